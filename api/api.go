@@ -1,9 +1,13 @@
 package api
 
 import (
+	"charles_communicator"
 	"common"
+	"context"
 	"device_info"
 	"encoding/json"
+	"errors"
+	"factory"
 	"fmt"
 	"gablogger"
 	"net/http"
@@ -27,34 +31,46 @@ func Start() {
 	}
 
 	mux := http.NewServeMux()
-	routes := map[string]func() (string, error){
-		"/diagnosis/modem/signal-strength":  peripherals.GetModemSignalStrength,
-		"/diagnosis/modem/sim-card-type":    peripherals.GetSIMCardType,
-		"/diagnosis/modem/sim-card-iccid":   peripherals.GetSIMCardICCID,
-		"/diagnosis/modem/sim-card-carrier": peripherals.GetSIMCardCarrier,
-		"/diagnosis/power/source":           peripherals.GetPowerSource,
-		"/diagnosis/power/bms":              peripherals.GetHasBMS,
-		"/diagnosis/power/battery-level":    peripherals.GetBatteryLevel,
-		"/diagnosis/stm32/firmware-version": peripherals.GetFirmwareVersion,
-		"/diagnosis/stm32/temperature":      peripherals.GetSTM32Temperature,
-		"/diagnosis/fabrication/pcb-batch":  peripherals.GetPCBBatch,
-		"/diagnosis/fabrication/pcb-review": peripherals.GetPCBReview,
-		"/diagnosis/socketxp/status":        socketxp.IsConnected,
-		"/diagnosis/device/serial-number":   device_info.GetDeviceId,
-		"/diagnosis/device/os-version":      device_info.GetOSVersion,
-		"/diagnosis/network/priority-route": network_info.GetPriorityRoute,
-		"/diagnosis/network/modem":          network_info.GetModemInterfaceStatus,
-		"/diagnosis/network/wired":          network_info.GetWiredInterfaceStatus,
+	routes := map[string]func(context.Context) (string, error){
+		"/diagnosis/stm32/watchdog":         withoutContext(peripherals.GetWatchdogStatus),
+		"/diagnosis/socketxp/status":        withoutContext(socketxp.IsConnected),
+		"/diagnosis/device/serial-number":   withoutContext(device_info.GetDeviceId),
+		"/diagnosis/device/os-version":      withoutContext(device_info.GetOSVersion),
+		"/diagnosis/network/priority-route": withoutContext(network_info.GetPriorityRoute),
+		"/diagnosis/network/modem":          withoutContext(network_info.GetModemInterfaceStatus),
+		"/diagnosis/network/wired":          withoutContext(network_info.GetWiredInterfaceStatus),
+	}
+	// The STM32 routes come from the command registry
+	routeCommands := make(map[string]uint8)
+	for _, command := range charles_communicator.Commands() {
+		if command.APIPath != "" {
+			routes[command.APIPath] = peripherals.ContextGetter(command.Id)
+			routeCommands[command.APIPath] = command.Id
+		}
 	}
 
 	// Register the routes with the router
 	for path, handler := range routes {
 		pathCopy := path // Copy to avoid variable capture in loop
 		handlerCopy := handler
+		var decode func(string) (interface{}, bool, error)
+		if command, ok := routeCommands[path]; ok {
+			decode = func(data string) (interface{}, bool, error) {
+				return peripherals.DecodeValue(command, data)
+			}
+		}
 		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-			handleGenericRequest(w, r, handlerCopy, pathCopy)
+			handleGenericRequest(w, r, handlerCopy, decode, pathCopy)
 		})
 	}
+	mux.HandleFunc("/diagnosis/stm32/link-statistics", handleLinkStatistics)
+	mux.HandleFunc("/factory-test", handleFactoryTest)
+	mux.HandleFunc("/actions/modem/power-cycle", func(w http.ResponseWriter, r *http.Request) {
+		handlePowerCycle(w, r, peripherals.PowerCycleModem)
+	})
+	mux.HandleFunc("/actions/poe/power-cycle", func(w http.ResponseWriter, r *http.Request) {
+		handlePowerCycle(w, r, peripherals.PowerCyclePoE)
+	})
 
 	Logger.Debug("Starting API Server in port: ", common.API_PORT)
 	err := http.ListenAndServe(":"+common.API_PORT, mux)
@@ -64,19 +80,33 @@ func Start() {
 	Logger.Debug("Server iniciado")
 }
 
-func handleGenericRequest(w http.ResponseWriter, r *http.Request, handler func() (string, error), path string) {
+// handleGenericRequest answers the string returned by the handler in "data". When decode is given
+// and the command has a typed getter, the parsed value is answered in "value" as well.
+func handleGenericRequest(w http.ResponseWriter, r *http.Request, handler func(context.Context) (string, error), decode func(string) (interface{}, bool, error), path string) {
 	Logger.Debugf("Received request at %s", path)
 
-	response, err := handler()
+	response, err := handler(r.Context())
 	w.Header().Set("Content-Type", "application/json")
 
+	if errors.Is(err, context.Canceled) {
+		Logger.Debugf("Request at %s canceled by the client", path)
+		return
+	}
 	if err != nil {
 		Logger.Errorf("Error processing request at %s: %v", path, err)
-		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		writeJSONError(w, err.Error(), statusCodeFromError(err))
 		return
 	}
 
 	dataResponse := map[string]interface{}{"data": response}
+	if decode != nil {
+		value, typed, err := decode(response)
+		if err != nil {
+			Logger.Warnf("Cannot decode the value of %s: %v", path, err)
+		} else if typed {
+			dataResponse["value"] = value
+		}
+	}
 
 	if err := json.NewEncoder(w).Encode(dataResponse); err != nil {
 		Logger.Errorf("Error encoding response for request at %s: %v", path, err)
@@ -87,6 +117,99 @@ func handleGenericRequest(w http.ResponseWriter, r *http.Request, handler func()
 	Logger.Debugf("Response sent for request at %s: %v", path, dataResponse)
 }
 
+// handleLinkStatistics answers the STM32 link counters as a JSON object, instead of the string
+// data of the other routes.
+func handleLinkStatistics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dataResponse := map[string]interface{}{"data": peripherals.GetLinkStatistics()}
+	if err := json.NewEncoder(w).Encode(dataResponse); err != nil {
+		Logger.Errorf("Error encoding link statistics: %v", err)
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleFactoryTest runs the factory test on POST and answers the report of the last one on GET.
+func handleFactoryTest(w http.ResponseWriter, r *http.Request) {
+	var report *factory.Report
+	switch r.Method {
+	case http.MethodGet:
+		report = factory.LastReport()
+		if report == nil {
+			writeJSONError(w, "no factory test ran", http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		var err error
+		report, err = factory.Run(r.Context())
+		if errors.Is(err, factory.ErrTestRunning) {
+			writeJSONError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			Logger.Errorf("Factory test failed: %v", err)
+			writeJSONError(w, err.Error(), statusCodeFromError(err))
+			return
+		}
+	default:
+		writeJSONError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"data": report}); err != nil {
+		Logger.Errorf("Error encoding factory test report: %v", err)
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handlePowerCycle runs a power-cycle on POST. The modem can be reset while it is the only
+// uplink with ?force=true. The request is answered once the STM32 accepted the reset, the
+// interface is verified afterwards.
+func handlePowerCycle(w http.ResponseWriter, r *http.Request, powerCycle func(context.Context, peripherals.PowerCycleOptions) error) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	options := peripherals.PowerCycleOptions{Requester: "api " + r.RemoteAddr, Force: force}
+	if err := powerCycle(r.Context(), options); err != nil {
+		Logger.Errorf("Power-cycle at %s refused or failed: %v", r.URL.Path, err)
+		writeJSONError(w, err.Error(), statusCodeFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"data": "OK"}); err != nil {
+		Logger.Errorf("Error encoding power-cycle response: %v", err)
+	}
+}
+
+// withoutContext adapts a function that does not depend on the STM32 to the routes table.
+func withoutContext(handler func() (string, error)) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		return handler()
+	}
+}
+
+func statusCodeFromError(err error) int {
+	switch {
+	case errors.Is(err, charles_communicator.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, charles_communicator.ErrRemote):
+		return http.StatusBadGateway
+	case errors.Is(err, charles_communicator.ErrPortClosed), errors.Is(err, charles_communicator.ErrSupervisorDisabled),
+		errors.Is(err, charles_communicator.ErrMaintenance):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, peripherals.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, peripherals.ErrOnlyUplink):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func writeJSONError(w http.ResponseWriter, reason string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
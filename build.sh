@@ -12,6 +12,10 @@ ldflags+=" -X 'common.SFTP_SERVER=$SFTP_SERVER'"
 ldflags+=" -X 'common.SFTP_PORT=$SFTP_PORT'"
 ldflags+=" -X 'common.SFTP_USER=$SFTP_USER'"
 ldflags+=" -X 'common.SFTP_PASS=$SFTP_PASS'"
+ldflags+=" -X 'common.ARTIFACT_SOURCE=$ARTIFACT_SOURCE'"
+ldflags+=" -X 'common.ARTIFACT_URL=$ARTIFACT_URL'"
+ldflags+=" -X 'common.ARTIFACT_TOKEN=$ARTIFACT_TOKEN'"
+ldflags+=" -X 'common.UPDATE_PUBLIC_KEY=$UPDATE_PUBLIC_KEY'"
 ldflags+=" -X 'common.DATADOG_HOST=$DATADOG_HOST'"
 ldflags+=" -X 'common.DATADOG_API_KEY=$DATADOG_API_KEY'"
 ldflags+=" -X 'common.API_PORT=$API_PORT'"
@@ -21,4 +25,4 @@ cd main
 env GOOS=linux GOARCH=mipsle GOMIPS=softfloat go build -tags ${ENVIRONMENT} -trimpath -ldflags="$ldflags" -o ../bin/CharlesGo || exit -1
 go build -trimpath -tags staging -ldflags="$ldflags" -o ../bin/LinuxGo || exit -1
 
-unset VERSION ENVIRONMENT MAGIC_KEY MQTT_BROKER MQTT_PORT SFTP_SERVER SFTP_PORT SFTP_USER SFTP_PASS DATADOG_HOST DATADOG_API_KEY API_PORT
\ No newline at end of file
+unset VERSION ENVIRONMENT MAGIC_KEY MQTT_BROKER MQTT_PORT SFTP_SERVER SFTP_PORT SFTP_USER SFTP_PASS ARTIFACT_SOURCE ARTIFACT_URL ARTIFACT_TOKEN UPDATE_PUBLIC_KEY DATADOG_HOST DATADOG_API_KEY API_PORT
\ No newline at end of file
@@ -0,0 +1,177 @@
+package charles_communicator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CAPTURE_INBOUND  = "in"
+	CAPTURE_OUTBOUND = "out"
+)
+
+// CaptureRecord is a message exchanged with the STM32, as written in a capture file (one JSON
+// object per line). TypeName and CommandName are only there to make the file readable. Data holds
+// the bytes of the message, base64 encoded in the file, since the binary payloads are not valid
+// UTF-8 strings.
+type CaptureRecord struct {
+	Time        time.Time `json:"time"`
+	Direction   string    `json:"direction"`
+	Version     uint8     `json:"version"`
+	Type        uint8     `json:"type"`
+	TypeName    string    `json:"type_name"`
+	Command     uint8     `json:"command"`
+	CommandName string    `json:"command_name"`
+	MessageId   uint16    `json:"message_id"`
+	Data        []byte    `json:"data"`
+}
+
+// Capture writes the messages exchanged with the STM32 to a file. When the file reaches maxSize
+// bytes it is renamed with the suffix .1, the older ones are shifted up to .maxFiles and the
+// oldest one is removed.
+type Capture struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func NewCapture(path string, maxSize int64, maxFiles int) (*Capture, error) {
+	capture := &Capture{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := capture.open(); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+func (c *Capture) open() error {
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	c.file = file
+	c.size = info.Size()
+	return nil
+}
+
+func (c *Capture) rotate() error {
+	c.file.Close()
+	c.file = nil
+	for i := c.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	if c.maxFiles > 0 {
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(c.path); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+// Record appends a message to the capture. direction is CAPTURE_INBOUND or CAPTURE_OUTBOUND.
+func (c *Capture) Record(direction string, message *CharlesMessage) {
+	line, err := json.Marshal(CaptureRecord{
+		Time:        time.Now(),
+		Direction:   direction,
+		Version:     message.version,
+		Type:        message.messageType,
+		TypeName:    TypeToString(message.messageType),
+		Command:     message.command,
+		CommandName: CommandToString(message.command),
+		MessageId:   message.messageId,
+		Data:        []byte(message.data),
+	})
+	if err != nil {
+		Logger.Errorln("Cannot encode capture record:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return
+	}
+	if c.maxSize > 0 && c.size > 0 && c.size+int64(len(line)) > c.maxSize {
+		if err := c.rotate(); err != nil {
+			Logger.Errorln("Cannot rotate capture file:", err)
+			return
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	if err != nil {
+		Logger.Errorln("Cannot write capture file:", err)
+	}
+}
+
+func (c *Capture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// ReadCapture parses a capture file written by Capture.
+func ReadCapture(reader io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*MAX_MESSAGE_DATA_SIZE)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func (r *CaptureRecord) message() *CharlesMessage {
+	return &CharlesMessage{
+		version:     r.Version,
+		messageType: r.Type,
+		command:     r.Command,
+		messageId:   r.MessageId,
+		dataLen:     uint16(len(r.Data) + 1),
+		data:        string(r.Data),
+	}
+}
+
+// SetCapture makes the handler record every message received or sent in capture. A nil capture
+// disables the recording.
+func (h *CharlesCommunicatorHandler) SetCapture(capture *Capture) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.capture = capture
+}
+
+func (h *CharlesCommunicatorHandler) record(direction string, message *CharlesMessage) {
+	h.mutex.Lock()
+	capture := h.capture
+	h.mutex.Unlock()
+	if capture != nil {
+		capture.Record(direction, message)
+	}
+}
@@ -0,0 +1,164 @@
+package charles_communicator
+
+import (
+	"initializer"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readCaptureFile(t *testing.T, path string) []CaptureRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Cannot open capture: %v", err)
+	}
+	defer file.Close()
+	records, err := ReadCapture(file)
+	if err != nil {
+		t.Fatalf("Cannot read capture: %v", err)
+	}
+	return records
+}
+
+func TestCaptureRotatesFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, err := NewCapture(path, 400, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer capture.Close()
+
+	for i := 0; i < 10; i++ {
+		capture.Record(CAPTURE_INBOUND, &CharlesMessage{messageType: MSG_TYPE_GET, command: MSG_CMD_GET_WATCHDOG, messageId: uint16(2 * i)})
+	}
+
+	for _, suffix := range []string{"", ".1", ".2"} {
+		info, err := os.Stat(path + suffix)
+		if err != nil {
+			t.Fatalf("Expected capture file %s, got: %v", path+suffix, err)
+		}
+		if info.Size() > 400 {
+			t.Errorf("Expected %s with at most 400 bytes, got: %d", path+suffix, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 rotated files")
+	}
+	records := readCaptureFile(t, path)
+	if last := records[len(records)-1]; last.MessageId != 18 || last.CommandName != "WATCHDOG" {
+		t.Errorf("Expected the last record in the current file, got: %+v", last)
+	}
+}
+
+func TestHandlerCapturesInboundAndOutboundMessages(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = echoResponse
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, _ := NewCapture(path, 0, 0)
+	handler.SetCapture(capture)
+	go handler.Start()
+	defer handler.Stop()
+
+	if _, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_OS_VERSION, "1.2.3", 1000); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	capture.Close()
+
+	records := readCaptureFile(t, path)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got: %d", len(records))
+	}
+	if records[0].Direction != CAPTURE_OUTBOUND || records[0].Type != MSG_TYPE_SET || string(records[0].Data) != "1.2.3" {
+		t.Errorf("Unexpected outbound record: %+v", records[0])
+	}
+	if records[1].Direction != CAPTURE_INBOUND || records[1].Type != MSG_TYPE_RESP || records[1].MessageId != records[0].MessageId {
+		t.Errorf("Unexpected inbound record: %+v", records[1])
+	}
+}
+
+func TestReplayFeedsCaptureIntoHandler(t *testing.T) {
+	initializer.LoadConfig("")
+	handler := NewCharlesCommunicatorHandler(NewReplayTransport())
+	handler.SetPacingInterval(0)
+	handler.SetMaxProtocolVersion(PROTOCOL_VERSION_ASCII)
+	handler.OpenPort()
+	tamperEvents := 0
+	handler.RegisterFunctionToRcvMsg(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(messageType, command uint8, message string, messageToken, externalData interface{}) {
+		tamperEvents++
+		handler.SendRespMessage(messageToken.(*CharlesMessage), "OK")
+	}, nil)
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	capture, _ := NewCapture(path, 0, 0)
+	handler.SetCapture(capture)
+	go handler.Start()
+	defer handler.Stop()
+
+	records := []CaptureRecord{
+		{Direction: CAPTURE_OUTBOUND, Type: MSG_TYPE_GET, Command: MSG_CMD_MODEM_SIGNAL, MessageId: 41},
+		{Direction: CAPTURE_INBOUND, Type: MSG_TYPE_SET, Command: MSG_CMD_TAMPER_EVENT, MessageId: 8, Data: []byte("Open")},
+		{Direction: CAPTURE_OUTBOUND, Type: MSG_TYPE_RESP, Command: MSG_CMD_TAMPER_EVENT, MessageId: 8, Data: []byte("OK")},
+		{Direction: CAPTURE_INBOUND, Version: PROTOCOL_VERSION_BINARY, Type: MSG_TYPE_RESP, Command: MSG_CMD_MODEM_SIGNAL, MessageId: 41, Data: []byte("-70")},
+	}
+	if err := handler.Replay(records, 0); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if tamperEvents != 1 {
+		t.Errorf("Expected 1 tamper event, got: %d", tamperEvents)
+	}
+	handler.mutex.Lock()
+	waiting := handler.messagesWaitingResponse.Len()
+	handler.mutex.Unlock()
+	if waiting != 0 {
+		t.Errorf("Expected the replayed GET to be answered, %d messages still waiting", waiting)
+	}
+
+	// The reply to the tamper event is written by the send loop
+	waitFor(t, func() bool {
+		for _, record := range readCaptureFile(t, path) {
+			if record.Direction == CAPTURE_OUTBOUND && record.Type == MSG_TYPE_RESP && record.Command == MSG_CMD_TAMPER_EVENT {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestReplayedCaptureKeepsBinaryData(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, _ := NewCapture(path, 0, 0)
+	capture.Record(CAPTURE_INBOUND, &CharlesMessage{version: PROTOCOL_VERSION_BINARY, messageType: MSG_TYPE_SET, command: MSG_CMD_TAMPER_EVENT, messageId: 8, data: string(data)})
+	capture.Close()
+	records := readCaptureFile(t, path)
+	if len(records) != 1 || string(records[0].Data) != string(data) {
+		t.Fatalf("Expected the bytes 0x00-0xFF read back, got: %v", records)
+	}
+
+	initializer.LoadConfig("")
+	handler := NewCharlesCommunicatorHandler(NewReplayTransport())
+	handler.SetPacingInterval(0)
+	handler.OpenPort()
+	received := make(chan string, 1)
+	handler.RegisterFunctionToRcvMsg(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(messageType, command uint8, message string, messageToken, externalData interface{}) {
+		received <- message
+	}, nil)
+	go handler.Start()
+	defer handler.Stop()
+
+	if err := handler.Replay(records, 0); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	select {
+	case message := <-received:
+		if message != string(data) {
+			t.Errorf("Expected the captured bytes replayed, got: %x", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the captured message replayed")
+	}
+}
@@ -1,14 +1,16 @@
 package charles_communicator
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"fmt"
 	"gablogger"
 	"initializer"
 	"io"
 	"reflect"
+	"strconv"
 	"time"
-
-	"github.com/tarm/serial"
 )
 
 var Logger = gablogger.Logger()
@@ -22,103 +24,356 @@ func GetCharlesCommunicatorHandler() *CharlesCommunicatorHandler {
 }
 
 func InitCC() {
-	CCHandler = &CharlesCommunicatorHandler{
-		config:      &serial.Config{Name: "/dev/ttyS1", Baud: 115200, ReadTimeout: time.Millisecond * 500},
-		rcvMsgState: WAITING_FOR_MESSAGE,
+	InitCCWithTransport(NewSerialTransport(initializer.GetSerialDevice(), initializer.GetSerialBaud()))
+}
+
+// InitCCWithTransport initializes the global handler over the given transport, e.g. a PTY or a
+// TCP connection to a simulated STM32.
+func InitCCWithTransport(transport Transport) {
+	CCHandler = NewCharlesCommunicatorHandler(transport)
+	CCHandler.SetPacingInterval(initializer.GetSerialPacingInterval())
+	CCHandler.SetMaxProtocolVersion(uint8(initializer.GetSerialMaxProtocolVersion()))
+	CCHandler.SetReconnectDelays(initializer.GetSerialReconnectDelays())
+	if _, isSerial := transport.(*SerialTransport); isSerial {
+		baud := initializer.GetSerialBaud()
+		// The modem ports must never receive Charles frames
+		CCHandler.SetPortProbing(initializer.GetSerialProbeDevices(), initializer.GetFactoryTestModemDevices(), func(device string) Transport {
+			return NewSerialTransport(device, baud)
+		})
+	}
+	if captureFile := initializer.GetSerialCaptureFile(); captureFile != "" {
+		capture, err := NewCapture(captureFile, int64(initializer.GetSerialCaptureMaxSizeKB())*1024, initializer.GetSerialCaptureMaxFiles())
+		if err != nil {
+			Logger.Errorf("Cannot open capture file %s: %v", captureFile, err)
+		} else {
+			Logger.Infoln("Capturing STM32 messages to", captureFile)
+			CCHandler.SetCapture(capture)
+		}
 	}
 	OpenPort()
 }
 
+func NewCharlesCommunicatorHandler(transport Transport) *CharlesCommunicatorHandler {
+	return &CharlesCommunicatorHandler{
+		transport:             transport,
+		pacingInterval:        DEFAULT_PACING_INTERVAL,
+		maxProtocolVersion:    PROTOCOL_VERSION,
+		linkState:             LINK_STATE_DISCONNECTED,
+		reconnectInitialDelay: DEFAULT_RECONNECT_INITIAL_DELAY,
+		reconnectMaxDelay:     DEFAULT_RECONNECT_MAX_DELAY,
+		reconnectRequested:    make(chan struct{}, 1),
+		stats:                 newLinkStatistics(),
+		messageQueued:         make(chan struct{}, 1),
+		inbound:               make(chan *CharlesMessage, INBOUND_QUEUE_SIZE),
+		stop:                  make(chan struct{}),
+	}
+}
+
+// SetPacingInterval sets the minimum interval between two frames written to the STM32.
+func (h *CharlesCommunicatorHandler) SetPacingInterval(interval time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.pacingInterval = interval
+}
+
+func (h *CharlesCommunicatorHandler) getPacingInterval() time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.pacingInterval
+}
+
+// SetMaxProtocolVersion sets the highest protocol version offered to the STM32 in the handshake.
+// With PROTOCOL_VERSION_ASCII the handshake is not sent and the link stays on version 0.
+func (h *CharlesCommunicatorHandler) SetMaxProtocolVersion(version uint8) {
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.maxProtocolVersion = version
+}
+
+// ProtocolVersion returns the protocol version negotiated with the STM32.
+func (h *CharlesCommunicatorHandler) ProtocolVersion() uint8 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.protocolVersion
+}
+
+func (h *CharlesCommunicatorHandler) setProtocolVersion(version uint8) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.protocolVersion = version
+}
+
+// negotiateProtocolVersion offers the highest supported protocol version to the STM32, which
+// answers with the version to be used. Firmwares that only know version 0 answer the handshake
+// with an error, or do not answer it, and the link stays on version 0.
+func (h *CharlesCommunicatorHandler) negotiateProtocolVersion() {
+	h.mutex.Lock()
+	maxVersion := h.maxProtocolVersion
+	h.mutex.Unlock()
+	if maxVersion == PROTOCOL_VERSION_ASCII {
+		return
+	}
+
+	response, err := h.sendRequest(context.Background(), MSG_TYPE_GET, MSG_CMD_PROTOCOL_VERSION, strconv.Itoa(int(maxVersion)), CommandTimeout(MSG_CMD_PROTOCOL_VERSION))
+	if err != nil {
+		Logger.Infof("Protocol version handshake failed (%v), using protocol version %d", err, PROTOCOL_VERSION_ASCII)
+		return
+	}
+	version, err := strconv.Atoi(response.Data)
+	if err != nil || version < PROTOCOL_VERSION_ASCII || version > int(maxVersion) {
+		Logger.Warnf("Invalid protocol version '%s' received, using protocol version %d", response.Data, PROTOCOL_VERSION_ASCII)
+		return
+	}
+	h.setProtocolVersion(uint8(version))
+	Logger.Infof("Using protocol version %d", version)
+}
+
+// acceptNegotiatedFraming lets the decoder accept the binary frames as soon as the STM32 answers
+// the handshake with version 1, before the next byte is read, since the STM32 switches to the
+// binary framing right after its answer.
+func (h *CharlesCommunicatorHandler) acceptNegotiatedFraming(message *CharlesMessage) {
+	if message.messageType != MSG_TYPE_RESP || message.command != MSG_CMD_PROTOCOL_VERSION {
+		return
+	}
+	h.mutex.Lock()
+	maxVersion := h.maxProtocolVersion
+	h.mutex.Unlock()
+	if version, err := strconv.Atoi(message.data); err == nil && version >= PROTOCOL_VERSION_BINARY && version <= int(maxVersion) {
+		h.frameDecoder.SetBinaryFraming(true)
+	}
+}
+
 func ClosePort() {
-	Logger.Debugln("Closing port", CCHandler.config.Name)
+	CCHandler.ClosePort()
+}
 
-	CCHandler.ValidPort = false
-	CCHandler.port.Flush()
-	err := CCHandler.port.Close()
+func OpenPort() bool {
+	return CCHandler.OpenPort()
+}
+
+// ClosePort closes the transport, which is not reopened until OpenPort is called, and fails
+// every pending request with ErrPortClosed.
+func (h *CharlesCommunicatorHandler) ClosePort() {
+	h.mutex.Lock()
+	h.wantPort = false
+	h.mutex.Unlock()
+	h.closePort()
+}
+
+func (h *CharlesCommunicatorHandler) closePort() {
+	Logger.Debugln("Closing port", h.transportName())
+
+	h.portMutex.Lock()
+	h.validPort = false
+	h.transport.Flush()
+	err := h.transport.Close()
 	if err != nil {
 		Logger.Infoln("Error closing serial port:", err)
 	}
+	h.portMutex.Unlock()
+
+	h.setLinkState(LINK_STATE_DISCONNECTED)
+	h.failPendingRequests(ErrPortClosed)
 }
 
-func OpenPort() bool {
-	Logger.Debugln("Opening port", CCHandler.config.Name)
+// OpenPort opens the transport, probing the candidate devices first when SetPortProbing was
+// called. When it fails, the port is reopened in the background, with exponential backoff,
+// until it succeeds or ClosePort is called. It fails while the link is in maintenance.
+func (h *CharlesCommunicatorHandler) OpenPort() bool {
+	h.mutex.Lock()
+	if h.maintenance {
+		h.mutex.Unlock()
+		Logger.Warnln("Cannot open the STM32 port in maintenance")
+		return false
+	}
+	h.wantPort = true
+	h.mutex.Unlock()
 
-	port, err := serial.OpenPort(CCHandler.config)
+	h.discoverPort()
+	if h.openPort() {
+		return true
+	}
+	h.requestReconnect()
+	return false
+}
+
+func (h *CharlesCommunicatorHandler) openPort() bool {
+	h.portMutex.Lock()
+	Logger.Debugln("Opening port", h.transport.Name())
+	err := h.transport.Open()
 	if err != nil {
-		Logger.Errorf("Error opening port %s: %s", CCHandler.config.Name, err)
+		h.portMutex.Unlock()
+		Logger.Errorf("Error opening port %s: %s", h.transport.Name(), err)
 		return false
 	}
-	CCHandler.port = port
-	CCHandler.ValidPort = true
+	h.validPort = true
+	h.portMutex.Unlock()
+	h.stats.portOpen()
+	h.setLinkState(LINK_STATE_CONNECTED)
+
+	// The STM32 may have been reset or reflashed while the port was closed
+	h.mutex.Lock()
+	h.protocolVersion = PROTOCOL_VERSION_ASCII
+	isRunning := h.running
+	h.mutex.Unlock()
+	h.frameDecoder.SetBinaryFraming(false)
+	if isRunning {
+		go h.negotiateProtocolVersion()
+	}
 	return true
 }
 
+func (h *CharlesCommunicatorHandler) IsPortValid() bool {
+	h.portMutex.RLock()
+	defer h.portMutex.RUnlock()
+	return h.validPort
+}
+
+// readPort reads from the transport holding the port lock, so the port cannot be closed in the
+// middle of a read. Reads and writes can run at the same time. It returns ErrPortClosed if the port is not open.
+func (h *CharlesCommunicatorHandler) readPort(buf []byte) (int, error) {
+	h.portMutex.RLock()
+	defer h.portMutex.RUnlock()
+	if !h.validPort {
+		return 0, ErrPortClosed
+	}
+	return h.transport.Read(buf)
+}
+
+func (h *CharlesCommunicatorHandler) writePort(buf []byte) (int, error) {
+	h.portMutex.RLock()
+	defer h.portMutex.RUnlock()
+	if !h.validPort {
+		return 0, ErrPortClosed
+	}
+	return h.transport.Write(buf)
+}
+
+func (h *CharlesCommunicatorHandler) isStopped() bool {
+	select {
+	case <-h.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop makes Start and the send loop return and fails every pending request with
+// ErrSupervisorDisabled.
+func (h *CharlesCommunicatorHandler) Stop() {
+	close(h.stop)
+	h.failPendingRequests(ErrSupervisorDisabled)
+}
+
 func (h *CharlesCommunicatorHandler) Start() {
 	if !initializer.IsSupervisorEnable() {
 		Logger.Debugln("Supervisor is disabled")
 		return
 	}
 	Logger.Infoln("Charles Communicator Handler started!")
+	h.mutex.Lock()
+	h.running = true
+	h.mutex.Unlock()
+	go h.sendLoop()
+	go h.inboundLoop()
+	go h.reconnectLoop()
+	go h.negotiateProtocolVersion()
+
 	var err error
 	var n int
-	buf := make([]byte, 1)
-	for {
-		for {
-			if h.ValidPort {
-				n, err = h.port.Read(buf)
-				break
-			} else {
-				time.Sleep(500 * time.Millisecond)
-			}
-		}
-		if err != nil && err != io.EOF {
+	buf := make([]byte, 64)
+	for !h.isStopped() {
+		n, err = h.readPort(buf)
+		if err == ErrPortClosed {
+			time.Sleep(500 * time.Millisecond)
+		} else if err != nil && err != io.EOF {
 			Logger.Errorf("Error in stm Handler: %v\n", err)
-			ClosePort()
-			time.Sleep(2 * time.Second)
-			OpenPort()
+			h.stats.readError()
+			h.closePort()
+			h.requestReconnect()
 		} else {
-			if n > 0 {
-				switch buf[0] {
-				case '[':
-					h.rcvMsgState = RECEIVING_DATA
-					h.rcvMsgBufferControl = 0
-				case ']':
-					if h.rcvMsgState == RECEIVING_DATA {
-						h.rcvMsgBuffer[h.rcvMsgBufferControl] = byte('\x00')
-						h.rcvMsgBufferControl++
-						h.processMessage()
-					}
-					h.rcvMsgState = WAITING_FOR_MESSAGE
-				default:
-					if h.rcvMsgState == RECEIVING_DATA {
-						if h.rcvMsgBufferControl >= (BUFFER_SIZE - 1) {
-							h.rcvMsgState = WAITING_FOR_MESSAGE
-						} else {
-							h.rcvMsgBuffer[h.rcvMsgBufferControl] = buf[0]
-							h.rcvMsgBufferControl++
-						}
+			for _, b := range buf[:n] {
+				if message, complete := h.frameDecoder.Feed(b); complete {
+					if message != nil {
+						h.stats.messageReceived(message)
+						h.record(CAPTURE_INBOUND, message)
+						h.acceptNegotiatedFraming(message)
+					} else {
+						h.stats.frameDiscarded(h.frameDecoder.overflow)
 					}
+					h.receiveMessage(message)
 				}
-			} else {
-				h.checkWaitingTimeouts()
-				h.sendMessageIfExists()
 			}
 		}
 	}
+	Logger.Infoln("Charles Communicator Handler stopped!")
+}
+
+// receiveMessage handles a message read by Start. The GETs and SETs of the STM32 are queued for
+// the inbound loop, so a subscriber waiting for the response of a request does not keep Start
+// from reading it.
+func (h *CharlesCommunicatorHandler) receiveMessage(message *CharlesMessage) {
+	if message == nil || (message.messageType != MSG_TYPE_GET && message.messageType != MSG_TYPE_SET) {
+		h.processMessage(message)
+		return
+	}
+	select {
+	case h.inbound <- message:
+	default:
+		Logger.Warnf("Too many pending STM32 messages, rejecting %s %s", TypeToString(message.messageType), CommandToString(message.command))
+		h.SendErrorMessage(message, "busy")
+	}
+}
+
+// inboundLoop gives the GETs and SETs of the STM32 to their subscribers, in arrival order.
+func (h *CharlesCommunicatorHandler) inboundLoop() {
+	for {
+		select {
+		case <-h.stop:
+			return
+		case message := <-h.inbound:
+			h.processMessage(message)
+		}
+	}
+}
+
+// sendLoop writes the queued messages, respecting the pacing interval between frames, and
+// expires the messages waiting for a response and the incomplete fragmented messages.
+func (h *CharlesCommunicatorHandler) sendLoop() {
+	ticker := time.NewTicker(TIMEOUT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		case <-h.messageQueued:
+		}
+
+		h.checkWaitingTimeouts()
+		h.frameDecoder.expireFragments()
+		for h.sendMessageIfExists() {
+			select {
+			case <-h.stop:
+				return
+			case <-time.After(h.getPacingInterval()):
+			}
+			h.checkWaitingTimeouts()
+		}
+	}
 }
 
-func (h *CharlesCommunicatorHandler) processMessage() {
-	rawMessage := string(h.rcvMsgBuffer[:])
-	rawMessage = rawMessage[:(h.rcvMsgBufferControl - 1)]
-	message := decodeCharlesMessage(rawMessage)
+func (h *CharlesCommunicatorHandler) processMessage(message *CharlesMessage) {
 	if message != nil {
 		switch message.messageType {
 		case MSG_TYPE_GET:
 			fallthrough
 		case MSG_TYPE_SET:
-			if !h.callRespFunc(message) {
-				h.SendErrorMessage(message, "unsupported command")
-			}
+			h.dispatchInbound(message)
 		case MSG_TYPE_RESP:
 			fallthrough
 		case MSG_TYPE_ERROR:
@@ -127,47 +382,43 @@ func (h *CharlesCommunicatorHandler) processMessage() {
 	}
 }
 
-func (h *CharlesCommunicatorHandler) callRespFunc(message *CharlesMessage) bool {
-	for e := h.respFunctionsList.Front(); e != nil; e = e.Next() {
-		respFunction, ok := e.Value.(*RespFuction)
-		if ok {
-			if respFunction.command == message.command && respFunction.messageType == message.messageType {
-				if respFunction.respFunction != nil {
-					respFunction.respFunction(message.messageType, message.command, message.data, message, respFunction.externalData)
-				}
-				return true
-			}
-		}
+func (h *CharlesCommunicatorHandler) callWaitingRespFunc(message *CharlesMessage) bool {
+	messageWaiting := h.removeWaitingMessage(message.messageId)
+	if messageWaiting == nil {
+		return false
 	}
-	return false
+	h.stats.responseReceived(messageWaiting, message)
+	if messageWaiting.reqFunc != nil {
+		messageWaiting.reqFunc(message.messageType, message.command, message.data, message, messageWaiting.externalData)
+	}
+	return true
 }
 
-func (h *CharlesCommunicatorHandler) callWaitingRespFunc(message *CharlesMessage) bool {
+func (h *CharlesCommunicatorHandler) removeWaitingMessage(messageId uint16) *CharlesMessage {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
 	for e := h.messagesWaitingResponse.Front(); e != nil; e = e.Next() {
 		messageWaiting, ok := e.Value.(*CharlesMessage)
-		if ok {
-
-			if message.messageId == messageWaiting.messageId {
-
-				if messageWaiting.reqFunc != nil {
-					messageWaiting.reqFunc(message.messageType, message.command, message.data, message, messageWaiting.externalData)
-				}
-				h.messagesWaitingResponse.Remove(e)
-				return true
-			}
+		if ok && messageWaiting.messageId == messageId {
+			h.messagesWaitingResponse.Remove(e)
+			return messageWaiting
 		}
 	}
-	return false
+	return nil
 }
 
 func (h *CharlesCommunicatorHandler) SendErrorMessage(messageToken *CharlesMessage, data string) {
+	if !h.claimReply(messageToken) {
+		Logger.Warnf("%s %s id=%d already answered, dropping reply", TypeToString(messageToken.messageType), CommandToString(messageToken.command), messageToken.messageId)
+		return
+	}
 	message := CharlesMessage{
 		version:             messageToken.version,
 		messageId:           messageToken.messageId,
 		messageType:         MSG_TYPE_ERROR,
 		command:             messageToken.command,
-		dataLen:             uint8(len(data) + 1),
+		dataLen:             uint16(len(data) + 1),
 		data:                data,
 		messageTimeout:      5000,
 		messageCreationTime: time.Now().UnixMilli(),
@@ -175,13 +426,19 @@ func (h *CharlesCommunicatorHandler) SendErrorMessage(messageToken *CharlesMessa
 	h.registerMessage(&message)
 }
 
+// SendRespMessage answers a GET or SET of the STM32. Only the first reply to a messageToken is
+// sent, SendErrorMessage included.
 func (h *CharlesCommunicatorHandler) SendRespMessage(messageToken *CharlesMessage, data string) {
+	if !h.claimReply(messageToken) {
+		Logger.Warnf("%s %s id=%d already answered, dropping reply", TypeToString(messageToken.messageType), CommandToString(messageToken.command), messageToken.messageId)
+		return
+	}
 	message := CharlesMessage{
 		version:             messageToken.version,
 		messageId:           messageToken.messageId,
 		messageType:         MSG_TYPE_RESP,
 		command:             messageToken.command,
-		dataLen:             uint8(len(data) + 1),
+		dataLen:             uint16(len(data) + 1),
 		data:                data,
 		messageTimeout:      5000,
 		messageCreationTime: time.Now().UnixMilli(),
@@ -190,17 +447,10 @@ func (h *CharlesCommunicatorHandler) SendRespMessage(messageToken *CharlesMessag
 }
 
 func (h *CharlesCommunicatorHandler) SendGetMessage(command uint8, data string, timeout int64, toRcvFunction pointerToCharlesFunction, externalData interface{}) error {
-	messageId, err := h.requestMessageId()
-	if err != nil {
-		return errors.New("cannot send message")
-	}
-
 	message := CharlesMessage{
-		version:             PROTOCOL_VERSION,
-		messageId:           messageId,
 		messageType:         MSG_TYPE_GET,
 		command:             command,
-		dataLen:             uint8(len(data) + 1),
+		dataLen:             uint16(len(data) + 1),
 		data:                data,
 		messageTimeout:      timeout,
 		messageCreationTime: time.Now().UnixMilli(),
@@ -208,23 +458,14 @@ func (h *CharlesCommunicatorHandler) SendGetMessage(command uint8, data string,
 		externalData:        externalData,
 	}
 
-	h.registerMessage(&message)
-
-	return nil
+	return h.registerRequest(&message)
 }
 
 func (h *CharlesCommunicatorHandler) SendSetMessage(command uint8, data string, timeout int64, toRcvFunction pointerToCharlesFunction, externalData interface{}) error {
-	messageId, err := h.requestMessageId()
-	if err != nil {
-		return errors.New("cannot send message")
-	}
-
 	message := CharlesMessage{
-		version:             PROTOCOL_VERSION,
-		messageId:           messageId,
 		messageType:         MSG_TYPE_SET,
 		command:             command,
-		dataLen:             uint8(len(data) + 1),
+		dataLen:             uint16(len(data) + 1),
 		data:                data,
 		messageTimeout:      timeout,
 		messageCreationTime: time.Now().UnixMilli(),
@@ -232,54 +473,94 @@ func (h *CharlesCommunicatorHandler) SendSetMessage(command uint8, data string,
 		externalData:        externalData,
 	}
 
-	h.registerMessage(&message)
+	return h.registerRequest(&message)
+}
 
-	return nil
+func (h *CharlesCommunicatorHandler) registerMessage(message *CharlesMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.maintenance {
+		Logger.Warnf("Dropping %s %s id=%d in maintenance", TypeToString(message.messageType), CommandToString(message.command), message.messageId)
+		return
+	}
+	h.queueMessage(message)
 }
 
-func (h *CharlesCommunicatorHandler) RegisterFunctionToRcvMsg(messageType, command uint8, respFunction pointerToCharlesFunction, externalData interface{}) {
-	newFunction := RespFuction{
-		respFunction: respFunction,
-		externalData: externalData,
-		messageType:  messageType,
-		command:      command,
+// queueMessage appends the message to the queue of its priority and wakes the send loop.
+// It must be called holding the handler lock.
+func (h *CharlesCommunicatorHandler) queueMessage(message *CharlesMessage) {
+	h.messagesToSend[messagePriority(message)].PushBack(message)
+	select {
+	case h.messageQueued <- struct{}{}:
+	default:
 	}
-	h.respFunctionsList.PushBack(&newFunction)
 }
 
-func (h *CharlesCommunicatorHandler) registerMessage(message *CharlesMessage) {
-	h.messagesToSendList.PushBack(message)
+// messagePriority returns the queue of a message: replies to the STM32 requests (including the
+// watchdog) are sent first, then the SETs and finally the GETs.
+func messagePriority(message *CharlesMessage) int {
+	switch message.messageType {
+	case MSG_TYPE_RESP, MSG_TYPE_ERROR:
+		return PRIORITY_REPLY
+	case MSG_TYPE_SET:
+		return PRIORITY_COMMAND
+	default:
+		return PRIORITY_TELEMETRY
+	}
+}
+
+// registerRequest validates a GET or SET against the command registry, assigns it a free
+// message id and queues it to be sent. Requests are rejected with ErrMaintenance while the link
+// is in maintenance.
+func (h *CharlesCommunicatorHandler) registerRequest(message *CharlesMessage) error {
+	if err := ValidateRequest(message.messageType, message.command, message.data); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.maintenance {
+		return ErrMaintenance
+	}
+
+	messageId, err := h.requestMessageId()
+	if err != nil {
+		return errors.New("cannot send message")
+	}
+	message.messageId = messageId
+	h.queueMessage(message)
+	return nil
 }
 
+// requestMessageId returns an odd message id not used by any pending message, the even ones
+// are used by the STM32. It must be called holding the handler lock.
 func (h *CharlesCommunicatorHandler) requestMessageId() (uint16, error) {
-	lastMessageId := h.msgIdControl
 	usedMessageIds := h.listAllUsedMessageIds()
-	for {
+	for trials := 0; trials < MAX_MESSAGE_IDS; trials++ {
 		pretendedMessageId := 2*(h.msgIdControl) + 1
-		h.msgIdControl++
+		h.msgIdControl = (h.msgIdControl + 1) % MAX_MESSAGE_IDS
 
 		if !usedMessageIds[pretendedMessageId] {
 			return pretendedMessageId, nil
 		}
-
-		if lastMessageId == pretendedMessageId {
-			return 0, errors.New("no message id available")
-		}
 	}
+	return 0, errors.New("no message id available")
 }
 
 func (h *CharlesCommunicatorHandler) listAllUsedMessageIds() map[uint16]bool {
 	listOfUsedMessageIds := make(map[uint16]bool)
 
-	for e := h.messagesToSendList.Front(); e != nil; e = e.Next() {
-		message, ok := e.Value.(CharlesMessage)
-		if ok {
-			listOfUsedMessageIds[message.messageId] = true
+	for priority := range h.messagesToSend {
+		for e := h.messagesToSend[priority].Front(); e != nil; e = e.Next() {
+			message, ok := e.Value.(*CharlesMessage)
+			if ok {
+				listOfUsedMessageIds[message.messageId] = true
+			}
 		}
 	}
 
 	for e := h.messagesWaitingResponse.Front(); e != nil; e = e.Next() {
-		message, ok := e.Value.(CharlesMessage)
+		message, ok := e.Value.(*CharlesMessage)
 		if ok {
 			listOfUsedMessageIds[message.messageId] = true
 		}
@@ -288,111 +569,284 @@ func (h *CharlesCommunicatorHandler) listAllUsedMessageIds() map[uint16]bool {
 	return listOfUsedMessageIds
 }
 
-func (h *CharlesCommunicatorHandler) sendMessageIfExists() {
+// sendMessageIfExists writes the next queued message and reports whether there was one.
+func (h *CharlesCommunicatorHandler) sendMessageIfExists() bool {
 	message, err := h.getMessageToSend()
 	if err == nil {
 		if message != nil {
 			message.messageCreationTime = time.Now().UnixMilli()
+			// Replies keep the version of the request they answer
+			if message.messageType == MSG_TYPE_GET || message.messageType == MSG_TYPE_SET {
+				message.version = h.ProtocolVersion()
+			}
 
-			serializedMessage, err := encodeCharlesMessage(message)
+			frames, err := encodeFrames(message)
 			if err == nil {
-				for {
-					if h.ValidPort {
-						_, err = h.port.Write([]byte(serializedMessage))
-						break
-					} else {
-						time.Sleep(500 * time.Millisecond)
-					}
+				// Register the message as waiting before writing it, so a fast response is not lost
+				switch message.messageType {
+				case MSG_TYPE_GET:
+					fallthrough
+				case MSG_TYPE_SET:
+					h.pushWaitingMessage(message)
 				}
+				// Recorded before writing, so the capture keeps requests before their responses
+				h.record(CAPTURE_OUTBOUND, message)
+				err = h.writeFrames(message, frames)
 				if err == nil {
-					switch message.messageType {
-					case MSG_TYPE_GET:
-						fallthrough
-					case MSG_TYPE_SET:
-						h.messagesWaitingResponse.PushBack(message)
-					}
+					h.stats.messageSent(message)
+				} else if err == ErrPortClosed {
+					h.failRequest(message, ErrPortClosed)
 				} else {
+					h.stats.writeError()
 					Logger.Errorln("Error writing to port", err)
 				}
+			} else {
+				// The message cannot be framed, e.g. its data is too long for the protocol version
+				notifyFailure(message, err)
 			}
 			if err != nil {
 				Logger.Errorln("Error sending message:", err)
 			}
+			return true
 		}
 	} else {
 		Logger.Errorln("Error requesting a message to send:", err)
+		return true
+	}
+	return false
+}
+
+// writeFrames writes the frames of a message, respecting the pacing interval between the
+// fragments of a long message. The response timeout starts after the last fragment.
+func (h *CharlesCommunicatorHandler) writeFrames(message *CharlesMessage, frames []string) error {
+	for i, frame := range frames {
+		if i > 0 {
+			select {
+			case <-h.stop:
+				return ErrSupervisorDisabled
+			case <-time.After(h.getPacingInterval()):
+			}
+		}
+		if _, err := h.writePort([]byte(frame)); err != nil {
+			return err
+		}
 	}
+	if len(frames) > 1 {
+		h.mutex.Lock()
+		message.messageCreationTime = time.Now().UnixMilli()
+		h.mutex.Unlock()
+	}
+	return nil
+}
+
+func (h *CharlesCommunicatorHandler) pushWaitingMessage(message *CharlesMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.messagesWaitingResponse.PushBack(message)
 }
 
 func (h *CharlesCommunicatorHandler) getMessageToSend() (*CharlesMessage, error) {
-	if h.messagesToSendList.Len() > 0 {
-		listElement := h.messagesToSendList.Back()
-		message, ok := listElement.Value.(*CharlesMessage)
-		h.messagesToSendList.Remove(listElement)
-		if ok {
-			return message, nil
-		} else {
-			return nil, errors.New("cannot decode element of message list, removing it")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for priority := range h.messagesToSend {
+		if h.messagesToSend[priority].Len() > 0 {
+			listElement := h.messagesToSend[priority].Front()
+			message, ok := listElement.Value.(*CharlesMessage)
+			h.messagesToSend[priority].Remove(listElement)
+			if ok {
+				return message, nil
+			} else {
+				return nil, errors.New("cannot decode element of message list, removing it")
+			}
 		}
 	}
 	return nil, nil
 }
 
 func (h *CharlesCommunicatorHandler) checkWaitingTimeouts() {
-	actualTime := time.Now().UnixMilli()
+	for _, message := range h.removeExpiredMessages() {
+		h.stats.timeout(message.command)
+		if message.reqFunc != nil {
+			message.reqFunc(MSG_TYPE_TIMEOUT, message.command, "", message, message.externalData)
+		}
+	}
+}
 
-	for e := h.messagesWaitingResponse.Front(); e != nil; e = e.Next() {
+func (h *CharlesCommunicatorHandler) removeExpiredMessages() []*CharlesMessage {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	actualTime := time.Now().UnixMilli()
+	var expiredMessages []*CharlesMessage
+	var next *list.Element
+	for e := h.messagesWaitingResponse.Front(); e != nil; e = next {
+		next = e.Next()
 		message, ok := e.Value.(*CharlesMessage)
 		if ok {
 			if (actualTime - message.messageCreationTime) > message.messageTimeout {
-				if message.reqFunc != nil {
-					message.reqFunc(MSG_TYPE_TIMEOUT, message.command, "", message, message.externalData)
-				}
+				expiredMessages = append(expiredMessages, message)
 				h.messagesWaitingResponse.Remove(e)
 			}
 		}
 	}
+	return expiredMessages
+}
+
+// SendMessageContext sends a GET or SET to the STM32 and waits for its response. The request
+// is removed from the queue if the context is done first. Each attempt waits up to the Timeout
+// of the command in the registry, bounded by the context deadline, and idempotent GETs are
+// repeated according to their RetryPolicy.
+//
+// The returned errors match ErrTimeout, ErrRemote, ErrPortClosed, ErrSupervisorDisabled,
+// ErrInvalidRequest or ErrMaintenance, or are the context error when it is canceled.
+func (h *CharlesCommunicatorHandler) SendMessageContext(ctx context.Context, messageType, command uint8, data string) (*Response, error) {
+	return h.sendRequestWithRetry(ctx, messageType, command, data, CommandTimeout(command))
 }
 
+// SendMessage sends a GET or SET to the STM32 and returns the response data, waiting up to
+// messageTimeout milliseconds for each attempt. An empty response is reported as ErrTimeout.
 func (h *CharlesCommunicatorHandler) SendMessage(messageType, messageCommand uint8, messageString string, messageTimeout int64) (string, error) {
-	if !initializer.IsSupervisorEnable() {
-		return "", errors.New("supervisor is disabled")
+	if messageType == MSG_TYPE_GET {
+		messageString = ""
+	}
+	response, err := h.sendRequestWithRetry(context.Background(), messageType, messageCommand, messageString, messageTimeout)
+	if err != nil {
+		return "", err
+	}
+	if response.Data == "" {
+		return "", ErrTimeout
+	}
+	return response.Data, nil
+}
+
+func (h *CharlesCommunicatorHandler) sendRequest(ctx context.Context, messageType, command uint8, data string, timeout int64) (*Response, error) {
+	if !initializer.IsSupervisorEnable() || h.isStopped() {
+		return nil, ErrSupervisorDisabled
+	}
+	if err := ValidateRequest(messageType, command, data); err != nil {
+		return nil, err
+	}
+	if h.InMaintenance() {
+		return nil, ErrMaintenance
+	}
+	if !h.IsPortValid() {
+		return nil, ErrPortClosed
+	}
+
+	resultChannel := make(chan requestResult, 1)
+	message := &CharlesMessage{
+		messageType:         messageType,
+		command:             command,
+		dataLen:             uint16(len(data) + 1),
+		data:                data,
+		messageTimeout:      timeout,
+		messageCreationTime: time.Now().UnixMilli(),
+		reqFunc:             deliverRequestResult,
+		externalData:        resultChannel,
+	}
+	if err := h.registerRequest(message); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-resultChannel:
+		return result.response, result.err
+	case <-ctx.Done():
+		h.cancelRequest(message)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// deliverRequestResult is the reqFunc of the requests sent by sendRequest.
+func deliverRequestResult(messageType, command uint8, message string, messageToken, externalData interface{}) {
+	resultChannel, ok := externalData.(chan requestResult)
+	if !ok {
+		Logger.Errorln("expected requestResult channel, received ", reflect.TypeOf(externalData))
+		return
 	}
-	responseChannel := make(chan respStatusParameters)
 
 	switch messageType {
-	case MSG_TYPE_GET:
-		h.SendGetMessage(messageCommand, "", messageTimeout, respSetGet, responseChannel)
-	case MSG_TYPE_SET:
-		h.SendSetMessage(messageCommand, messageString, messageTimeout, respSetGet, responseChannel)
-	default:
-		return "", errors.New("message type not available")
+	case MSG_TYPE_RESP:
+		resultChannel <- requestResult{response: &Response{Command: command, Data: message}}
+	case MSG_TYPE_ERROR:
+		resultChannel <- requestResult{err: &RemoteError{Command: command, Message: message}}
+	case MSG_TYPE_TIMEOUT:
+		resultChannel <- requestResult{err: ErrTimeout}
+	case MSG_TYPE_CANCELED:
+		resultChannel <- requestResult{err: messageToken.(*CharlesMessage).failure}
 	}
-	response := <-responseChannel
+}
+
+// cancelRequest removes a request from the send queue or from the messages waiting response.
+func (h *CharlesCommunicatorHandler) cancelRequest(message *CharlesMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	return returnStringDataAndError(response)
+	for priority := range h.messagesToSend {
+		removeMessageFromList(&h.messagesToSend[priority], message)
+	}
+	removeMessageFromList(&h.messagesWaitingResponse, message)
 }
 
-func returnStringDataAndError(responseStruct respStatusParameters) (string, error) {
-	responseData := responseStruct.message
-	responseType := responseStruct.messageType
+func removeMessageFromList(messages *list.List, message *CharlesMessage) bool {
+	for e := messages.Front(); e != nil; e = e.Next() {
+		if e.Value == message {
+			messages.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+// failRequest removes a request that could not be written and notifies its reqFunc.
+func (h *CharlesCommunicatorHandler) failRequest(message *CharlesMessage, err error) {
+	h.mutex.Lock()
+	isPending := removeMessageFromList(&h.messagesWaitingResponse, message)
+	h.mutex.Unlock()
+
+	if isPending || (message.messageType != MSG_TYPE_GET && message.messageType != MSG_TYPE_SET) {
+		notifyFailure(message, err)
+	}
+}
 
-	if responseType == MSG_TYPE_ERROR {
-		return "", errors.New(responseData)
+// failPendingRequests empties the send queues and the messages waiting response, notifying
+// the reqFunc of every GET and SET with MSG_TYPE_CANCELED.
+func (h *CharlesCommunicatorHandler) failPendingRequests(err error) {
+	h.mutex.Lock()
+	var pendingMessages []*CharlesMessage
+	for priority := range h.messagesToSend {
+		pendingMessages = append(pendingMessages, takeAllMessages(&h.messagesToSend[priority])...)
 	}
-	if responseData == "" {
-		return "", errors.New("timeout")
+	pendingMessages = append(pendingMessages, takeAllMessages(&h.messagesWaitingResponse)...)
+	h.mutex.Unlock()
+
+	for _, message := range pendingMessages {
+		notifyFailure(message, err)
 	}
-	return responseData, nil
 }
 
-func respSetGet(messageType, command uint8, message string, messageToken, externalData interface{}) {
-	ch, cond := externalData.(chan respStatusParameters)
+func takeAllMessages(messages *list.List) []*CharlesMessage {
+	var takenMessages []*CharlesMessage
+	for e := messages.Front(); e != nil; e = e.Next() {
+		if message, ok := e.Value.(*CharlesMessage); ok {
+			takenMessages = append(takenMessages, message)
+		}
+	}
+	messages.Init()
+	return takenMessages
+}
 
-	if !cond {
-		Logger.Errorln("expected respStatusParamaters channel, received ", reflect.TypeOf(externalData))
+func notifyFailure(message *CharlesMessage, err error) {
+	if message.messageType != MSG_TYPE_GET && message.messageType != MSG_TYPE_SET {
+		Logger.Debugf("Dropping %s %s reply. %v", TypeToString(message.messageType), CommandToString(message.command), err)
 		return
 	}
-
-	ch <- respStatusParameters{messageType, message}
+	message.failure = err
+	if message.reqFunc != nil {
+		message.reqFunc(MSG_TYPE_CANCELED, message.command, err.Error(), message, message.externalData)
+	}
 }
@@ -0,0 +1,340 @@
+package charles_communicator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"initializer"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport is an in-memory Transport: bytes pushed with feed are returned by Read and
+// everything written by the handler is kept to be inspected by the test.
+type fakeTransport struct {
+	mutex   sync.Mutex
+	inbound bytes.Buffer
+	written bytes.Buffer
+	isOpen  bool
+	// respond, when set, is called with every frame written and its result is fed back
+	respond func(message *CharlesMessage) string
+	decoder FrameDecoder
+	// openErrors is the number of calls to Open that fail, readError is returned by the next Read
+	openErrors int
+	readError  error
+	opens      int
+	name       string
+}
+
+func (t *fakeTransport) Open() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.opens++
+	if t.openErrors > 0 {
+		t.openErrors--
+		return errors.New("no such device")
+	}
+	t.isOpen = true
+	return nil
+}
+
+func (t *fakeTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.isOpen = false
+	return nil
+}
+
+func (t *fakeTransport) Flush() error {
+	return nil
+}
+
+func (t *fakeTransport) Read(buf []byte) (int, error) {
+	t.mutex.Lock()
+	if err := t.readError; err != nil {
+		defer t.mutex.Unlock()
+		t.readError = nil
+		return 0, err
+	}
+	if t.inbound.Len() > 0 {
+		defer t.mutex.Unlock()
+		return t.inbound.Read(buf)
+	}
+	t.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	return 0, nil
+}
+
+func (t *fakeTransport) Write(buf []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.isOpen {
+		return 0, errors.New("port is not open")
+	}
+	if t.respond != nil {
+		for _, b := range buf {
+			if message, complete := t.decoder.Feed(b); complete && message != nil {
+				t.inbound.WriteString(t.respond(message))
+			}
+		}
+	}
+	return t.written.Write(buf)
+}
+
+func (t *fakeTransport) Name() string {
+	if t.name != "" {
+		return t.name
+	}
+	return "fake"
+}
+
+func (t *fakeTransport) feed(data string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inbound.WriteString(data)
+}
+
+func (t *fakeTransport) output() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.written.String()
+}
+
+func newTestHandler(t *testing.T) (*CharlesCommunicatorHandler, *fakeTransport) {
+	initializer.LoadConfig("")
+	transport := &fakeTransport{}
+	handler := NewCharlesCommunicatorHandler(transport)
+	handler.SetPacingInterval(0)
+	// Most tests check the frames written, so the handshake is left to the protocol tests
+	handler.SetMaxProtocolVersion(PROTOCOL_VERSION_ASCII)
+	// The fake STM32 reads the binary frames once the protocol tests negotiate them
+	transport.decoder.SetBinaryFraming(true)
+	if !handler.OpenPort() {
+		t.Fatalf("Expected fake transport to open")
+	}
+	return handler, transport
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not reached before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendMessageIfExistsWritesEncodedFrame(t *testing.T) {
+	handler, transport := newTestHandler(t)
+
+	if err := handler.SendGetMessage(MSG_CMD_MODEM_SIGNAL, "", 1000, nil, nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	handler.sendMessageIfExists()
+
+	expected := "[version:0;type:0;command:5;message_id:1;data_len:1;data:]"
+	if transport.output() != expected {
+		t.Errorf("Expected frame %s, got: %s", expected, transport.output())
+	}
+	if handler.messagesWaitingResponse.Len() != 1 {
+		t.Errorf("Expected 1 message waiting response, got: %d", handler.messagesWaitingResponse.Len())
+	}
+}
+
+func TestProcessMessageRepliesUnsupportedCommand(t *testing.T) {
+	handler, transport := newTestHandler(t)
+
+	handler.processMessage(decodeCharlesMessage("version:0;type:0;command:22;message_id:2;data_len:1;data:"))
+	handler.sendMessageIfExists()
+
+	expected := "[version:0;type:3;command:22;message_id:2;data_len:20;data:unsupported command]"
+	if transport.output() != expected {
+		t.Errorf("Expected frame %s, got: %s", expected, transport.output())
+	}
+}
+
+func TestStartDeliversResponse(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+
+	type result struct {
+		data string
+		err  error
+	}
+	resultChannel := make(chan result)
+	go func() {
+		data, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_STM32_TEMPERATURE, "", 1000)
+		resultChannel <- result{data, err}
+	}()
+
+	waitFor(t, func() bool { return strings.Contains(transport.output(), "command:28") })
+	transport.feed("noise[version:0;type:2;command:28;message_id:1;data_len:5;data:36.5]")
+
+	response := <-resultChannel
+	if response.err != nil {
+		t.Fatalf("Expected no error, got: %v", response.err)
+	}
+	if response.data != "36.5" {
+		t.Errorf("Expected data 36.5, got: %s", response.data)
+	}
+}
+
+func TestStartReportsTimeout(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	handler.SetRetryPolicy(MSG_CMD_STM32_TEMPERATURE, RetryPolicy{MaxAttempts: 1})
+	go handler.Start()
+	defer handler.Stop()
+
+	_, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_STM32_TEMPERATURE, "", 50)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected timeout error, got: %v", err)
+	}
+}
+
+func TestSendMessageContextReturnsRemoteError(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = func(message *CharlesMessage) string {
+		frame, _ := EncodeFrame(message.version, MSG_TYPE_ERROR, message.command, message.messageId, "busy")
+		return frame
+	}
+	go handler.Start()
+	defer handler.Stop()
+
+	_, err := handler.SendMessageContext(context.Background(), MSG_TYPE_SET, MSG_CMD_POE_RESET, "")
+	var remoteError *RemoteError
+	if !errors.Is(err, ErrRemote) || !errors.As(err, &remoteError) {
+		t.Fatalf("Expected remote error, got: %v", err)
+	}
+	if remoteError.Message != "busy" || remoteError.Command != MSG_CMD_POE_RESET {
+		t.Errorf("Unexpected remote error content: %+v", remoteError)
+	}
+}
+
+func TestSendMessageContextDeadline(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := handler.SendMessageContext(ctx, MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "")
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected timeout error, got: %v", err)
+	}
+}
+
+func TestSendMessageContextCancelRemovesRequest(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := handler.SendMessageContext(ctx, MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected canceled error, got: %v", err)
+	}
+	if message, _ := handler.getMessageToSend(); message != nil {
+		t.Errorf("Expected canceled request to be removed from the queue")
+	}
+}
+
+func TestClosePortFailsPendingRequests(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+
+	errorChannel := make(chan error)
+	go func() {
+		_, err := handler.SendMessageContext(context.Background(), MSG_TYPE_GET, MSG_CMD_FIRMWARE_VERSION, "")
+		errorChannel <- err
+	}()
+	waitFor(t, func() bool { return strings.Contains(transport.output(), "command:11") })
+	handler.ClosePort()
+
+	select {
+	case err := <-errorChannel:
+		if !errors.Is(err, ErrPortClosed) {
+			t.Errorf("Expected port closed error, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Pending request not failed after ClosePort")
+	}
+
+	if _, err := handler.SendMessageContext(context.Background(), MSG_TYPE_GET, MSG_CMD_FIRMWARE_VERSION, ""); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Expected port closed error, got: %v", err)
+	}
+}
+
+func TestStopFailsPendingRequests(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	errorChannel := make(chan error)
+	go func() {
+		_, err := handler.SendMessageContext(context.Background(), MSG_TYPE_GET, MSG_CMD_FIRMWARE_VERSION, "")
+		errorChannel <- err
+	}()
+	waitFor(t, func() bool {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+		return handler.messagesToSend[PRIORITY_TELEMETRY].Len() == 1
+	})
+	handler.Stop()
+
+	if err := <-errorChannel; !errors.Is(err, ErrSupervisorDisabled) {
+		t.Errorf("Expected supervisor disabled error, got: %v", err)
+	}
+}
+
+func TestGetMessageToSendIsFIFO(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	for _, command := range []uint8{MSG_CMD_PCB_REV, MSG_CMD_BATCH_NUMBER, MSG_CMD_HAS_BMS} {
+		handler.SendGetMessage(command, "", 1000, nil, nil)
+	}
+
+	for _, expected := range []uint8{MSG_CMD_PCB_REV, MSG_CMD_BATCH_NUMBER, MSG_CMD_HAS_BMS} {
+		message, err := handler.getMessageToSend()
+		if err != nil || message == nil {
+			t.Fatalf("Expected a message, got: %v %v", message, err)
+		}
+		if message.command != expected {
+			t.Errorf("Expected command %s, got: %s", CommandToString(expected), CommandToString(message.command))
+		}
+	}
+}
+
+func TestGetMessageToSendRespectsPriority(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	handler.SendGetMessage(MSG_CMD_MODEM_SIGNAL, "", 1000, nil, nil)
+	handler.SendSetMessage(MSG_CMD_BUZZER_ENABLE, "10", 1000, nil, nil)
+	handler.SendRespMessage(&CharlesMessage{messageId: 2, command: MSG_CMD_GET_WATCHDOG}, "OK")
+
+	for _, expected := range []uint8{MSG_TYPE_RESP, MSG_TYPE_SET, MSG_TYPE_GET} {
+		message, _ := handler.getMessageToSend()
+		if message == nil || message.messageType != expected {
+			t.Fatalf("Expected %s message, got: %v", TypeToString(expected), message)
+		}
+	}
+}
+
+func TestSendLoopRespectsPacingInterval(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetPacingInterval(100 * time.Millisecond)
+
+	handler.SendGetMessage(MSG_CMD_PCB_REV, "", 1000, nil, nil)
+	handler.SendGetMessage(MSG_CMD_BATCH_NUMBER, "", 1000, nil, nil)
+	go handler.Start()
+	defer handler.Stop()
+
+	waitFor(t, func() bool { return strings.Count(transport.output(), "[") == 1 })
+	firstFrameTime := time.Now()
+	waitFor(t, func() bool { return strings.Count(transport.output(), "[") == 2 })
+
+	if elapsed := time.Since(firstFrameTime); elapsed < 80*time.Millisecond {
+		t.Errorf("Expected frames paced by 100ms, second frame sent after %v", elapsed)
+	}
+}
@@ -0,0 +1,209 @@
+package charles_communicator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RequestTypes is a set of request types (MSG_TYPE_GET and MSG_TYPE_SET).
+type RequestTypes uint8
+
+const (
+	REQUEST_GET         RequestTypes = 1 << MSG_TYPE_GET
+	REQUEST_SET         RequestTypes = 1 << MSG_TYPE_SET
+	REQUEST_GET_AND_SET              = REQUEST_GET | REQUEST_SET
+	REQUEST_NONE        RequestTypes = 0
+)
+
+func (r RequestTypes) Has(messageType uint8) bool {
+	return messageType < 8 && r&(1<<messageType) != 0
+}
+
+const (
+	DIRECTION_TO_STM32   = "to_stm32"
+	DIRECTION_FROM_STM32 = "from_stm32"
+	DIRECTION_BOTH       = "both"
+)
+
+const (
+	PAYLOAD_NONE = iota
+	PAYLOAD_TEXT
+	PAYLOAD_INTEGER
+	PAYLOAD_DECIMAL
+)
+
+// PayloadSchema describes the data of the SETs of a command. Values, when given, lists the only
+// accepted values; MaxLength 0 means no limit besides the one of the protocol version.
+type PayloadSchema struct {
+	Kind      int
+	MaxLength int
+	Values    []string
+}
+
+func (p PayloadSchema) Validate(data string) error {
+	switch p.Kind {
+	case PAYLOAD_NONE:
+		if data != "" {
+			return errors.New("no data expected")
+		}
+		return nil
+	case PAYLOAD_INTEGER:
+		if _, err := strconv.Atoi(data); err != nil {
+			return fmt.Errorf("integer expected, got '%s'", data)
+		}
+	case PAYLOAD_DECIMAL:
+		if _, err := strconv.ParseFloat(data, 64); err != nil {
+			return fmt.Errorf("decimal expected, got '%s'", data)
+		}
+	}
+	if p.MaxLength > 0 && len(data) > p.MaxLength {
+		return fmt.Errorf("data longer than %d bytes", p.MaxLength)
+	}
+	if len(p.Values) > 0 {
+		for _, value := range p.Values {
+			if data == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' is not one of %v", data, p.Values)
+	}
+	return nil
+}
+
+// CommandSpec declares a STM32 command. Outbound are the requests CharlesGo sends to the STM32
+// and Inbound the ones the STM32 sends to CharlesGo. Timeout is in milliseconds, 0 meaning
+// WAIT_MESSAGE_RESPONSE_TIMEOUT. Idempotent GETs are repeated after a timeout. The GETs of the
+// commands with APIPath are answered by the diagnosis API and the ones with TelemetryTopic are
+// published by the monitor.
+type CommandSpec struct {
+	Id             uint8
+	Name           string
+	Outbound       RequestTypes
+	Inbound        RequestTypes
+	Payload        PayloadSchema
+	Timeout        int64
+	Idempotent     bool
+	APIPath        string
+	TelemetryTopic string
+}
+
+func (c *CommandSpec) Direction() string {
+	switch {
+	case c.Outbound != REQUEST_NONE && c.Inbound != REQUEST_NONE:
+		return DIRECTION_BOTH
+	case c.Inbound != REQUEST_NONE:
+		return DIRECTION_FROM_STM32
+	default:
+		return DIRECTION_TO_STM32
+	}
+}
+
+// ResponseTimeout returns the time to wait for the response of a request, in milliseconds.
+func (c *CommandSpec) ResponseTimeout() int64 {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return WAIT_MESSAGE_RESPONSE_TIMEOUT
+}
+
+var textPayload = PayloadSchema{Kind: PAYLOAD_TEXT}
+
+// commandRegistry is the single place where the STM32 commands are declared, ordered by id.
+var commandRegistry = []CommandSpec{
+	{Id: MSG_CMD_GET_WATCHDOG, Name: "WATCHDOG", Inbound: REQUEST_GET},
+	{Id: MSG_CMD_POE_RESET, Name: "POE_RESET", Outbound: REQUEST_SET},
+	{Id: MSG_CMD_SIM_TYPE, Name: "SIM_TYPE", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/modem/sim-card-type", TelemetryTopic: "sim_card_type"},
+	{Id: MSG_CMD_SIM_ICCID, Name: "SIM_ICCID", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/modem/sim-card-iccid", TelemetryTopic: "iccid"},
+	{Id: MSG_CMD_SIM_CARRIER, Name: "SIM_CARRIER", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/modem/sim-card-carrier", TelemetryTopic: "sim_card_carrier"},
+	{Id: MSG_CMD_MODEM_SIGNAL, Name: "MODEM_SIGNAL", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/modem/signal-strength", TelemetryTopic: "modem_signal"},
+	{Id: MSG_CMD_MODEM_RESET, Name: "MODEM_RESET", Outbound: REQUEST_SET},
+	{Id: MSG_CMD_SERIAL_NUMBER, Name: "SERIAL_NUMBER", Outbound: REQUEST_GET_AND_SET, Payload: textPayload, Idempotent: true},
+	{Id: MSG_CMD_BATCH_NUMBER, Name: "BATCH_NUMBER", Outbound: REQUEST_GET_AND_SET, Payload: textPayload, Idempotent: true,
+		APIPath: "/diagnosis/fabrication/pcb-batch", TelemetryTopic: "pcb_batch_number"},
+	{Id: MSG_CMD_ANATEL_NUMBER, Name: "ANATEL_NUMBER", Outbound: REQUEST_GET_AND_SET, Payload: textPayload, Idempotent: true},
+	{Id: MSG_CMD_OS_VERSION, Name: "OS_VERSION", Outbound: REQUEST_GET_AND_SET, Payload: textPayload},
+	{Id: MSG_CMD_FIRMWARE_VERSION, Name: "FIRMWARE_VERSION", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/stm32/firmware-version", TelemetryTopic: "stm32_firmware_version"},
+	{Id: MSG_CMD_BUZZER_ENABLE, Name: "BUZZER_ENABLE", Outbound: REQUEST_SET, Payload: PayloadSchema{Kind: PAYLOAD_INTEGER}},
+	{Id: MSG_CMD_BUZZER_DISABLE, Name: "BUZZER_DISABLE", Outbound: REQUEST_SET, Inbound: REQUEST_SET},
+	{Id: MSG_CMD_IS_UPGRADING, Name: "IS_UPGRADING", Outbound: REQUEST_GET, Idempotent: true},
+	{Id: MSG_CMD_PCB_REV, Name: "PCB_REV", Outbound: REQUEST_GET_AND_SET, Payload: textPayload, Idempotent: true,
+		APIPath: "/diagnosis/fabrication/pcb-review", TelemetryTopic: "pcb_review"},
+	{Id: MSG_CMD_TEST_START, Name: "TEST_START", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_TEST_MODEM_RESULT, Name: "TEST_MODEM_RESULT", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_TEST_SWITCH_RESULT, Name: "TEST_SWITCH_RESULT", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_TEST_ETHERNET_RESULT, Name: "TEST_ETHERNET_RESULT", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_HAS_BMS, Name: "HAS_BMS", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/power/bms", TelemetryTopic: "has_bms"},
+	{Id: MSG_CMD_POWER_SOURCE, Name: "POWER_SOURCE", Outbound: REQUEST_GET, Inbound: REQUEST_SET, Idempotent: true,
+		APIPath: "/diagnosis/power/source"},
+	{Id: MSG_CMD_SOCKETXP_STATUS, Name: "SOCKETXP_STATUS", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_TAMPER_EVENT, Name: "TAMPER_EVENT", Inbound: REQUEST_SET, Payload: PayloadSchema{Kind: PAYLOAD_TEXT, Values: []string{"Open", "Close"}}},
+	{Id: MSG_CMD_TEST_EEPROM_RESULT, Name: "TEST_EEPROM_RESULT", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_TEST_DISPLAY_RESULT, Name: "TEST_DISPLAY_RESULT", Outbound: REQUEST_SET, Payload: textPayload},
+	{Id: MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION, Name: "MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION", Outbound: REQUEST_SET},
+	{Id: MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION, Name: "MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION", Outbound: REQUEST_SET},
+	{Id: MSG_CMD_STM32_TEMPERATURE, Name: "STM32_TEMPERATURE", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/stm32/temperature", TelemetryTopic: "stm32_temperature"},
+	{Id: MSG_CMD_BATTERY_LEVEL, Name: "BATTERY_LEVEL", Outbound: REQUEST_GET, Idempotent: true,
+		APIPath: "/diagnosis/power/battery-level", TelemetryTopic: "battery_level"},
+	{Id: MSG_CMD_MODEM_CONN_TYPE, Name: "MODEM_CONN_TYPE", Outbound: REQUEST_GET, Idempotent: true, TelemetryTopic: "modem_conn_type"},
+	{Id: MSG_CMD_MODEM_CONN_BAND, Name: "MODEM_CONN_BAND", Outbound: REQUEST_GET, Idempotent: true, TelemetryTopic: "modem_conn_band"},
+	// The handshake GET carries the highest version offered
+	{Id: MSG_CMD_PROTOCOL_VERSION, Name: "PROTOCOL_VERSION", Outbound: REQUEST_GET, Timeout: PROTOCOL_HANDSHAKE_TIMEOUT},
+}
+
+var commandsById = indexCommands()
+
+func indexCommands() map[uint8]*CommandSpec {
+	commands := make(map[uint8]*CommandSpec, len(commandRegistry))
+	for i := range commandRegistry {
+		commands[commandRegistry[i].Id] = &commandRegistry[i]
+	}
+	return commands
+}
+
+// Commands returns a copy of the command registry, ordered by id.
+func Commands() []CommandSpec {
+	return append([]CommandSpec(nil), commandRegistry...)
+}
+
+func LookupCommand(command uint8) (CommandSpec, bool) {
+	spec, ok := commandsById[command]
+	if !ok {
+		return CommandSpec{}, false
+	}
+	return *spec, true
+}
+
+// CommandTimeout returns the time to wait for the response of a request of the command, in
+// milliseconds.
+func CommandTimeout(command uint8) int64 {
+	if spec, ok := commandsById[command]; ok {
+		return spec.ResponseTimeout()
+	}
+	return WAIT_MESSAGE_RESPONSE_TIMEOUT
+}
+
+// ValidateRequest checks that CharlesGo can send the request to the STM32 according to the
+// command registry. The errors match ErrInvalidRequest.
+func ValidateRequest(messageType, command uint8, data string) error {
+	spec, ok := commandsById[command]
+	if !ok {
+		return fmt.Errorf("%w: unknown command %d", ErrInvalidRequest, command)
+	}
+	if !spec.Outbound.Has(messageType) {
+		return fmt.Errorf("%w: %s does not support %s", ErrInvalidRequest, spec.Name, TypeToString(messageType))
+	}
+	if messageType == MSG_TYPE_SET {
+		if err := spec.Payload.Validate(data); err != nil {
+			return fmt.Errorf("%w: %s %v", ErrInvalidRequest, spec.Name, err)
+		}
+	}
+	return nil
+}
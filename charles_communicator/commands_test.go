@@ -0,0 +1,132 @@
+package charles_communicator
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// declaredCommands returns the MSG_CMD_* constants declared in constants.go, so a command added
+// there without a registry entry fails the test.
+func declaredCommands(t *testing.T) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), "constants.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Cannot parse constants.go: %v", err)
+	}
+	var names []string
+	for _, declaration := range file.Decls {
+		general, ok := declaration.(*ast.GenDecl)
+		if !ok || general.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range general.Specs {
+			for _, name := range spec.(*ast.ValueSpec).Names {
+				if strings.HasPrefix(name.Name, "MSG_CMD_") {
+					names = append(names, name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestEveryCommandIsRegistered(t *testing.T) {
+	names := declaredCommands(t)
+	if len(names) != len(commandRegistry) {
+		t.Errorf("Expected %d registered commands, got: %d", len(names), len(commandRegistry))
+	}
+	for _, name := range names {
+		found := false
+		for _, spec := range commandRegistry {
+			// The EEPROM write protection commands keep their historical log names
+			if strings.TrimPrefix(name, "MSG_CMD_") == spec.Name || name == spec.Name || name == "MSG_CMD_GET_WATCHDOG" && spec.Name == "WATCHDOG" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s is not in the command registry", name)
+		}
+	}
+}
+
+func TestCommandRegistryIsConsistent(t *testing.T) {
+	ids := make(map[uint8]bool)
+	unique := make(map[string]bool)
+	for i, spec := range commandRegistry {
+		if ids[spec.Id] {
+			t.Errorf("Command id %d registered twice", spec.Id)
+		}
+		ids[spec.Id] = true
+		if i > 0 && spec.Id <= commandRegistry[i-1].Id {
+			t.Errorf("Registry not ordered by id at %s", spec.Name)
+		}
+		for _, key := range []string{"name:" + spec.Name, "path:" + spec.APIPath, "topic:" + spec.TelemetryTopic} {
+			if strings.HasSuffix(key, ":") {
+				continue
+			}
+			if unique[key] {
+				t.Errorf("%s registered twice", key)
+			}
+			unique[key] = true
+		}
+		if spec.Outbound == REQUEST_NONE && spec.Inbound == REQUEST_NONE {
+			t.Errorf("%s supports no request", spec.Name)
+		}
+		if (spec.APIPath != "" || spec.TelemetryTopic != "" || spec.Idempotent) && !spec.Outbound.Has(MSG_TYPE_GET) {
+			t.Errorf("%s is read by the API, the monitor or retried without an outbound GET", spec.Name)
+		}
+		if CommandToString(spec.Id) != spec.Name {
+			t.Errorf("Expected CommandToString(%d) to be %s, got: %s", spec.Id, spec.Name, CommandToString(spec.Id))
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	valid := []struct {
+		messageType, command uint8
+		data                 string
+	}{
+		{MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, ""},
+		{MSG_TYPE_SET, MSG_CMD_OS_VERSION, "1.2.3"},
+		{MSG_TYPE_SET, MSG_CMD_BUZZER_ENABLE, "10"},
+		{MSG_TYPE_SET, MSG_CMD_MODEM_RESET, ""},
+	}
+	for _, request := range valid {
+		if err := ValidateRequest(request.messageType, request.command, request.data); err != nil {
+			t.Errorf("Expected %+v to be valid, got: %v", request, err)
+		}
+	}
+
+	invalid := []struct {
+		messageType, command uint8
+		data                 string
+	}{
+		{MSG_TYPE_SET, MSG_CMD_BATTERY_LEVEL, "10"},
+		{MSG_TYPE_GET, MSG_CMD_MODEM_RESET, ""},
+		{MSG_TYPE_SET, MSG_CMD_BUZZER_ENABLE, "loud"},
+		{MSG_TYPE_SET, MSG_CMD_POE_RESET, "now"},
+		{MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, ""},
+		{MSG_TYPE_RESP, MSG_CMD_OS_VERSION, ""},
+		{MSG_TYPE_GET, 200, ""},
+	}
+	for _, request := range invalid {
+		if err := ValidateRequest(request.messageType, request.command, request.data); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Expected %+v to be invalid, got: %v", request, err)
+		}
+	}
+}
+
+func TestSendMessageRejectsInvalidRequest(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	if _, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_STM32_TEMPERATURE, "30", 1000); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got: %v", err)
+	}
+	if statistics := handler.Statistics(); statistics.MessagesSent != 0 {
+		t.Errorf("Expected nothing sent, got: %d messages", statistics.MessagesSent)
+	}
+}
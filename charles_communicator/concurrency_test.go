@@ -0,0 +1,147 @@
+package charles_communicator
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoResponse answers GETs and SETs with the request data, or "OK" when there is no data.
+func echoResponse(message *CharlesMessage) string {
+	if message.messageType != MSG_TYPE_GET && message.messageType != MSG_TYPE_SET {
+		return ""
+	}
+	data := message.data
+	if data == "" {
+		data = "OK"
+	}
+	frame, _ := EncodeFrame(message.version, MSG_TYPE_RESP, message.command, message.messageId, data)
+	return frame
+}
+
+func TestConcurrentSendMessage(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = echoResponse
+	go handler.Start()
+	defer handler.Stop()
+
+	const senders = 20
+	const messagesPerSender = 10
+
+	var wg sync.WaitGroup
+	errorsChannel := make(chan error, senders*messagesPerSender)
+	for sender := 0; sender < senders; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for i := 0; i < messagesPerSender; i++ {
+				expected := fmt.Sprintf("%d-%d", sender, i)
+				data, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_OS_VERSION, expected, 5000)
+				if err != nil {
+					errorsChannel <- err
+				} else if data != expected {
+					errorsChannel <- fmt.Errorf("expected %s, got %s", expected, data)
+				}
+			}
+		}(sender)
+	}
+	wg.Wait()
+	close(errorsChannel)
+
+	for err := range errorsChannel {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentUnsolicitedMessagesAndRegistrations(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+
+	var received sync.WaitGroup
+	received.Add(1)
+	var once sync.Once
+	handler.RegisterFunctionToRcvMsg(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(messageType, command uint8, message string, messageToken, externalData interface{}) {
+		handler.SendRespMessage(messageToken.(*CharlesMessage), "OK")
+		once.Do(received.Done)
+	}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			handler.RegisterFunctionToRcvMsg(MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, nil, nil)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			transport.feed(fmt.Sprintf("[version:0;type:1;command:23;message_id:%d;data_len:5;data:Open]", 2*i+2))
+		}(i)
+	}
+	wg.Wait()
+	received.Wait()
+}
+
+func TestConcurrentClosePortDoesNotLoseCallers(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = echoResponse
+	go handler.Start()
+	defer handler.Stop()
+
+	stopToggling := make(chan struct{})
+	toggled := make(chan struct{})
+	go func() {
+		defer close(toggled)
+		for {
+			select {
+			case <-stopToggling:
+				handler.OpenPort()
+				return
+			default:
+				handler.ClosePort()
+				time.Sleep(time.Millisecond)
+				handler.OpenPort()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Either the response or the timeout must be delivered
+			handler.SendMessage(MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "", 200)
+		}()
+	}
+	wg.Wait()
+	close(stopToggling)
+	<-toggled
+}
+
+func TestRequestMessageIdSkipsPendingIds(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	usedIds := make(map[uint16]bool)
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			// Wrap the id counter around while the first ids are still pending
+			handler.msgIdControl = 0
+		}
+		if err := handler.SendGetMessage(MSG_CMD_PCB_REV, "", 1000, nil, nil); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	for e := handler.messagesToSend[PRIORITY_TELEMETRY].Front(); e != nil; e = e.Next() {
+		messageId := e.Value.(*CharlesMessage).messageId
+		if usedIds[messageId] {
+			t.Errorf("Message id %d used twice", messageId)
+		}
+		if messageId%2 == 0 {
+			t.Errorf("Expected odd message id, got: %d", messageId)
+		}
+		usedIds[messageId] = true
+	}
+}
@@ -1,10 +1,44 @@
 package charles_communicator
 
+import "time"
+
+const (
+	BUFFER_SIZE           = 100
+	WAITING_FOR_MESSAGE   = 0
+	RECEIVING_DATA        = 1
+	RECEIVING_BINARY_DATA = 2
+	MAX_MESSAGE_IDS       = 32768
+)
+
+// PROTOCOL_VERSION is the highest protocol version supported. The version used on the link is
+// negotiated with the STM32 every time the port is opened, starting from version 0.
+const (
+	PROTOCOL_VERSION_ASCII  = 0
+	PROTOCOL_VERSION_BINARY = 1
+	PROTOCOL_VERSION        = PROTOCOL_VERSION_BINARY
+)
+
+// Binary framing of protocol version 1
+const (
+	FRAME_FLAG          = 0x7E
+	FRAME_ESCAPE        = 0x7D
+	FRAME_ESCAPE_XOR    = 0x20
+	FRAME_HEADER_SIZE   = 7
+	FRAME_CRC_SIZE      = 2
+	MAX_FRAME_DATA_SIZE = 1024
+	BINARY_BUFFER_SIZE  = FRAME_HEADER_SIZE + MAX_FRAME_DATA_SIZE + FRAME_CRC_SIZE
+)
+
+// Fragmentation of long messages, available from protocol version 1
 const (
-	BUFFER_SIZE         = 100
-	RECEIVING_DATA      = 0
-	WAITING_FOR_MESSAGE = 1
-	PROTOCOL_VERSION    = 0
+	MSG_FLAG_FRAGMENT           = 0x80
+	FRAGMENT_HEADER_SIZE        = 2
+	FRAGMENT_DATA_SIZE          = 256
+	MAX_FRAGMENTS               = 255
+	MAX_MESSAGE_DATA_SIZE       = MAX_FRAGMENTS * FRAGMENT_DATA_SIZE
+	FRAGMENT_REASSEMBLY_TIMEOUT = 5 * time.Second
+	// MAX_PARTIAL_MESSAGES bounds the messages being reassembled, the oldest one is discarded
+	MAX_PARTIAL_MESSAGES = 8
 )
 
 const (
@@ -13,6 +47,9 @@ const (
 	MSG_TYPE_RESP    = 2
 	MSG_TYPE_ERROR   = 3
 	MSG_TYPE_TIMEOUT = 4
+	// MSG_TYPE_CANCELED is given to reqFunc when a request is dropped before its response,
+	// e.g. because the port was closed
+	MSG_TYPE_CANCELED = 5
 )
 
 const (
@@ -48,6 +85,26 @@ const (
 	MSG_CMD_BATTERY_LEVEL                   = 29
 	MSG_CMD_MODEM_CONN_TYPE                 = 30
 	MSG_CMD_MODEM_CONN_BAND                 = 31
+	MSG_CMD_PROTOCOL_VERSION                = 32
+)
+
+// Send queues, from the highest to the lowest priority
+const (
+	PRIORITY_REPLY     = 0
+	PRIORITY_COMMAND   = 1
+	PRIORITY_TELEMETRY = 2
+	PRIORITY_LEVELS    = 3
+)
+
+const (
+	DEFAULT_PACING_INTERVAL = 100 * time.Millisecond
+	TIMEOUT_CHECK_INTERVAL  = 50 * time.Millisecond
 )
 
 const WAIT_MESSAGE_RESPONSE_TIMEOUT = 10000
+
+// INBOUND_QUEUE_SIZE is the number of GETs and SETs of the STM32 waiting for their subscribers;
+// beyond it they are answered with an ERROR
+const INBOUND_QUEUE_SIZE = 32
+
+const PROTOCOL_HANDSHAKE_TIMEOUT = 2000
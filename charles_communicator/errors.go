@@ -0,0 +1,38 @@
+package charles_communicator
+
+import "errors"
+
+var (
+	ErrTimeout            = errors.New("timeout")
+	ErrRemote             = errors.New("remote error")
+	ErrPortClosed         = errors.New("port is closed")
+	ErrSupervisorDisabled = errors.New("supervisor is disabled")
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrMaintenance        = errors.New("link in maintenance")
+)
+
+// RemoteError is returned when the STM32 answers a request with an ERROR message.
+// It matches ErrRemote with errors.Is.
+type RemoteError struct {
+	Command uint8
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+func (e *RemoteError) Is(target error) bool {
+	return target == ErrRemote
+}
+
+// Response is the answer of the STM32 to a GET or SET.
+type Response struct {
+	Command uint8
+	Data    string
+}
+
+type requestResult struct {
+	response *Response
+	err      error
+}
@@ -0,0 +1,112 @@
+package charles_communicator
+
+import (
+	"strings"
+	"time"
+)
+
+type fragmentKey struct {
+	messageId   uint16
+	messageType uint8
+	command     uint8
+}
+
+type partialMessage struct {
+	fragments    []string
+	received     []bool
+	missing      int
+	lastFragment time.Time
+}
+
+// reassemble keeps the fragments of a message until all of them are received and then returns
+// the whole message. Messages that are not fragmented are returned as they are. Fragments of
+// different messages can be interleaved, up to MAX_PARTIAL_MESSAGES of them; the ones not
+// completed within FRAGMENT_REASSEMBLY_TIMEOUT are discarded.
+func (d *FrameDecoder) reassemble(message *CharlesMessage) *CharlesMessage {
+	if message.fragmentCount == 0 {
+		return message
+	}
+	d.fragmentsMutex.Lock()
+	defer d.fragmentsMutex.Unlock()
+	d.dropStaleFragments()
+	if d.fragments == nil {
+		d.fragments = make(map[fragmentKey]*partialMessage)
+	}
+
+	key := fragmentKey{messageId: message.messageId, messageType: message.messageType, command: message.command}
+	partial, ok := d.fragments[key]
+	if !ok || len(partial.fragments) != int(message.fragmentCount) {
+		if ok {
+			Logger.Warnf("Fragment count of %s %s id=%d changed, discarding %d fragments", TypeToString(message.messageType),
+				CommandToString(message.command), message.messageId, len(partial.fragments)-partial.missing)
+		}
+		if !ok && len(d.fragments) >= MAX_PARTIAL_MESSAGES {
+			d.dropOldestFragments()
+		}
+		partial = &partialMessage{
+			fragments: make([]string, message.fragmentCount),
+			received:  make([]bool, message.fragmentCount),
+			missing:   int(message.fragmentCount),
+		}
+		d.fragments[key] = partial
+	}
+
+	partial.lastFragment = time.Now()
+	if !partial.received[message.fragmentIndex] {
+		partial.received[message.fragmentIndex] = true
+		partial.missing--
+	}
+	partial.fragments[message.fragmentIndex] = message.data
+	if partial.missing > 0 {
+		return nil
+	}
+
+	delete(d.fragments, key)
+	data := strings.Join(partial.fragments, "")
+	return &CharlesMessage{
+		version:     message.version,
+		messageType: message.messageType,
+		command:     message.command,
+		messageId:   message.messageId,
+		dataLen:     uint16(len(data) + 1),
+		data:        data,
+	}
+}
+
+// expireFragments discards the messages not completed within FRAGMENT_REASSEMBLY_TIMEOUT, so
+// they are freed even when no other fragment arrives.
+func (d *FrameDecoder) expireFragments() {
+	d.fragmentsMutex.Lock()
+	defer d.fragmentsMutex.Unlock()
+	d.dropStaleFragments()
+}
+
+// dropStaleFragments must be called holding fragmentsMutex.
+func (d *FrameDecoder) dropStaleFragments() {
+	for key, partial := range d.fragments {
+		if time.Since(partial.lastFragment) > FRAGMENT_REASSEMBLY_TIMEOUT {
+			d.dropFragments(key, partial)
+		}
+	}
+}
+
+// dropOldestFragments discards the message that received no fragment for the longest time. It
+// must be called holding fragmentsMutex.
+func (d *FrameDecoder) dropOldestFragments() {
+	var oldestKey fragmentKey
+	var oldest *partialMessage
+	for key, partial := range d.fragments {
+		if oldest == nil || partial.lastFragment.Before(oldest.lastFragment) {
+			oldestKey, oldest = key, partial
+		}
+	}
+	if oldest != nil {
+		d.dropFragments(oldestKey, oldest)
+	}
+}
+
+func (d *FrameDecoder) dropFragments(key fragmentKey, partial *partialMessage) {
+	Logger.Warnf("Discarding incomplete %s %s id=%d, %d of %d fragments received", TypeToString(key.messageType),
+		CommandToString(key.command), key.messageId, len(partial.fragments)-partial.missing, len(partial.fragments))
+	delete(d.fragments, key)
+}
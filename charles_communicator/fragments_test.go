@@ -0,0 +1,178 @@
+package charles_communicator
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// splitFrames splits concatenated binary frames.
+func splitFrames(stream string) []string {
+	var frames []string
+	for _, frame := range strings.Split(stream, "\x7e\x7e") {
+		frame = strings.TrimPrefix(frame, "\x7e")
+		frame = strings.TrimSuffix(frame, "\x7e")
+		frames = append(frames, "\x7e"+frame+"\x7e")
+	}
+	return frames
+}
+
+func TestLongMessageIsFragmented(t *testing.T) {
+	data := strings.Repeat("0123456789", 100)
+	stream, err := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_TEST_EEPROM_RESULT, 7, data)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if frames := splitFrames(stream); len(frames) != 4 {
+		t.Fatalf("Expected 4 fragments, got: %d", len(frames))
+	}
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, stream)
+	if len(messages) != 1 || malformed != 0 {
+		t.Fatalf("Expected 1 message, got: %d (%d malformed)", len(messages), malformed)
+	}
+	if messages[0].data != data || messages[0].messageType != MSG_TYPE_RESP || messages[0].messageId != 7 {
+		t.Errorf("Unexpected reassembled message: type %d id %d with %d bytes", messages[0].messageType, messages[0].messageId, len(messages[0].data))
+	}
+}
+
+func TestFragmentsInterleavedWithOtherMessages(t *testing.T) {
+	firstData := strings.Repeat("a", 600)
+	secondData := strings.Repeat("b", 300)
+	first, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_TEST_EEPROM_RESULT, 1, firstData)
+	second, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_SET, MSG_CMD_TEST_DISPLAY_RESULT, 2, secondData)
+	tamper, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, 4, "Open")
+	watchdog, _ := EncodeFrame(PROTOCOL_VERSION_ASCII, MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, 6, "")
+
+	firstFrames := splitFrames(first)
+	secondFrames := splitFrames(second)
+	stream := firstFrames[0] + secondFrames[0] + tamper + firstFrames[1] + watchdog + secondFrames[1] + firstFrames[2]
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, stream)
+	if malformed != 0 {
+		t.Errorf("Expected no malformed frame, got: %d", malformed)
+	}
+	expected := []struct {
+		command uint8
+		data    string
+	}{
+		{MSG_CMD_TAMPER_EVENT, "Open"},
+		{MSG_CMD_GET_WATCHDOG, ""},
+		{MSG_CMD_TEST_DISPLAY_RESULT, secondData},
+		{MSG_CMD_TEST_EEPROM_RESULT, firstData},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got: %d", len(expected), len(messages))
+	}
+	for i := range expected {
+		if messages[i].command != expected[i].command || messages[i].data != expected[i].data {
+			t.Errorf("Expected %s as message %d, got: %s", CommandToString(expected[i].command), i, CommandToString(messages[i].command))
+		}
+	}
+}
+
+func TestStaleFragmentsAreDiscarded(t *testing.T) {
+	stream, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_TEST_EEPROM_RESULT, 1, strings.Repeat("a", 300))
+	frames := splitFrames(stream)
+
+	decoder := newBinaryDecoder()
+	feedAll(decoder, frames[0])
+	for _, partial := range decoder.fragments {
+		partial.lastFragment = time.Now().Add(-2 * FRAGMENT_REASSEMBLY_TIMEOUT)
+	}
+	messages, _ := feedAll(decoder, frames[1])
+	if len(messages) != 0 {
+		t.Errorf("Expected the message to be discarded, got: %d messages", len(messages))
+	}
+}
+
+func TestStaleFragmentsExpireWithoutNewFragment(t *testing.T) {
+	stream, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_TEST_EEPROM_RESULT, 1, strings.Repeat("a", 300))
+
+	decoder := newBinaryDecoder()
+	feedAll(decoder, splitFrames(stream)[0])
+	decoder.expireFragments()
+	if len(decoder.fragments) != 1 {
+		t.Fatalf("Expected the recent fragment kept, got: %d partial messages", len(decoder.fragments))
+	}
+	for _, partial := range decoder.fragments {
+		partial.lastFragment = time.Now().Add(-2 * FRAGMENT_REASSEMBLY_TIMEOUT)
+	}
+	decoder.expireFragments()
+	if len(decoder.fragments) != 0 {
+		t.Errorf("Expected the stale fragment freed, got: %d partial messages", len(decoder.fragments))
+	}
+}
+
+func TestPartialMessagesAreBounded(t *testing.T) {
+	decoder := newBinaryDecoder()
+	for id := uint16(1); id <= MAX_PARTIAL_MESSAGES+1; id++ {
+		stream, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_TEST_EEPROM_RESULT, id, strings.Repeat("a", 300))
+		feedAll(decoder, splitFrames(stream)[0])
+		for _, partial := range decoder.fragments {
+			partial.lastFragment = partial.lastFragment.Add(-time.Millisecond)
+		}
+	}
+	if len(decoder.fragments) != MAX_PARTIAL_MESSAGES {
+		t.Fatalf("Expected %d partial messages, got: %d", MAX_PARTIAL_MESSAGES, len(decoder.fragments))
+	}
+	if _, ok := decoder.fragments[fragmentKey{messageId: 1, messageType: MSG_TYPE_RESP, command: MSG_CMD_TEST_EEPROM_RESULT}]; ok {
+		t.Errorf("Expected the oldest partial message discarded")
+	}
+}
+
+func TestMessageTooLongIsRefused(t *testing.T) {
+	if _, err := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_SET, MSG_CMD_SERIAL_NUMBER, 1, strings.Repeat("a", MAX_MESSAGE_DATA_SIZE+1)); err == nil {
+		t.Errorf("Expected error encoding more than MAX_MESSAGE_DATA_SIZE bytes")
+	}
+}
+
+func TestSendMessageWithFragmentedRequestAndResponse(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetMaxProtocolVersion(PROTOCOL_VERSION)
+	handler.RegisterFunctionToRcvMsg(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(messageType, command uint8, message string, messageToken, externalData interface{}) {
+		handler.SendRespMessage(messageToken.(*CharlesMessage), "OK")
+	}, nil)
+	// Answers with the request data, sending a tamper event between the response fragments
+	transport.respond = func(message *CharlesMessage) string {
+		if message.command == MSG_CMD_PROTOCOL_VERSION {
+			return answerHandshake("1")(message)
+		}
+		if message.messageType != MSG_TYPE_SET {
+			return ""
+		}
+		response, _ := EncodeFrame(message.version, MSG_TYPE_RESP, message.command, message.messageId, message.data)
+		tamper, _ := EncodeFrame(message.version, MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, 2, "Open")
+		frames := splitFrames(response)
+		return frames[0] + tamper + strings.Join(frames[1:], "")
+	}
+	go handler.Start()
+	defer handler.Stop()
+
+	waitFor(t, func() bool { return handler.ProtocolVersion() == PROTOCOL_VERSION_BINARY })
+	expected := strings.Repeat("display line;", 80)
+	data, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_TEST_DISPLAY_RESULT, expected, 2000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != expected {
+		t.Errorf("Expected the %d bytes sent, got %d bytes", len(expected), len(data))
+	}
+	waitFor(t, func() bool {
+		message, _ := decodeLastFrame(transport.output())
+		return message != nil && message.messageType == MSG_TYPE_RESP && message.command == MSG_CMD_TAMPER_EVENT
+	})
+}
+
+// decodeLastFrame decodes the last frame written in a stream of binary frames.
+func decodeLastFrame(stream string) (*CharlesMessage, bool) {
+	frames := splitFrames(stream)
+	decoder := newBinaryDecoder()
+	messages, _ := feedAll(decoder, frames[len(frames)-1])
+	if len(messages) == 0 {
+		return nil, false
+	}
+	return messages[0], true
+}
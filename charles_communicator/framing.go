@@ -0,0 +1,143 @@
+package charles_communicator
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Binary frames (protocol version 1) are delimited by FRAME_FLAG and carry, before byte stuffing:
+//
+//	version (1) | type (1) | command (1) | message_id (2) | data_len (2) | data | crc (2)
+//
+// Multi-byte fields are big-endian and the CRC-16/CCITT-FALSE covers every byte before it.
+// FRAME_FLAG and FRAME_ESCAPE inside the frame are sent as FRAME_ESCAPE followed by the byte
+// XORed with FRAME_ESCAPE_XOR, so data can carry any byte.
+//
+// Data longer than FRAGMENT_DATA_SIZE is split into frames sharing the message id, with
+// MSG_FLAG_FRAGMENT set in the type and the data starting with the fragment index and the
+// number of fragments (1 byte each).
+
+func encodeBinaryMessage(message *CharlesMessage) ([]string, error) {
+	if len(message.data) <= FRAGMENT_DATA_SIZE {
+		frame, err := encodeBinaryFrame(message.version, message.messageType, message.command, message.messageId, message.data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{frame}, nil
+	}
+
+	fragmentCount := (len(message.data) + FRAGMENT_DATA_SIZE - 1) / FRAGMENT_DATA_SIZE
+	if fragmentCount > MAX_FRAGMENTS {
+		return nil, errors.New("message is too long")
+	}
+	frames := make([]string, 0, fragmentCount)
+	for index := 0; index < fragmentCount; index++ {
+		start := index * FRAGMENT_DATA_SIZE
+		end := min(start+FRAGMENT_DATA_SIZE, len(message.data))
+		fragment := string([]byte{byte(index), byte(fragmentCount)}) + message.data[start:end]
+		frame, err := encodeBinaryFrame(message.version, message.messageType|MSG_FLAG_FRAGMENT, message.command, message.messageId, fragment)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func encodeBinaryFrame(version, messageType, command uint8, messageId uint16, data string) (string, error) {
+	if len(data) > MAX_FRAME_DATA_SIZE {
+		return "", errors.New("message is too long")
+	}
+
+	payload := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(data)+FRAME_CRC_SIZE)
+	payload[0] = version
+	payload[1] = messageType
+	payload[2] = command
+	binary.BigEndian.PutUint16(payload[3:5], messageId)
+	binary.BigEndian.PutUint16(payload[5:7], uint16(len(data)))
+	payload = append(payload, data...)
+	payload = binary.BigEndian.AppendUint16(payload, crc16(payload))
+
+	var frame strings.Builder
+	frame.Grow(2*len(payload) + 2)
+	frame.WriteByte(FRAME_FLAG)
+	for _, b := range payload {
+		if b == FRAME_FLAG || b == FRAME_ESCAPE {
+			frame.WriteByte(FRAME_ESCAPE)
+			b ^= FRAME_ESCAPE_XOR
+		}
+		frame.WriteByte(b)
+	}
+	frame.WriteByte(FRAME_FLAG)
+	return frame.String(), nil
+}
+
+// decodeBinaryMessage parses an unstuffed binary frame, without its flags. It returns nil if
+// the frame is truncated, its length does not match data_len, its CRC is wrong or its fragment
+// header is invalid. Fragments are returned with fragmentCount set and the header removed.
+func decodeBinaryMessage(payload []byte) *CharlesMessage {
+	if len(payload) < FRAME_HEADER_SIZE+FRAME_CRC_SIZE {
+		return nil
+	}
+	crcOffset := len(payload) - FRAME_CRC_SIZE
+	if crc16(payload[:crcOffset]) != binary.BigEndian.Uint16(payload[crcOffset:]) {
+		return nil
+	}
+	dataLen := int(binary.BigEndian.Uint16(payload[5:7]))
+	if FRAME_HEADER_SIZE+dataLen != crcOffset {
+		return nil
+	}
+
+	message := &CharlesMessage{
+		version:     payload[0],
+		messageType: payload[1],
+		command:     payload[2],
+		messageId:   binary.BigEndian.Uint16(payload[3:5]),
+		dataLen:     uint16(dataLen + 1),
+		data:        string(payload[FRAME_HEADER_SIZE:crcOffset]),
+	}
+	if message.messageType&MSG_FLAG_FRAGMENT != 0 {
+		if len(message.data) < FRAGMENT_HEADER_SIZE {
+			return nil
+		}
+		message.messageType &^= MSG_FLAG_FRAGMENT
+		message.fragmentIndex = message.data[0]
+		message.fragmentCount = message.data[1]
+		message.data = message.data[FRAGMENT_HEADER_SIZE:]
+		message.dataLen = uint16(len(message.data) + 1)
+		if message.fragmentIndex >= message.fragmentCount {
+			return nil
+		}
+	}
+	return message
+}
+
+// crc16 computes the CRC-16/CCITT-FALSE (polynomial 0x1021, initial value 0xFFFF) of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeFrames serializes a message with the framing of its protocol version. Only protocol
+// version 1 splits long messages, with version 0 they are refused.
+func encodeFrames(message *CharlesMessage) ([]string, error) {
+	if message.version == PROTOCOL_VERSION_ASCII {
+		frame, err := encodeCharlesMessage(message)
+		if err != nil {
+			return nil, err
+		}
+		return []string{frame}, nil
+	}
+	return encodeBinaryMessage(message)
+}
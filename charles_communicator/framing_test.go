@@ -0,0 +1,213 @@
+package charles_communicator
+
+import (
+	"strings"
+	"testing"
+)
+
+func feedAll(decoder *FrameDecoder, stream string) (messages []*CharlesMessage, malformed int) {
+	for _, b := range []byte(stream) {
+		if message, complete := decoder.Feed(b); complete {
+			if message == nil {
+				malformed++
+			} else {
+				messages = append(messages, message)
+			}
+		}
+	}
+	return messages, malformed
+}
+
+// newBinaryDecoder returns the decoder of a link that negotiated protocol version 1.
+func newBinaryDecoder() *FrameDecoder {
+	decoder := &FrameDecoder{}
+	decoder.SetBinaryFraming(true)
+	return decoder
+}
+
+func TestBinaryFrameCarriesAnyData(t *testing.T) {
+	data := "a;b:c[d]e\x7e\x7d\x00" + strings.Repeat("x", 200)
+	frame, err := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_SET, MSG_CMD_SERIAL_NUMBER, 0x7e7d, data)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if strings.Count(frame, "\x7e") != 2 {
+		t.Errorf("Expected the flag only at the frame boundaries, got: %q", frame)
+	}
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, frame)
+	if len(messages) != 1 || malformed != 0 {
+		t.Fatalf("Expected 1 message, got: %d (%d malformed)", len(messages), malformed)
+	}
+	message := messages[0]
+	if message.version != PROTOCOL_VERSION_BINARY || message.messageType != MSG_TYPE_SET ||
+		message.command != MSG_CMD_SERIAL_NUMBER || message.messageId != 0x7e7d || message.data != data {
+		t.Errorf("Unexpected message: %+v", message)
+	}
+}
+
+func TestBinaryFrameWithWrongCRCIsDiscarded(t *testing.T) {
+	frame, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_BATTERY_LEVEL, 3, "87")
+	corrupted := []byte(frame)
+	corrupted[len(corrupted)-4] ^= 0x01
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, string(corrupted)+frame)
+	if malformed != 1 {
+		t.Errorf("Expected 1 malformed frame, got: %d", malformed)
+	}
+	if len(messages) != 1 || messages[0].data != "87" {
+		t.Errorf("Expected the valid frame after the corrupted one, got: %v", messages)
+	}
+}
+
+func TestBinaryFrameWithWrongLengthIsDiscarded(t *testing.T) {
+	payload := []byte{PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_BATTERY_LEVEL, 0, 3, 0, 5, '8', '7'}
+	payload = append(payload, byte(crc16(payload)>>8), byte(crc16(payload)))
+
+	if message := decodeBinaryMessage(payload); message != nil {
+		t.Errorf("Expected nil for a data_len not matching the frame, got: %+v", message)
+	}
+}
+
+func TestFrameDecoderAcceptsBothVersions(t *testing.T) {
+	binaryFrame, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, 2, "")
+	asciiFrame, _ := EncodeFrame(PROTOCOL_VERSION_ASCII, MSG_TYPE_RESP, MSG_CMD_PCB_REV, 1, "3")
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, "noise"+asciiFrame+"]"+binaryFrame+asciiFrame)
+	if len(messages) != 3 || malformed != 0 {
+		t.Fatalf("Expected 3 messages, got: %d (%d malformed)", len(messages), malformed)
+	}
+	for i, expected := range []uint8{PROTOCOL_VERSION_ASCII, PROTOCOL_VERSION_BINARY, PROTOCOL_VERSION_ASCII} {
+		if messages[i].version != expected {
+			t.Errorf("Expected message %d with version %d, got: %d", i, expected, messages[i].version)
+		}
+	}
+}
+
+func TestAsciiFrameCarriesFrameFlag(t *testing.T) {
+	asciiFrame, err := EncodeFrame(PROTOCOL_VERSION_ASCII, MSG_TYPE_RESP, MSG_CMD_OS_VERSION, 1, "1.2~rc")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	binaryFrame, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, 2, "")
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, asciiFrame+binaryFrame)
+	if len(messages) != 2 || malformed != 0 {
+		t.Fatalf("Expected 2 messages, got: %d (%d malformed)", len(messages), malformed)
+	}
+	if messages[0].data != "1.2~rc" || messages[1].version != PROTOCOL_VERSION_BINARY {
+		t.Errorf("Unexpected messages: %+v %+v", messages[0], messages[1])
+	}
+}
+
+func TestStrayFrameFlagOnAsciiLink(t *testing.T) {
+	first, _ := EncodeFrame(PROTOCOL_VERSION_ASCII, MSG_TYPE_RESP, MSG_CMD_OS_VERSION, 1, "1.2.3")
+	second, _ := EncodeFrame(PROTOCOL_VERSION_ASCII, MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, 2, "")
+
+	var decoder FrameDecoder
+	messages, malformed := feedAll(&decoder, "\x7e"+first+second)
+	if len(messages) != 2 || malformed != 0 {
+		t.Fatalf("Expected the 2 frames after the noise, got: %d (%d malformed)", len(messages), malformed)
+	}
+	if messages[0].messageId != 1 || messages[1].messageId != 2 {
+		t.Errorf("Unexpected messages: %+v %+v", messages[0], messages[1])
+	}
+}
+
+func TestBinaryFrameEndsAtDataLen(t *testing.T) {
+	frame, _ := EncodeFrame(PROTOCOL_VERSION_BINARY, MSG_TYPE_RESP, MSG_CMD_OS_VERSION, 1, "1.2.3")
+	// A header announcing 1 byte of data followed by a long run without the closing flag
+	long := "\x7e\x01\x02\x05\x00\x01\x00\x01" + strings.Repeat("a", 100)
+
+	decoder := newBinaryDecoder()
+	messages, malformed := feedAll(decoder, long+frame)
+	if malformed != 1 || decoder.overflow {
+		t.Errorf("Expected the long frame discarded at its data_len, got: %d malformed, overflow %v", malformed, decoder.overflow)
+	}
+	if len(messages) != 1 || messages[0].data != "1.2.3" {
+		t.Errorf("Expected the next frame decoded, got: %+v", messages)
+	}
+}
+
+func TestAsciiFrameRejectsReservedCharacters(t *testing.T) {
+	if _, err := EncodeFrame(PROTOCOL_VERSION_ASCII, MSG_TYPE_SET, MSG_CMD_SERIAL_NUMBER, 1, "AA:BB"); err == nil {
+		t.Errorf("Expected error encoding ':' with protocol version 0")
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	// Check value of CRC-16/CCITT-FALSE
+	if crc := crc16([]byte("123456789")); crc != 0x29B1 {
+		t.Errorf("Expected 0x29B1, got: 0x%04X", crc)
+	}
+}
+
+// answerHandshake answers the protocol version handshake with version, or with an error when
+// version is empty, and echoes the other requests.
+func answerHandshake(version string) func(message *CharlesMessage) string {
+	return func(message *CharlesMessage) string {
+		if message.command != MSG_CMD_PROTOCOL_VERSION {
+			return echoResponse(message)
+		}
+		if version == "" {
+			frame, _ := EncodeFrame(message.version, MSG_TYPE_ERROR, message.command, message.messageId, "unsupported command")
+			return frame
+		}
+		frame, _ := EncodeFrame(message.version, MSG_TYPE_RESP, message.command, message.messageId, version)
+		return frame
+	}
+}
+
+func TestHandshakeSwitchesToBinaryFrames(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetMaxProtocolVersion(PROTOCOL_VERSION)
+	transport.respond = answerHandshake("1")
+	go handler.Start()
+	defer handler.Stop()
+
+	waitFor(t, func() bool { return handler.ProtocolVersion() == PROTOCOL_VERSION_BINARY })
+	data, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_SERIAL_NUMBER, "AA:BB;CC", 1000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != "AA:BB;CC" {
+		t.Errorf("Expected AA:BB;CC, got: %s", data)
+	}
+	if !strings.HasPrefix(transport.output(), "[version:0;type:0;command:32;") {
+		t.Errorf("Expected the handshake to be sent with protocol version 0, got: %q", transport.output())
+	}
+}
+
+func TestHandshakeFallsBackToAscii(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetMaxProtocolVersion(PROTOCOL_VERSION)
+	transport.respond = answerHandshake("")
+	go handler.Start()
+	defer handler.Stop()
+
+	waitFor(t, func() bool { return strings.Contains(transport.output(), "command:32;") })
+	data, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_PCB_REV, "", 1000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != "OK" || handler.ProtocolVersion() != PROTOCOL_VERSION_ASCII {
+		t.Errorf("Expected OK with protocol version 0, got: %s with version %d", data, handler.ProtocolVersion())
+	}
+	if !strings.Contains(transport.output(), "[version:0;type:0;command:15;") {
+		t.Errorf("Expected an ASCII frame, got: %q", transport.output())
+	}
+}
+
+func TestRequestThatCannotBeFramedFails(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+
+	if _, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_SERIAL_NUMBER, "AA:BB", 1000); err == nil {
+		t.Errorf("Expected error sending ':' with protocol version 0")
+	}
+}
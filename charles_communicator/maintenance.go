@@ -0,0 +1,137 @@
+package charles_communicator
+
+import (
+	"context"
+	"event_control"
+	"time"
+)
+
+const (
+	MAINTENANCE_STARTED  = "started"
+	MAINTENANCE_FINISHED = "finished"
+)
+
+const (
+	MAINTENANCE_DRAIN_TIMEOUT = 5 * time.Second
+	// MAINTENANCE_DRAIN_INTERVAL is the period at which the pending requests are checked while draining
+	MAINTENANCE_DRAIN_INTERVAL = 10 * time.Millisecond
+)
+
+var maintenanceEventId int
+
+// GetMaintenanceEventId is the event fired with MAINTENANCE_STARTED when the STM32 link enters
+// maintenance mode and with MAINTENANCE_FINISHED once it leaves it.
+func GetMaintenanceEventId() int {
+	if maintenanceEventId == 0 {
+		maintenanceEventId = event_control.CreateEventId()
+	}
+	return maintenanceEventId
+}
+
+func EnterMaintenance(ctx context.Context) error {
+	return CCHandler.EnterMaintenance(ctx)
+}
+
+func ExitMaintenance(ctx context.Context) (string, error) {
+	return CCHandler.ExitMaintenance(ctx)
+}
+
+func GetMaintenanceFirmwareVersion() string {
+	return CCHandler.MaintenanceFirmwareVersion()
+}
+
+// EnterMaintenance hands the exclusive ownership of the STM32 port to the caller, e.g. to flash
+// the STM32. New GETs and SETs are rejected with ErrMaintenance, the pending ones are waited for
+// until the context is done and then failed with ErrMaintenance, and the port is closed. The
+// queued replies to the STM32 are dropped, as are the replies sent until ExitMaintenance, since
+// they would answer requests of the STM32 from before the maintenance. The port is neither
+// reopened by the reconnection nor by OpenPort until ExitMaintenance is called.
+func (h *CharlesCommunicatorHandler) EnterMaintenance(ctx context.Context) error {
+	h.mutex.Lock()
+	if h.maintenance {
+		h.mutex.Unlock()
+		return ErrMaintenance
+	}
+	h.maintenance = true
+	if dropped := h.messagesToSend[PRIORITY_REPLY].Len(); dropped > 0 {
+		Logger.Warnf("Dropping %d queued STM32 replies when entering maintenance", dropped)
+		h.messagesToSend[PRIORITY_REPLY].Init()
+	}
+	h.mutex.Unlock()
+	Logger.Infoln("STM32 link entering maintenance")
+	event_control.CallRegisteredEventFunctions(GetMaintenanceEventId(), 0, 0, MAINTENANCE_STARTED)
+
+	ticker := time.NewTicker(MAINTENANCE_DRAIN_INTERVAL)
+	defer ticker.Stop()
+	for h.hasPendingRequests() {
+		select {
+		case <-ctx.Done():
+			Logger.Warnln("STM32 requests still pending when entering maintenance, failing them")
+			h.failPendingRequests(ErrMaintenance)
+		case <-ticker.C:
+		}
+	}
+
+	h.mutex.Lock()
+	h.wantPort = false
+	h.mutex.Unlock()
+	h.closePort()
+	return nil
+}
+
+// ExitMaintenance reopens the port, accepts requests again and returns the firmware version
+// read from the STM32, which may have changed while in maintenance. The version is kept for
+// MaintenanceFirmwareVersion before MAINTENANCE_FINISHED is fired.
+func (h *CharlesCommunicatorHandler) ExitMaintenance(ctx context.Context) (string, error) {
+	h.mutex.Lock()
+	h.maintenance = false
+	h.mutex.Unlock()
+	Logger.Infoln("STM32 link leaving maintenance")
+
+	var version string
+	var err error
+	if !h.OpenPort() {
+		err = ErrPortClosed
+	} else if response, sendErr := h.SendMessageContext(ctx, MSG_TYPE_GET, MSG_CMD_FIRMWARE_VERSION, ""); sendErr != nil {
+		err = sendErr
+	} else {
+		version = response.Data
+	}
+	if err != nil {
+		Logger.Errorf("Cannot read the STM32 firmware version after maintenance: %v", err)
+	}
+	h.mutex.Lock()
+	h.maintenanceFirmwareVersion = version
+	h.mutex.Unlock()
+	event_control.CallRegisteredEventFunctions(GetMaintenanceEventId(), 0, 0, MAINTENANCE_FINISHED)
+	return version, err
+}
+
+// MaintenanceFirmwareVersion returns the firmware version read by the last ExitMaintenance,
+// empty when it could not be read.
+func (h *CharlesCommunicatorHandler) MaintenanceFirmwareVersion() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.maintenanceFirmwareVersion
+}
+
+// InMaintenance tells whether EnterMaintenance was called without ExitMaintenance.
+func (h *CharlesCommunicatorHandler) InMaintenance() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.maintenance
+}
+
+// hasPendingRequests tells whether a GET or SET is queued or waiting for its response.
+func (h *CharlesCommunicatorHandler) hasPendingRequests() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for priority := range h.messagesToSend {
+		for e := h.messagesToSend[priority].Front(); e != nil; e = e.Next() {
+			if message, ok := e.Value.(*CharlesMessage); ok && (message.messageType == MSG_TYPE_GET || message.messageType == MSG_TYPE_SET) {
+				return true
+			}
+		}
+	}
+	return h.messagesWaitingResponse.Len() > 0
+}
@@ -0,0 +1,87 @@
+package charles_communicator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceFailsUndrainedRequests(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := handler.SendMessageContext(context.Background(), MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "")
+		result <- err
+	}()
+	waitFor(t, handler.hasPendingRequests)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := handler.EnterMaintenance(ctx); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := <-result; !errors.Is(err, ErrMaintenance) {
+		t.Errorf("Expected the pending request to fail with ErrMaintenance, got: %v", err)
+	}
+	if _, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "", 1000); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("Expected ErrMaintenance, got: %v", err)
+	}
+	if handler.OpenPort() || handler.IsPortValid() {
+		t.Errorf("Expected the port to stay closed in maintenance")
+	}
+	if err := handler.EnterMaintenance(ctx); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("Expected ErrMaintenance when already in maintenance, got: %v", err)
+	}
+}
+
+func TestExitMaintenanceReadsFirmwareVersion(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = func(message *CharlesMessage) string {
+		frame, _ := EncodeFrame(message.version, MSG_TYPE_RESP, message.command, message.messageId, "2.0.1")
+		return frame
+	}
+	go handler.Start()
+	defer handler.Stop()
+
+	if err := handler.EnterMaintenance(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	version, err := handler.ExitMaintenance(context.Background())
+	if err != nil || version != "2.0.1" {
+		t.Errorf("Expected version 2.0.1, got: %s %v", version, err)
+	}
+	if handler.MaintenanceFirmwareVersion() != "2.0.1" {
+		t.Errorf("Expected the version kept for the maintenance subscribers, got: %s", handler.MaintenanceFirmwareVersion())
+	}
+	if handler.InMaintenance() || !handler.IsPortValid() {
+		t.Errorf("Expected the link restored after maintenance")
+	}
+}
+
+func TestMaintenanceDropsReplies(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	queuedReplies := func() int {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+		return handler.messagesToSend[PRIORITY_REPLY].Len()
+	}
+
+	handler.SendRespMessage(&CharlesMessage{messageId: 1, command: MSG_CMD_GET_WATCHDOG}, "OK")
+	if queuedReplies() != 1 {
+		t.Fatalf("Expected the reply queued")
+	}
+	if err := handler.EnterMaintenance(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if queuedReplies() != 0 {
+		t.Errorf("Expected the queued reply dropped when entering maintenance")
+	}
+	handler.SendErrorMessage(&CharlesMessage{messageId: 2, command: MSG_CMD_GET_WATCHDOG}, "busy")
+	if queuedReplies() != 0 {
+		t.Errorf("Expected the reply dropped in maintenance")
+	}
+}
@@ -0,0 +1,232 @@
+package charles_communicator
+
+import (
+	"event_control"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+const (
+	LINK_STATE_CONNECTED    = "connected"
+	LINK_STATE_DISCONNECTED = "disconnected"
+	LINK_STATE_RECONNECTING = "reconnecting"
+)
+
+const (
+	DEFAULT_RECONNECT_INITIAL_DELAY = 500 * time.Millisecond
+	DEFAULT_RECONNECT_MAX_DELAY     = 30 * time.Second
+	PROBE_TIMEOUT                   = time.Second
+	// PROBE_MESSAGE_ID is odd, as the ids of the messages sent to the STM32
+	PROBE_MESSAGE_ID = 1
+)
+
+var linkStateEventId int
+
+// GetLinkStateEventId is the event fired with LINK_STATE_CONNECTED, LINK_STATE_DISCONNECTED or
+// LINK_STATE_RECONNECTING when the state of the STM32 port changes.
+func GetLinkStateEventId() int {
+	if linkStateEventId == 0 {
+		linkStateEventId = event_control.CreateEventId()
+	}
+	return linkStateEventId
+}
+
+// portProbe finds the tty of the STM32 among candidate devices.
+type portProbe struct {
+	patterns     []string
+	excluded     []string
+	newTransport func(device string) Transport
+	timeout      time.Duration
+}
+
+// SetReconnectDelays sets the wait before the first attempt to reopen a lost port, doubled after
+// each failed attempt up to maxDelay.
+func (h *CharlesCommunicatorHandler) SetReconnectDelays(initialDelay, maxDelay time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reconnectInitialDelay = initialDelay
+	h.reconnectMaxDelay = max(maxDelay, initialDelay)
+}
+
+// SetPortProbing makes the handler probe, before opening the port, the device of its transport
+// and then the devices matching the glob patterns, and use the first one where an STM32 answers
+// the version handshake. The devices matching an excluded pattern, e.g. the ports of the modem,
+// are never written to. newTransport creates the transport of a candidate device.
+func (h *CharlesCommunicatorHandler) SetPortProbing(patterns, excluded []string, newTransport func(device string) Transport) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(patterns) == 0 {
+		h.probe = nil
+		return
+	}
+	h.probe = &portProbe{patterns: patterns, excluded: excluded, newTransport: newTransport, timeout: PROBE_TIMEOUT}
+}
+
+// LinkState returns the state of the STM32 port, one of the LINK_STATE_* values.
+func (h *CharlesCommunicatorHandler) LinkState() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.linkState
+}
+
+func (h *CharlesCommunicatorHandler) setLinkState(state string) {
+	h.mutex.Lock()
+	changed := h.linkState != state
+	h.linkState = state
+	h.mutex.Unlock()
+	if changed {
+		Logger.Infof("STM32 link %s", state)
+		event_control.CallRegisteredEventFunctions(GetLinkStateEventId(), 0, 0, state)
+	}
+}
+
+func (h *CharlesCommunicatorHandler) wantsPort() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.wantPort
+}
+
+func (h *CharlesCommunicatorHandler) requestReconnect() {
+	select {
+	case h.reconnectRequested <- struct{}{}:
+	default:
+	}
+}
+
+// reconnectLoop reopens the port each time it is lost, until the handler is stopped.
+func (h *CharlesCommunicatorHandler) reconnectLoop() {
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-h.reconnectRequested:
+			h.reconnect()
+		}
+	}
+}
+
+// reconnect tries to reopen the port, waiting between the attempts a delay that doubles from
+// the initial to the maximum one. It gives up when ClosePort is called.
+func (h *CharlesCommunicatorHandler) reconnect() {
+	h.mutex.Lock()
+	delay, maxDelay := h.reconnectInitialDelay, h.reconnectMaxDelay
+	h.mutex.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		if !h.wantsPort() || h.IsPortValid() {
+			return
+		}
+		h.setLinkState(LINK_STATE_RECONNECTING)
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(delay):
+		}
+		if !h.wantsPort() {
+			return
+		}
+		h.discoverPort()
+		if h.openPort() {
+			Logger.Infof("STM32 port reopened after %d attempts", attempt)
+			return
+		}
+		delay = min(2*delay, maxDelay)
+	}
+}
+
+// discoverPort switches the transport to the first candidate device where an STM32 answers.
+// The transport is kept when probing is disabled or no STM32 answers.
+func (h *CharlesCommunicatorHandler) discoverPort() {
+	h.mutex.Lock()
+	probe := h.probe
+	h.mutex.Unlock()
+	if probe == nil {
+		return
+	}
+
+	current := h.transportName()
+	candidates := []string{current}
+	for _, pattern := range probe.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			Logger.Warnf("Invalid probe pattern %s: %v", pattern, err)
+			continue
+		}
+		for _, match := range matches {
+			if match != current && !probe.isExcluded(match) {
+				candidates = append(candidates, match)
+			}
+		}
+	}
+
+	for _, device := range candidates {
+		transport := probe.newTransport(device)
+		if probeTransport(transport, probe.timeout) {
+			if device != current {
+				Logger.Infof("STM32 found on %s", device)
+				h.portMutex.Lock()
+				h.transport = transport
+				h.portMutex.Unlock()
+			}
+			return
+		}
+	}
+	Logger.Warnf("No STM32 answered on %v, keeping %s", candidates, current)
+}
+
+// isExcluded tells whether the device matches one of the excluded patterns.
+func (p *portProbe) isExcluded(device string) bool {
+	for _, pattern := range p.excluded {
+		if matched, _ := filepath.Match(pattern, device); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// probeTransport tells whether an STM32 answers on the transport. It sends the version
+// handshake offering protocol version 0, which every firmware answers, with a response or an
+// error, and waits for any valid message.
+func probeTransport(transport Transport, timeout time.Duration) bool {
+	if err := transport.Open(); err != nil {
+		return false
+	}
+	defer transport.Close()
+
+	frame, err := encodeCharlesMessage(&CharlesMessage{
+		version:     PROTOCOL_VERSION_ASCII,
+		messageType: MSG_TYPE_GET,
+		command:     MSG_CMD_PROTOCOL_VERSION,
+		messageId:   PROBE_MESSAGE_ID,
+		dataLen:     2,
+		data:        "0",
+	})
+	if err != nil {
+		return false
+	}
+	if _, err := transport.Write([]byte(frame)); err != nil {
+		return false
+	}
+
+	var decoder FrameDecoder
+	buf := make([]byte, 64)
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		n, err := transport.Read(buf)
+		if err != nil && err != io.EOF {
+			return false
+		}
+		for _, b := range buf[:n] {
+			if message, complete := decoder.Feed(b); complete && message != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *CharlesCommunicatorHandler) transportName() string {
+	h.portMutex.RLock()
+	defer h.portMutex.RUnlock()
+	return h.transport.Name()
+}
@@ -0,0 +1,150 @@
+package charles_communicator
+
+import (
+	"errors"
+	"event_control"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnectAfterReadError(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetReconnectDelays(time.Millisecond, 4*time.Millisecond)
+	transport.mutex.Lock()
+	transport.readError = errors.New("input/output error")
+	transport.openErrors = 2
+	transport.mutex.Unlock()
+	go handler.Start()
+	defer handler.Stop()
+
+	waitFor(t, func() bool {
+		return handler.Statistics().PortReopens == 1 && handler.LinkState() == LINK_STATE_CONNECTED
+	})
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.opens != 4 {
+		t.Errorf("Expected the first open and 3 attempts, got: %d opens", transport.opens)
+	}
+}
+
+func TestLinkStateEvents(t *testing.T) {
+	var mutex sync.Mutex
+	states := make(map[string]int)
+	event_control.RegisterToReceiveEvent(GetLinkStateEventId(), func(messageType, command uint8, message string, externalData interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states[message]++
+	}, nil)
+
+	handler, transport := newTestHandler(t)
+	handler.SetReconnectDelays(time.Millisecond, time.Millisecond)
+	transport.mutex.Lock()
+	transport.openErrors = 1
+	transport.mutex.Unlock()
+	go handler.Start()
+	defer handler.Stop()
+	handler.ClosePort()
+	handler.OpenPort()
+
+	// The event functions run concurrently, so only the number of changes is checked
+	waitFor(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return states[LINK_STATE_CONNECTED] == 2 && states[LINK_STATE_DISCONNECTED] == 1 && states[LINK_STATE_RECONNECTING] == 1
+	})
+}
+
+func TestClosePortStopsReconnecting(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetReconnectDelays(time.Millisecond, time.Millisecond)
+	go handler.Start()
+	defer handler.Stop()
+
+	transport.mutex.Lock()
+	transport.openErrors = 1000000
+	transport.mutex.Unlock()
+	handler.ClosePort()
+	handler.OpenPort()
+	waitFor(t, func() bool {
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		return transport.opens > 5
+	})
+	handler.ClosePort()
+	time.Sleep(10 * time.Millisecond)
+	transport.mutex.Lock()
+	opens := transport.opens
+	transport.mutex.Unlock()
+	time.Sleep(20 * time.Millisecond)
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.opens != opens || handler.LinkState() != LINK_STATE_DISCONNECTED {
+		t.Errorf("Expected no attempt after ClosePort, got %d more in state %s", transport.opens-opens, handler.LinkState())
+	}
+}
+
+func TestOpenPortProbesCandidateDevices(t *testing.T) {
+	directory := t.TempDir()
+	for _, name := range []string{"ttyUSB0", "ttyUSB1"} {
+		os.WriteFile(filepath.Join(directory, name), nil, 0o600)
+	}
+	answering := filepath.Join(directory, "ttyUSB1")
+	transports := map[string]*fakeTransport{}
+	newTransport := func(device string) Transport {
+		transport := &fakeTransport{name: device}
+		if device == answering {
+			transport.respond = func(message *CharlesMessage) string {
+				return "[version:0;type:3;command:32;message_id:1;data_len:20;data:unsupported command]"
+			}
+		}
+		transports[device] = transport
+		return transport
+	}
+
+	handler, _ := newTestHandler(t)
+	handler.ClosePort()
+	handler.SetPortProbing([]string{filepath.Join(directory, "ttyUSB*")}, nil, newTransport)
+	handler.probe.timeout = 20 * time.Millisecond
+	if !handler.OpenPort() {
+		t.Fatalf("Expected the port to open")
+	}
+
+	if handler.transportName() != answering {
+		t.Errorf("Expected %s, got: %s", answering, handler.transportName())
+	}
+	if len(transports) != 3 || transports["fake"] == nil || transports[filepath.Join(directory, "ttyUSB0")] == nil {
+		t.Errorf("Expected the current and the silent devices to be probed first, got: %v", transports)
+	}
+}
+
+func TestOpenPortNeverProbesExcludedDevices(t *testing.T) {
+	directory := t.TempDir()
+	for _, name := range []string{"ttyUSB0", "ttyACM0"} {
+		os.WriteFile(filepath.Join(directory, name), nil, 0o600)
+	}
+	var probed []string
+	newTransport := func(device string) Transport {
+		probed = append(probed, device)
+		return &fakeTransport{name: device}
+	}
+
+	handler, _ := newTestHandler(t)
+	handler.ClosePort()
+	handler.SetPortProbing([]string{filepath.Join(directory, "tty*")}, []string{filepath.Join(directory, "ttyUSB*")}, newTransport)
+	handler.probe.timeout = 20 * time.Millisecond
+	handler.OpenPort()
+	handler.ClosePort()
+
+	for _, device := range probed {
+		if device == filepath.Join(directory, "ttyUSB0") {
+			t.Errorf("Expected the excluded device not to be probed, got: %v", probed)
+		}
+	}
+	if len(probed) != 2 {
+		t.Errorf("Expected the current device and ttyACM0 to be probed, got: %v", probed)
+	}
+}
@@ -0,0 +1,173 @@
+package charles_communicator
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ReplayTransport is an in-memory Transport used to replay captures: the frames given to Feed are
+// returned by Read and everything written by the handler is discarded.
+type ReplayTransport struct {
+	mutex      sync.Mutex
+	inbound    bytes.Buffer
+	isOpen     bool
+	emptyReads int
+}
+
+func NewReplayTransport() *ReplayTransport {
+	return &ReplayTransport{}
+}
+
+func (t *ReplayTransport) Open() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.isOpen = true
+	return nil
+}
+
+func (t *ReplayTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.isOpen = false
+	return nil
+}
+
+func (t *ReplayTransport) Flush() error {
+	return nil
+}
+
+func (t *ReplayTransport) Read(buf []byte) (int, error) {
+	t.mutex.Lock()
+	if t.inbound.Len() > 0 {
+		defer t.mutex.Unlock()
+		return t.inbound.Read(buf)
+	}
+	t.emptyReads++
+	t.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	return 0, nil
+}
+
+func (t *ReplayTransport) Write(buf []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.isOpen {
+		return 0, errors.New("port is not open")
+	}
+	return len(buf), nil
+}
+
+func (t *ReplayTransport) Name() string {
+	return "replay"
+}
+
+// Feed queues bytes to be read by the handler.
+func (t *ReplayTransport) Feed(frame string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inbound.WriteString(frame)
+}
+
+// waitIdle returns when the handler has read every byte fed and asked for more, so the last
+// messages were processed.
+func (t *ReplayTransport) waitIdle(stop chan struct{}) {
+	t.mutex.Lock()
+	emptyReads := t.emptyReads
+	t.mutex.Unlock()
+	for {
+		t.mutex.Lock()
+		isIdle := t.inbound.Len() == 0 && t.emptyReads > emptyReads
+		t.mutex.Unlock()
+		if isIdle {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// Replay feeds a capture back into the handler, which must be started over a ReplayTransport.
+// The inbound messages are fed to the transport, so they go through processMessage as in the
+// field, and the outbound GETs and SETs are registered as waiting for a response with their
+// captured message ids. The outbound replies are not replayed, the handler sends its own.
+// With a positive speed the captured intervals are kept, divided by speed; otherwise the
+// records are replayed as fast as possible. It returns when the replies of the handler were
+// written.
+func (h *CharlesCommunicatorHandler) Replay(records []CaptureRecord, speed float64) error {
+	transport, ok := h.transport.(*ReplayTransport)
+	if !ok {
+		return errors.New("replay needs a ReplayTransport")
+	}
+
+	var previousTime time.Time
+	for i := range records {
+		record := &records[i]
+		if speed > 0 && !previousTime.IsZero() {
+			if interval := record.Time.Sub(previousTime); interval > 0 {
+				select {
+				case <-h.stop:
+					return ErrSupervisorDisabled
+				case <-time.After(time.Duration(float64(interval) / speed)):
+				}
+			}
+		}
+		previousTime = record.Time
+
+		if record.Direction == CAPTURE_INBOUND {
+			if record.Version >= PROTOCOL_VERSION_BINARY {
+				h.frameDecoder.SetBinaryFraming(true)
+			}
+			frame, err := EncodeFrame(record.Version, record.Type, record.Command, record.MessageId, string(record.Data))
+			if err != nil {
+				Logger.Warnf("Skipping record %d: %v", i+1, err)
+				continue
+			}
+			transport.Feed(frame)
+			// Keep the order between the inbound messages and the requests registered below
+			transport.waitIdle(h.stop)
+		} else if record.Type == MSG_TYPE_GET || record.Type == MSG_TYPE_SET {
+			h.replayRequest(record.message())
+		}
+	}
+	transport.waitIdle(h.stop)
+	h.waitSendQueues()
+	return nil
+}
+
+// waitSendQueues returns when the send loop has written every queued message.
+func (h *CharlesCommunicatorHandler) waitSendQueues() {
+	for {
+		h.mutex.Lock()
+		queued := 0
+		for priority := range h.messagesToSend {
+			queued += h.messagesToSend[priority].Len()
+		}
+		h.mutex.Unlock()
+		if queued == 0 {
+			return
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (h *CharlesCommunicatorHandler) replayRequest(message *CharlesMessage) {
+	message.messageTimeout = WAIT_MESSAGE_RESPONSE_TIMEOUT
+	message.messageCreationTime = time.Now().UnixMilli()
+	message.reqFunc = logReplayedResult
+	h.record(CAPTURE_OUTBOUND, message)
+	h.pushWaitingMessage(message)
+}
+
+func logReplayedResult(messageType, command uint8, message string, messageToken, externalData interface{}) {
+	Logger.Infof("%s id=%d finished with %s: %q", CommandToString(command), messageToken.(*CharlesMessage).messageId,
+		TypeToString(messageType), message)
+}
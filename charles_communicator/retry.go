@@ -0,0 +1,85 @@
+package charles_communicator
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy tells how many times a request is sent when the STM32 does not answer it.
+// The wait between two attempts starts at Backoff and doubles up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: 500 * time.Millisecond, MaxBackoff: 4 * time.Second}
+
+var noRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// IsIdempotent tells whether a request has no side effect on the STM32, so it can be repeated
+// after a timeout. Only the GETs of the commands declared Idempotent are, SETs are never repeated.
+func IsIdempotent(messageType, command uint8) bool {
+	spec, ok := commandsById[command]
+	return messageType == MSG_TYPE_GET && ok && spec.Idempotent
+}
+
+// SetRetryPolicy overrides DefaultRetryPolicy for the GETs of a command. It has no effect on
+// commands that are not idempotent.
+func (h *CharlesCommunicatorHandler) SetRetryPolicy(command uint8, policy RetryPolicy) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.retryPolicies == nil {
+		h.retryPolicies = make(map[uint8]RetryPolicy)
+	}
+	h.retryPolicies[command] = policy
+}
+
+func (h *CharlesCommunicatorHandler) getRetryPolicy(messageType, command uint8) RetryPolicy {
+	if !IsIdempotent(messageType, command) {
+		return noRetryPolicy
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if policy, ok := h.retryPolicies[command]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
+// sendRequestWithRetry sends a request again, following the retry policy of the command,
+// while the STM32 does not answer it.
+func (h *CharlesCommunicatorHandler) sendRequestWithRetry(ctx context.Context, messageType, command uint8, data string, timeout int64) (*Response, error) {
+	policy := h.getRetryPolicy(messageType, command)
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		attemptTimeout := timeout
+		if deadline, ok := ctx.Deadline(); ok {
+			if remaining := time.Until(deadline).Milliseconds(); remaining < attemptTimeout {
+				attemptTimeout = remaining
+			}
+		}
+
+		response, err := h.sendRequest(ctx, messageType, command, data, attemptTimeout)
+		if err == nil || attempt >= policy.MaxAttempts || !errors.Is(err, ErrTimeout) || ctx.Err() != nil {
+			return response, err
+		}
+
+		h.stats.retry(command)
+		Logger.Warnf("%s %s not answered, retrying (attempt %d of %d)", TypeToString(messageType), CommandToString(command), attempt+1, policy.MaxAttempts)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-h.stop:
+			return nil, ErrSupervisorDisabled
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package charles_communicator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dropFirstRequests answers with echoResponse after ignoring the first count requests.
+func dropFirstRequests(count int, requests *int) func(message *CharlesMessage) string {
+	return func(message *CharlesMessage) string {
+		*requests++
+		if *requests <= count {
+			return ""
+		}
+		return echoResponse(message)
+	}
+}
+
+func TestIdempotentGetIsRetriedAfterTimeout(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	requests := 0
+	transport.respond = dropFirstRequests(2, &requests)
+	handler.SetRetryPolicy(MSG_CMD_MODEM_SIGNAL, RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	go handler.Start()
+	defer handler.Stop()
+
+	data, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_MODEM_SIGNAL, "", 50)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != "OK" {
+		t.Errorf("Expected OK, got: %s", data)
+	}
+	if count := strings.Count(transport.output(), "command:5;"); count != 3 {
+		t.Errorf("Expected 3 attempts, got: %d", count)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetRetryPolicy(MSG_CMD_BATTERY_LEVEL, RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+	go handler.Start()
+	defer handler.Stop()
+
+	_, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "", 50)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected timeout error, got: %v", err)
+	}
+	if count := strings.Count(transport.output(), "command:29;"); count != 2 {
+		t.Errorf("Expected 2 attempts, got: %d", count)
+	}
+}
+
+func TestSetIsNeverRetried(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.SetRetryPolicy(MSG_CMD_MODEM_RESET, RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	go handler.Start()
+	defer handler.Stop()
+
+	_, err := handler.SendMessage(MSG_TYPE_SET, MSG_CMD_MODEM_RESET, "", 50)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected timeout error, got: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if count := strings.Count(transport.output(), "command:6;"); count != 1 {
+		t.Errorf("Expected a single attempt, got: %d", count)
+	}
+}
+
+func TestRemoteErrorIsNotRetried(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = func(message *CharlesMessage) string {
+		frame, _ := EncodeFrame(message.version, MSG_TYPE_ERROR, message.command, message.messageId, "no sim")
+		return frame
+	}
+	handler.SetRetryPolicy(MSG_CMD_SIM_ICCID, RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	go handler.Start()
+	defer handler.Stop()
+
+	_, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_SIM_ICCID, "", 50)
+	if !errors.Is(err, ErrRemote) {
+		t.Fatalf("Expected remote error, got: %v", err)
+	}
+	if count := strings.Count(transport.output(), "command:3;"); count != 1 {
+		t.Errorf("Expected a single attempt, got: %d", count)
+	}
+}
@@ -0,0 +1,200 @@
+package charles_communicator
+
+import (
+	"sync"
+	"time"
+)
+
+// LATENCY_BUCKETS_MS are the upper bounds of the round-trip latency histogram buckets. A last
+// bucket counts the latencies above the highest bound.
+var LATENCY_BUCKETS_MS = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// LatencyHistogram counts the round-trip latencies, from the request written to its response
+// received, per bucket of LATENCY_BUCKETS_MS.
+type LatencyHistogram struct {
+	BucketsMs []int64  `json:"buckets_ms"`
+	Counts    []uint64 `json:"counts"`
+	Count     uint64   `json:"count"`
+	SumMs     int64    `json:"sum_ms"`
+	MaxMs     int64    `json:"max_ms"`
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{
+		BucketsMs: LATENCY_BUCKETS_MS,
+		Counts:    make([]uint64, len(LATENCY_BUCKETS_MS)+1),
+	}
+}
+
+func (l *LatencyHistogram) observe(latencyMs int64) {
+	bucket := len(l.BucketsMs)
+	for i, bound := range l.BucketsMs {
+		if latencyMs <= bound {
+			bucket = i
+			break
+		}
+	}
+	l.Counts[bucket]++
+	l.Count++
+	l.SumMs += latencyMs
+	l.MaxMs = max(l.MaxMs, latencyMs)
+}
+
+func (l LatencyHistogram) copy() LatencyHistogram {
+	l.Counts = append([]uint64(nil), l.Counts...)
+	return l
+}
+
+// CommandStatistics are the counters of one MSG_CMD_* command. Sent and Received count messages
+// of any type, so a GET answered counts one of each. A fragmented message counts once.
+type CommandStatistics struct {
+	Sent     uint64           `json:"sent"`
+	Received uint64           `json:"received"`
+	Timeouts uint64           `json:"timeouts"`
+	Retries  uint64           `json:"retries"`
+	Errors   uint64           `json:"errors"`
+	Latency  LatencyHistogram `json:"latency"`
+}
+
+// LinkStatistics is a snapshot of the counters of the STM32 link since the handler was created.
+// A dead STM32 shows up as timeouts with no frame received, a noisy cable as decode failures.
+type LinkStatistics struct {
+	Since             time.Time        `json:"since"`
+	ProtocolVersion   uint8            `json:"protocol_version"`
+	PortOpen          bool             `json:"port_open"`
+	MessagesSent      uint64           `json:"messages_sent"`
+	MessagesReceived  uint64           `json:"messages_received"`
+	DecodeFailures    uint64           `json:"decode_failures"`
+	BufferOverflows   uint64           `json:"buffer_overflows"`
+	Timeouts          uint64           `json:"timeouts"`
+	Retries           uint64           `json:"retries"`
+	RemoteErrors      uint64           `json:"remote_errors"`
+	ReadErrors        uint64           `json:"read_errors"`
+	WriteErrors       uint64           `json:"write_errors"`
+	PortReopens       uint64           `json:"port_reopens"`
+	LastFrameReceived time.Time        `json:"last_frame_received"`
+	Latency           LatencyHistogram `json:"latency"`
+	// Commands is indexed by the CommandToString name
+	Commands map[string]*CommandStatistics `json:"commands"`
+}
+
+type linkStatistics struct {
+	mutex      sync.Mutex
+	stats      LinkStatistics
+	portOpened bool
+}
+
+func newLinkStatistics() *linkStatistics {
+	return &linkStatistics{stats: LinkStatistics{
+		Since:    time.Now(),
+		Latency:  newLatencyHistogram(),
+		Commands: make(map[string]*CommandStatistics),
+	}}
+}
+
+// command returns the counters of a command. It must be called holding the mutex.
+func (s *linkStatistics) command(command uint8) *CommandStatistics {
+	name := CommandToString(command)
+	commandStats, ok := s.stats.Commands[name]
+	if !ok {
+		commandStats = &CommandStatistics{Latency: newLatencyHistogram()}
+		s.stats.Commands[name] = commandStats
+	}
+	return commandStats
+}
+
+func (s *linkStatistics) messageSent(message *CharlesMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.MessagesSent++
+	s.command(message.command).Sent++
+}
+
+func (s *linkStatistics) messageReceived(message *CharlesMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.MessagesReceived++
+	s.stats.LastFrameReceived = time.Now()
+	s.command(message.command).Received++
+}
+
+func (s *linkStatistics) frameDiscarded(overflow bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if overflow {
+		s.stats.BufferOverflows++
+	} else {
+		s.stats.DecodeFailures++
+	}
+}
+
+func (s *linkStatistics) responseReceived(request *CharlesMessage, response *CharlesMessage) {
+	latencyMs := time.Now().UnixMilli() - request.messageCreationTime
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	commandStats := s.command(request.command)
+	if response.messageType == MSG_TYPE_ERROR {
+		s.stats.RemoteErrors++
+		commandStats.Errors++
+	}
+	s.stats.Latency.observe(latencyMs)
+	commandStats.Latency.observe(latencyMs)
+}
+
+func (s *linkStatistics) timeout(command uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.Timeouts++
+	s.command(command).Timeouts++
+}
+
+func (s *linkStatistics) retry(command uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.Retries++
+	s.command(command).Retries++
+}
+
+func (s *linkStatistics) readError() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.ReadErrors++
+}
+
+func (s *linkStatistics) writeError() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.WriteErrors++
+}
+
+func (s *linkStatistics) portOpen() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.portOpened {
+		s.stats.PortReopens++
+	}
+	s.portOpened = true
+}
+
+func (s *linkStatistics) snapshot() LinkStatistics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := s.stats
+	snapshot.Latency = s.stats.Latency.copy()
+	snapshot.Commands = make(map[string]*CommandStatistics, len(s.stats.Commands))
+	for name, commandStats := range s.stats.Commands {
+		commandCopy := *commandStats
+		commandCopy.Latency = commandStats.Latency.copy()
+		snapshot.Commands[name] = &commandCopy
+	}
+	return snapshot
+}
+
+// Statistics returns a snapshot of the link counters.
+func (h *CharlesCommunicatorHandler) Statistics() LinkStatistics {
+	snapshot := h.stats.snapshot()
+	snapshot.ProtocolVersion = h.ProtocolVersion()
+	snapshot.PortOpen = h.IsPortValid()
+	return snapshot
+}
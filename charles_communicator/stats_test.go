@@ -0,0 +1,89 @@
+package charles_communicator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatisticsCountMessagesAndLatency(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = echoResponse
+	go handler.Start()
+	defer handler.Stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := handler.SendMessage(MSG_TYPE_GET, MSG_CMD_BATTERY_LEVEL, "", 1000); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	statistics := handler.Statistics()
+	if statistics.MessagesSent != 3 || statistics.MessagesReceived != 3 {
+		t.Errorf("Expected 3 messages sent and received, got: %d and %d", statistics.MessagesSent, statistics.MessagesReceived)
+	}
+	battery := statistics.Commands["BATTERY_LEVEL"]
+	if battery == nil || battery.Sent != 3 || battery.Received != 3 || battery.Latency.Count != 3 {
+		t.Fatalf("Unexpected BATTERY_LEVEL statistics: %+v", battery)
+	}
+	if statistics.Latency.Count != 3 || statistics.LastFrameReceived.IsZero() {
+		t.Errorf("Unexpected link latency: %+v", statistics.Latency)
+	}
+}
+
+func TestStatisticsCountTimeoutsAndRetries(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	handler.SetRetryPolicy(MSG_CMD_PCB_REV, RetryPolicy{MaxAttempts: 2})
+	go handler.Start()
+	defer handler.Stop()
+
+	handler.SendMessage(MSG_TYPE_GET, MSG_CMD_PCB_REV, "", 20)
+
+	statistics := handler.Statistics()
+	if statistics.Timeouts != 2 || statistics.Retries != 1 {
+		t.Errorf("Expected 2 timeouts and 1 retry, got: %d and %d", statistics.Timeouts, statistics.Retries)
+	}
+	if statistics.MessagesReceived != 0 {
+		t.Errorf("Expected no message received, got: %d", statistics.MessagesReceived)
+	}
+}
+
+func TestStatisticsCountDiscardedFrames(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	go handler.Start()
+	defer handler.Stop()
+	handler.frameDecoder.SetBinaryFraming(true)
+
+	transport.feed("[version:0;type:x]")
+	transport.feed("[" + strings.Repeat("a", BUFFER_SIZE) + "]")
+	transport.feed("\x7e\x01\x02\x7e")
+
+	waitFor(t, func() bool {
+		statistics := handler.Statistics()
+		return statistics.DecodeFailures == 2 && statistics.BufferOverflows == 1
+	})
+}
+
+func TestStatisticsCountPortReopens(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	handler.ClosePort()
+	handler.OpenPort()
+
+	statistics := handler.Statistics()
+	if statistics.PortReopens != 1 || !statistics.PortOpen {
+		t.Errorf("Expected 1 reopen with the port open, got: %d %v", statistics.PortReopens, statistics.PortOpen)
+	}
+}
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+	histogram := newLatencyHistogram()
+	for _, latency := range []int64{5, 10, 11, 20000} {
+		histogram.observe(latency)
+	}
+
+	if histogram.Counts[0] != 2 || histogram.Counts[1] != 1 || histogram.Counts[len(histogram.Counts)-1] != 1 {
+		t.Errorf("Unexpected bucket counts: %v", histogram.Counts)
+	}
+	if histogram.MaxMs != 20000 || histogram.SumMs != 20026 {
+		t.Errorf("Unexpected max and sum: %d %d", histogram.MaxMs, histogram.SumMs)
+	}
+}
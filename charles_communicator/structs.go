@@ -2,8 +2,9 @@ package charles_communicator
 
 import (
 	"container/list"
-
-	"github.com/tarm/serial"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type CharlesMessage struct {
@@ -11,35 +12,73 @@ type CharlesMessage struct {
 	messageId           uint16
 	messageType         uint8
 	command             uint8
-	dataLen             uint8
+	dataLen             uint16
 	data                string
 	messageTimeout      int64
 	messageCreationTime int64
 	reqFunc             pointerToCharlesFunction
 	externalData        interface{}
+	// failure is the reason given to reqFunc with MSG_TYPE_CANCELED
+	failure error
+	// replied is set on the GETs and SETs of the STM32 once answered, under the handler lock
+	replied bool
+	// fragmentCount is set on the fragments of a message while it is reassembled
+	fragmentIndex uint8
+	fragmentCount uint8
 }
 
 type CharlesCommunicatorHandler struct {
-	respFunctionsList       list.List
-	messagesToSendList      list.List
+	// mutex protects the lists and msgIdControl, which are used by the Start goroutine and by
+	// every goroutine sending messages
+	mutex                   sync.Mutex
+	subscriptions           list.List
+	messagesToSend          [PRIORITY_LEVELS]list.List
 	messagesWaitingResponse list.List
-	rcvMsgState             int
-	config                  *serial.Config
-	port                    *serial.Port
-	ValidPort               bool
-	rcvMsgBufferControl     uint
-	rcvMsgBuffer            [BUFFER_SIZE]byte
-	msgIdControl            uint16
-}
-
-type RespFuction struct {
-	respFunction pointerToCharlesFunction
-	externalData interface{}
-	messageType  uint8
-	command      uint8
+	// portMutex protects the transport, so it is not closed while being read or written
+	portMutex      sync.RWMutex
+	transport      Transport
+	validPort      bool
+	frameDecoder   FrameDecoder
+	msgIdControl   uint16
+	pacingInterval time.Duration
+	retryPolicies  map[uint8]RetryPolicy
+	// protocolVersion is the version negotiated with the STM32, used to encode the GETs and SETs
+	protocolVersion    uint8
+	maxProtocolVersion uint8
+	running            bool
+	// wantPort is cleared by ClosePort, so the lost port is not reopened in the background
+	wantPort bool
+	// maintenance is set between EnterMaintenance and ExitMaintenance, while the port belongs to
+	// another program
+	maintenance bool
+	// maintenanceFirmwareVersion is the firmware version read by the last ExitMaintenance
+	maintenanceFirmwareVersion string
+	linkState                  string
+	reconnectInitialDelay      time.Duration
+	reconnectMaxDelay          time.Duration
+	reconnectRequested         chan struct{}
+	probe                      *portProbe
+	capture                    *Capture
+	stats                      *linkStatistics
+	messageQueued              chan struct{}
+	// inbound holds the GETs and SETs of the STM32 read by Start until the inbound loop gives
+	// them to their subscribers
+	inbound chan *CharlesMessage
+	stop    chan struct{}
 }
 
-type respStatusParameters struct {
-	messageType uint8
-	message     string
+// FrameDecoder splits a byte stream into messages and reassembles the fragmented ones. The
+// frames of protocol version 0 are always accepted, the binary frames of version 1 only once
+// SetBinaryFraming is called, so a noise byte on a version 0 link does not start a binary frame.
+type FrameDecoder struct {
+	binary        atomic.Bool
+	state         int
+	bufferControl uint
+	escaped       bool
+	// overflow tells whether the last frame discarded was longer than the buffer
+	overflow bool
+	buffer   [BINARY_BUFFER_SIZE]byte
+	// fragmentsMutex protects fragments, expired by the send loop while Start feeds the decoder
+	fragmentsMutex sync.Mutex
+	fragments      map[fragmentKey]*partialMessage
 }
@@ -0,0 +1,149 @@
+package charles_communicator
+
+// InboundMessage is a GET or SET sent by the STM32, as given to the subscribers of its command.
+type InboundMessage struct {
+	Type      uint8
+	Command   uint8
+	Data      string
+	MessageId uint16
+	reply     string
+}
+
+// SetReply sets the data of the response sent to the STM32 once every subscriber returned.
+// It defaults to "OK"; when several subscribers set it, the last one wins.
+func (m *InboundMessage) SetReply(data string) {
+	m.reply = data
+}
+
+// Subscriber is called for each GET or SET of its command. Returning an error answers the STM32
+// with an ERROR carrying the error text instead of the response. The subscribers run on the
+// inbound loop, not on the goroutine reading the port, so they can wait for the response of a
+// request; the next GETs and SETs of the STM32 wait meanwhile.
+type Subscriber func(message *InboundMessage) error
+
+// Subscription is the handle returned by Subscribe and RegisterFunctionToRcvMsg.
+type Subscription struct {
+	handler     *CharlesCommunicatorHandler
+	messageType uint8
+	command     uint8
+	subscriber  Subscriber
+	// respFunction is set by RegisterFunctionToRcvMsg; it answers the STM32 itself with the
+	// messageToken
+	respFunction pointerToCharlesFunction
+	externalData interface{}
+}
+
+// Cancel removes the subscription; the messages received afterwards are no longer given to it.
+// It can be called several times.
+func (s *Subscription) Cancel() {
+	h := s.handler
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for e := h.subscriptions.Front(); e != nil; e = e.Next() {
+		if e.Value == s {
+			h.subscriptions.Remove(e)
+			return
+		}
+	}
+}
+
+// Subscribe calls subscriber for each GET or SET of the command sent by the STM32. Every
+// subscriber of the command is called, in subscription order, and then the handler sends
+// exactly one reply: an ERROR with the text of the first error returned, or else the response
+// set with SetReply. Commands without subscribers are answered with "unsupported command".
+func (h *CharlesCommunicatorHandler) Subscribe(messageType, command uint8, subscriber Subscriber) *Subscription {
+	return h.addSubscription(&Subscription{messageType: messageType, command: command, subscriber: subscriber})
+}
+
+// RegisterFunctionToRcvMsg subscribes a function that answers the STM32 itself, calling
+// SendRespMessage or SendErrorMessage with the messageToken. When such a function is subscribed
+// to a command, the handler does not reply on its own, and only the first reply sent for a
+// message reaches the STM32.
+func (h *CharlesCommunicatorHandler) RegisterFunctionToRcvMsg(messageType, command uint8, respFunction pointerToCharlesFunction, externalData interface{}) *Subscription {
+	return h.addSubscription(&Subscription{
+		messageType:  messageType,
+		command:      command,
+		respFunction: respFunction,
+		externalData: externalData,
+	})
+}
+
+func (h *CharlesCommunicatorHandler) addSubscription(subscription *Subscription) *Subscription {
+	subscription.handler = h
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.subscriptions.PushBack(subscription)
+	return subscription
+}
+
+// subscriptionsOf returns the subscriptions to the message, so they are called without holding
+// the handler lock.
+func (h *CharlesCommunicatorHandler) subscriptionsOf(message *CharlesMessage) []*Subscription {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var subscriptions []*Subscription
+	for e := h.subscriptions.Front(); e != nil; e = e.Next() {
+		subscription := e.Value.(*Subscription)
+		if subscription.command == message.command && subscription.messageType == message.messageType {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions
+}
+
+// dispatchInbound gives a GET or SET of the STM32 to the subscribers of its command and replies.
+// The subscribers are called without holding the handler lock, so they can send messages and
+// wait for their responses.
+func (h *CharlesCommunicatorHandler) dispatchInbound(message *CharlesMessage) {
+	subscriptions := h.subscriptionsOf(message)
+	if len(subscriptions) == 0 {
+		h.SendErrorMessage(message, "unsupported command")
+		return
+	}
+
+	inbound := &InboundMessage{
+		Type:      message.messageType,
+		Command:   message.command,
+		Data:      message.data,
+		MessageId: message.messageId,
+		reply:     "OK",
+	}
+	repliesItself := false
+	var failure error
+	for _, subscription := range subscriptions {
+		if subscription.subscriber == nil {
+			repliesItself = true
+			if subscription.respFunction != nil {
+				subscription.respFunction(message.messageType, message.command, message.data, message, subscription.externalData)
+			}
+			continue
+		}
+		if err := subscription.subscriber(inbound); err != nil {
+			Logger.Warnf("Subscriber of %s %s failed: %v", TypeToString(message.messageType), CommandToString(message.command), err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+
+	switch {
+	case repliesItself:
+		return
+	case failure != nil:
+		h.SendErrorMessage(message, failure.Error())
+	default:
+		h.SendRespMessage(message, inbound.reply)
+	}
+}
+
+// claimReply marks the message as answered and tells whether it was not answered yet.
+func (h *CharlesCommunicatorHandler) claimReply(messageToken *CharlesMessage) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if messageToken.replied {
+		return false
+	}
+	messageToken.replied = true
+	return true
+}
@@ -0,0 +1,148 @@
+package charles_communicator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tamperOpenFrame = "version:0;type:1;command:23;message_id:2;data_len:5;data:Open"
+
+// drainReplies writes every queued message and returns the output of the transport.
+func drainReplies(handler *CharlesCommunicatorHandler, transport *fakeTransport) string {
+	for handler.sendMessageIfExists() {
+	}
+	return transport.output()
+}
+
+func TestSubscribeFansOutWithSingleReply(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	var received []string
+	for _, name := range []string{"buzzer", "monitor"} {
+		name := name
+		handler.Subscribe(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(message *InboundMessage) error {
+			received = append(received, name+":"+message.Data)
+			return nil
+		})
+	}
+
+	handler.processMessage(decodeCharlesMessage(tamperOpenFrame))
+
+	if strings.Join(received, ",") != "buzzer:Open,monitor:Open" {
+		t.Errorf("Expected both subscribers in order, got: %v", received)
+	}
+	expected := "[version:0;type:2;command:23;message_id:2;data_len:3;data:OK]"
+	if output := drainReplies(handler, transport); output != expected {
+		t.Errorf("Expected a single reply %s, got: %s", expected, output)
+	}
+}
+
+func TestSubscriberErrorRepliesError(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	handler.Subscribe(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(message *InboundMessage) error {
+		message.SetReply("ignored")
+		return nil
+	})
+	handler.Subscribe(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(message *InboundMessage) error {
+		return errors.New("buzzer busy")
+	})
+
+	handler.processMessage(decodeCharlesMessage(tamperOpenFrame))
+
+	expected := "[version:0;type:3;command:23;message_id:2;data_len:12;data:buzzer busy]"
+	if output := drainReplies(handler, transport); output != expected {
+		t.Errorf("Expected %s, got: %s", expected, output)
+	}
+}
+
+func TestCanceledSubscriptionIsNotCalled(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	calls := 0
+	subscription := handler.Subscribe(MSG_TYPE_GET, MSG_CMD_GET_WATCHDOG, func(message *InboundMessage) error {
+		calls++
+		message.SetReply("alive")
+		return nil
+	})
+
+	handler.processMessage(decodeCharlesMessage("version:0;type:0;command:0;message_id:2;data_len:1;data:"))
+	subscription.Cancel()
+	subscription.Cancel()
+	handler.processMessage(decodeCharlesMessage("version:0;type:0;command:0;message_id:4;data_len:1;data:"))
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got: %d", calls)
+	}
+	expected := "[version:0;type:2;command:0;message_id:2;data_len:6;data:alive]" +
+		"[version:0;type:3;command:0;message_id:4;data_len:20;data:unsupported command]"
+	if output := drainReplies(handler, transport); output != expected {
+		t.Errorf("Expected %s, got: %s", expected, output)
+	}
+}
+
+func TestRegisteredFunctionOwnsTheReply(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	subscriberCalled := false
+	handler.Subscribe(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(message *InboundMessage) error {
+		subscriberCalled = true
+		return nil
+	})
+	handler.RegisterFunctionToRcvMsg(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(messageType, command uint8, message string, messageToken, externalData interface{}) {
+		handler.SendRespMessage(messageToken.(*CharlesMessage), "ACK")
+		handler.SendErrorMessage(messageToken.(*CharlesMessage), "twice")
+	}, nil)
+
+	handler.processMessage(decodeCharlesMessage(tamperOpenFrame))
+
+	if !subscriberCalled {
+		t.Errorf("Expected the subscriber to be called")
+	}
+	expected := "[version:0;type:2;command:23;message_id:2;data_len:4;data:ACK]"
+	if output := drainReplies(handler, transport); output != expected {
+		t.Errorf("Expected only the first reply %s, got: %s", expected, output)
+	}
+}
+
+func TestSubscriberCanWaitForRequest(t *testing.T) {
+	handler, transport := newTestHandler(t)
+	transport.respond = func(message *CharlesMessage) string {
+		if message.messageType != MSG_TYPE_GET {
+			return ""
+		}
+		frame, _ := EncodeFrame(message.version, MSG_TYPE_RESP, message.command, message.messageId, "36.5")
+		return frame
+	}
+	type result struct {
+		data string
+		err  error
+	}
+	results := make(chan result, 1)
+	handler.Subscribe(MSG_TYPE_SET, MSG_CMD_TAMPER_EVENT, func(message *InboundMessage) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		response, err := handler.SendMessageContext(ctx, MSG_TYPE_GET, MSG_CMD_STM32_TEMPERATURE, "")
+		if err != nil {
+			results <- result{err: err}
+			return err
+		}
+		results <- result{data: response.Data}
+		return nil
+	})
+	go handler.Start()
+	defer handler.Stop()
+
+	transport.feed("[" + tamperOpenFrame + "]")
+
+	select {
+	case response := <-results:
+		if response.err != nil || response.data != "36.5" {
+			t.Fatalf("Expected the response read while the subscriber waits, got: %q %v", response.data, response.err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("The request of the subscriber was not answered")
+	}
+	waitFor(t, func() bool {
+		return strings.Contains(transport.output(), "command:23;message_id:2;data_len:3;data:OK")
+	})
+}
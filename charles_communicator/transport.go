@@ -0,0 +1,154 @@
+package charles_communicator
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	TRANSPORT_READ_TIMEOUT    = 500 * time.Millisecond
+	tcpTransportAddressPrefix = "tcp://"
+)
+
+// Transport is the byte stream used by CharlesCommunicatorHandler to talk with the STM32.
+//
+// Read must return periodically, with (0, nil) or (0, io.EOF) when no data arrived, e.g. after
+// TRANSPORT_READ_TIMEOUT: the goroutine reading the port only notices Stop between two reads, and
+// closing the port waits for the read in progress.
+type Transport interface {
+	Open() error
+	Close() error
+	Flush() error
+	Read(buf []byte) (int, error)
+	Write(buf []byte) (int, error)
+	Name() string
+}
+
+// NewTransport creates a transport from an address. Addresses starting with "tcp://" create
+// a TCPTransport, any other value is handled as a serial device path (e.g. /dev/ttyS1 or a PTY).
+func NewTransport(address string, baud int) Transport {
+	if strings.HasPrefix(address, tcpTransportAddressPrefix) {
+		return NewTCPTransport(strings.TrimPrefix(address, tcpTransportAddressPrefix))
+	}
+	return NewSerialTransport(address, baud)
+}
+
+// SerialTransport is a Transport backed by a tty device.
+type SerialTransport struct {
+	config *serial.Config
+	port   *serial.Port
+}
+
+func NewSerialTransport(device string, baud int) *SerialTransport {
+	return &SerialTransport{
+		config: &serial.Config{Name: device, Baud: baud, ReadTimeout: TRANSPORT_READ_TIMEOUT},
+	}
+}
+
+func (t *SerialTransport) Open() error {
+	port, err := serial.OpenPort(t.config)
+	if err != nil {
+		return err
+	}
+	t.port = port
+	return nil
+}
+
+func (t *SerialTransport) Close() error {
+	if t.port == nil {
+		return errors.New("port is not open")
+	}
+	err := t.port.Close()
+	t.port = nil
+	return err
+}
+
+func (t *SerialTransport) Flush() error {
+	if t.port == nil {
+		return errors.New("port is not open")
+	}
+	return t.port.Flush()
+}
+
+func (t *SerialTransport) Read(buf []byte) (int, error) {
+	if t.port == nil {
+		return 0, errors.New("port is not open")
+	}
+	return t.port.Read(buf)
+}
+
+func (t *SerialTransport) Write(buf []byte) (int, error) {
+	if t.port == nil {
+		return 0, errors.New("port is not open")
+	}
+	return t.port.Write(buf)
+}
+
+func (t *SerialTransport) Name() string {
+	return t.config.Name
+}
+
+// TCPTransport is a Transport backed by a TCP connection, used to reach a simulated STM32.
+type TCPTransport struct {
+	address string
+	conn    net.Conn
+}
+
+func NewTCPTransport(address string) *TCPTransport {
+	return &TCPTransport{address: address}
+}
+
+func (t *TCPTransport) Open() error {
+	conn, err := net.DialTimeout("tcp", t.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+func (t *TCPTransport) Close() error {
+	if t.conn == nil {
+		return errors.New("connection is not open")
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func (t *TCPTransport) Flush() error {
+	return nil
+}
+
+// Read emulates the serial read timeout: an expired deadline is reported as an idle read.
+func (t *TCPTransport) Read(buf []byte) (int, error) {
+	if t.conn == nil {
+		return 0, errors.New("connection is not open")
+	}
+	t.conn.SetReadDeadline(time.Now().Add(TRANSPORT_READ_TIMEOUT))
+	n, err := t.conn.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, errors.New("connection closed by peer")
+	}
+	return n, err
+}
+
+func (t *TCPTransport) Write(buf []byte) (int, error) {
+	if t.conn == nil {
+		return 0, errors.New("connection is not open")
+	}
+	return t.conn.Write(buf)
+}
+
+func (t *TCPTransport) Name() string {
+	return tcpTransportAddressPrefix + t.address
+}
@@ -45,6 +45,10 @@ func decodeCharlesMessage(message string) *CharlesMessage {
 }
 
 func encodeCharlesMessage(message *CharlesMessage) (string, error) {
+	if strings.ContainsAny(message.data, ";:[]") {
+		return "", errors.New("data cannot be sent with protocol version 0")
+	}
+
 	serializedMessage := fmt.Sprintf("[version:%d;type:%d;command:%d;message_id:%d;data_len:%d;data:%s]",
 		message.version, message.messageType, message.command, message.messageId, message.dataLen, message.data)
 
@@ -55,6 +59,148 @@ func encodeCharlesMessage(message *CharlesMessage) (string, error) {
 	return serializedMessage, nil
 }
 
+// SetBinaryFraming accepts the binary frames of protocol version 1, once it is negotiated, or
+// only the frames of version 0. It can be called while another goroutine feeds the decoder.
+func (d *FrameDecoder) SetBinaryFraming(accept bool) {
+	d.binary.Store(accept)
+}
+
+// Feed processes one byte of the stream. When a frame is closed it returns the decoded message
+// and true; the message is nil if the frame is malformed. The bracketed frames of protocol
+// version 0 are accepted, and the binary frames of version 1 when SetBinaryFraming allows them;
+// the binary frame flag is data inside a version 0 frame. Frames longer than the buffer, or than
+// the data_len of their header, are discarded.
+func (d *FrameDecoder) Feed(b byte) (*CharlesMessage, bool) {
+	if d.state == RECEIVING_BINARY_DATA {
+		return d.feedBinary(b)
+	}
+	if b == FRAME_FLAG && (d.state == RECEIVING_DATA || !d.binary.Load()) {
+		return d.feedASCII(b)
+	}
+
+	switch b {
+	case '[':
+		d.state = RECEIVING_DATA
+		d.bufferControl = 0
+	case ']':
+		isReceiving := d.state == RECEIVING_DATA
+		d.state = WAITING_FOR_MESSAGE
+		if isReceiving {
+			d.overflow = false
+			return decodeCharlesMessage(string(d.buffer[:d.bufferControl])), true
+		}
+	case FRAME_FLAG:
+		d.state = RECEIVING_BINARY_DATA
+		d.bufferControl = 0
+		d.escaped = false
+	default:
+		if d.state == RECEIVING_DATA {
+			return d.feedASCII(b)
+		}
+	}
+	return nil, false
+}
+
+func (d *FrameDecoder) feedASCII(b byte) (*CharlesMessage, bool) {
+	if d.state != RECEIVING_DATA {
+		return nil, false
+	}
+	if d.bufferControl >= (BUFFER_SIZE - 1) {
+		d.state = WAITING_FOR_MESSAGE
+		d.overflow = true
+		return nil, true
+	}
+	d.buffer[d.bufferControl] = b
+	d.bufferControl++
+	return nil, false
+}
+
+func (d *FrameDecoder) feedBinary(b byte) (*CharlesMessage, bool) {
+	switch {
+	case b == FRAME_FLAG:
+		// Consecutive flags delimit an empty frame, which is ignored
+		if d.bufferControl == 0 {
+			d.escaped = false
+			return nil, false
+		}
+		d.state = WAITING_FOR_MESSAGE
+		d.overflow = false
+		if d.escaped {
+			return nil, true
+		}
+		message := decodeBinaryMessage(d.buffer[:d.bufferControl])
+		if message == nil {
+			return nil, true
+		}
+		// Fragments are kept until the whole message is received
+		message = d.reassemble(message)
+		return message, message != nil
+	case b == FRAME_ESCAPE:
+		d.escaped = true
+	default:
+		if d.escaped {
+			b ^= FRAME_ESCAPE_XOR
+			d.escaped = false
+		}
+		if d.bufferControl >= BINARY_BUFFER_SIZE {
+			d.state = WAITING_FOR_MESSAGE
+			d.overflow = true
+			return nil, true
+		}
+		// The frame ends after the CRC following the data_len bytes of data: a longer frame is
+		// discarded without waiting for its flag, or for the buffer to overflow
+		if d.bufferControl >= FRAME_HEADER_SIZE {
+			dataLen := uint(d.buffer[5])<<8 | uint(d.buffer[6])
+			if dataLen > MAX_FRAME_DATA_SIZE || d.bufferControl >= FRAME_HEADER_SIZE+dataLen+FRAME_CRC_SIZE {
+				d.state = WAITING_FOR_MESSAGE
+				d.overflow = false
+				return nil, true
+			}
+		}
+		d.buffer[d.bufferControl] = b
+		d.bufferControl++
+	}
+	return nil, false
+}
+
+// EncodeFrame serializes a message built from its fields, with the framing of the given protocol
+// version. Long messages result in several frames, concatenated. It is meant for tools that speak
+// the device side of the protocol, such as the STM32 simulator.
+func EncodeFrame(version, messageType, command uint8, messageId uint16, data string) (string, error) {
+	frames, err := encodeFrames(&CharlesMessage{
+		version:     version,
+		messageType: messageType,
+		command:     command,
+		messageId:   messageId,
+		dataLen:     uint16(len(data) + 1),
+		data:        data,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(frames, ""), nil
+}
+
+func (m *CharlesMessage) Version() uint8 {
+	return m.version
+}
+
+func (m *CharlesMessage) MessageId() uint16 {
+	return m.messageId
+}
+
+func (m *CharlesMessage) Type() uint8 {
+	return m.messageType
+}
+
+func (m *CharlesMessage) Command() uint8 {
+	return m.command
+}
+
+func (m *CharlesMessage) Data() string {
+	return m.data
+}
+
 func TypeToString(value uint8) string {
 	switch value {
 	case MSG_TYPE_ERROR:
@@ -63,6 +209,8 @@ func TypeToString(value uint8) string {
 		return "RESPONSE"
 	case MSG_TYPE_TIMEOUT:
 		return "TIMEOUT"
+	case MSG_TYPE_CANCELED:
+		return "CANCELED"
 	case MSG_TYPE_GET:
 		return "GET"
 	case MSG_TYPE_SET:
@@ -73,68 +221,8 @@ func TypeToString(value uint8) string {
 }
 
 func CommandToString(value uint8) string {
-	switch value {
-	case MSG_CMD_GET_WATCHDOG:
-		return "WATCHDOG"
-	case MSG_CMD_POE_RESET:
-		return "POE_RESET"
-	case MSG_CMD_SIM_TYPE:
-		return "SIM_TYPE"
-	case MSG_CMD_SIM_ICCID:
-		return "SIM_ICCID"
-	case MSG_CMD_SIM_CARRIER:
-		return "SIM_CARRIER"
-	case MSG_CMD_MODEM_SIGNAL:
-		return "MODEM_SIGNAL"
-	case MSG_CMD_MODEM_RESET:
-		return "MODEM_RESET"
-	case MSG_CMD_SERIAL_NUMBER:
-		return "SERIAL_NUMBER"
-	case MSG_CMD_BATCH_NUMBER:
-		return "BATCH_NUMBER"
-	case MSG_CMD_ANATEL_NUMBER:
-		return "ANATEL_NUMBER"
-	case MSG_CMD_OS_VERSION:
-		return "OS_VERSION"
-	case MSG_CMD_FIRMWARE_VERSION:
-		return "FIRMWARE_VERSION"
-	case MSG_CMD_BUZZER_ENABLE:
-		return "BUZZER_ENABLE"
-	case MSG_CMD_BUZZER_DISABLE:
-		return "BUZZER_DISABLE"
-	case MSG_CMD_IS_UPGRADING:
-		return "IS_UPGRADING"
-	case MSG_CMD_PCB_REV:
-		return "PCB_REV"
-	case MSG_CMD_TEST_START:
-		return "TEST_START"
-	case MSG_CMD_TEST_MODEM_RESULT:
-		return "TEST_MODEM_RESULT"
-	case MSG_CMD_TEST_SWITCH_RESULT:
-		return "TEST_SWITCH_RESULT"
-	case MSG_CMD_TEST_ETHERNET_RESULT:
-		return "TEST_ETHERNET_RESULT"
-	case MSG_CMD_HAS_BMS:
-		return "HAS_BMS"
-	case MSG_CMD_POWER_SOURCE:
-		return "POWER_SOURCE"
-	case MSG_CMD_SOCKETXP_STATUS:
-		return "SOCKETXP_STATUS"
-	case MSG_CMD_TAMPER_EVENT:
-		return "TAMPER_EVENT"
-	case MSG_CMD_BATTERY_LEVEL:
-		return "BATTERY_LEVEL"
-	case MSG_CMD_STM32_TEMPERATURE:
-		return "STM32_TEMPERATURE"
-	case MSG_CMD_TEST_EEPROM_RESULT:
-		return "TEST_EEPROM_RESULT"
-	case MSG_CMD_TEST_DISPLAY_RESULT:
-		return "TEST_DISPLAY_RESULT"
-	case MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION:
-		return "MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION"
-	case MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION:
-		return "MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION"
-	default:
-		return "undefined"
+	if spec, ok := commandsById[value]; ok {
+		return spec.Name
 	}
+	return "undefined"
 }
@@ -0,0 +1,3 @@
+module charlesreplay
+
+go 1.21.1
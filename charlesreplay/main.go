@@ -0,0 +1,105 @@
+// charlesreplay feeds a capture of the STM32 traffic, written with [SERIAL] CAPTURE_FILE, back into a
+// CharlesCommunicatorHandler connected to an in-memory transport, so the handling of the field
+// traffic can be reproduced and debugged without the board.
+package main
+
+import (
+	"charles_communicator"
+	"flag"
+	"fmt"
+	"gablogger"
+	"initializer"
+	"os"
+)
+
+var Logger = gablogger.Logger()
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] capture.jsonl\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	speed := flag.Float64("speed", 0, "Keep the captured intervals divided by this factor, 0 replays as fast as possible")
+	outputFilePath := flag.String("output", "", "Capture the replayed session in this file")
+	answer := flag.Bool("answer", true, "Answer the STM32 requests with the replies found in the capture")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		Logger.Fatalln("Cannot open capture.", err)
+	}
+	records, err := charles_communicator.ReadCapture(file)
+	file.Close()
+	if err != nil {
+		Logger.Fatalln("Cannot read capture.", err)
+	}
+
+	initializer.LoadConfig("")
+	handler := charles_communicator.NewCharlesCommunicatorHandler(charles_communicator.NewReplayTransport())
+	handler.SetPacingInterval(0)
+	// Each record keeps the protocol version it was captured with
+	handler.SetMaxProtocolVersion(charles_communicator.PROTOCOL_VERSION_ASCII)
+	if *outputFilePath != "" {
+		capture, err := charles_communicator.NewCapture(*outputFilePath, 0, 0)
+		if err != nil {
+			Logger.Fatalln("Cannot create output capture.", err)
+		}
+		defer capture.Close()
+		handler.SetCapture(capture)
+	}
+	if *answer {
+		registerCapturedReplies(handler, records)
+	}
+
+	handler.OpenPort()
+	go handler.Start()
+	Logger.Infof("Replaying %d records from %s", len(records), flag.Arg(0))
+	if err := handler.Replay(records, *speed); err != nil {
+		Logger.Fatalln("Cannot replay capture.", err)
+	}
+	handler.Stop()
+	Logger.Infoln("Replay finished")
+}
+
+// registerCapturedReplies answers each GET and SET received from the STM32 with the reply sent
+// to it in the capture, matched by message id.
+func registerCapturedReplies(handler *charles_communicator.CharlesCommunicatorHandler, records []charles_communicator.CaptureRecord) {
+	type requestKey struct {
+		messageType uint8
+		command     uint8
+	}
+	replies := make(map[uint16][]charles_communicator.CaptureRecord)
+	requests := make(map[requestKey]bool)
+	for _, record := range records {
+		isRequest := record.Type == charles_communicator.MSG_TYPE_GET || record.Type == charles_communicator.MSG_TYPE_SET
+		if record.Direction == charles_communicator.CAPTURE_INBOUND && isRequest {
+			requests[requestKey{record.Type, record.Command}] = true
+		} else if record.Direction == charles_communicator.CAPTURE_OUTBOUND && !isRequest {
+			replies[record.MessageId] = append(replies[record.MessageId], record)
+		}
+	}
+
+	answer := func(messageType, command uint8, message string, messageToken, externalData interface{}) {
+		token := messageToken.(*charles_communicator.CharlesMessage)
+		pending := replies[token.MessageId()]
+		if len(pending) == 0 {
+			Logger.Warnf("No reply captured for %s %s id=%d", charles_communicator.TypeToString(messageType),
+				charles_communicator.CommandToString(command), token.MessageId())
+			return
+		}
+		reply := pending[0]
+		replies[token.MessageId()] = pending[1:]
+		if reply.Type == charles_communicator.MSG_TYPE_ERROR {
+			handler.SendErrorMessage(token, string(reply.Data))
+		} else {
+			handler.SendRespMessage(token, string(reply.Data))
+		}
+	}
+	for key := range requests {
+		handler.RegisterFunctionToRcvMsg(key.messageType, key.command, answer, nil)
+	}
+}
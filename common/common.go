@@ -6,18 +6,22 @@ import (
 )
 
 var (
-	VERSION         string
-	ENVIRONMENT     string
-	MAGIC_KEY       string
-	MQTT_BROKER     string
-	MQTT_PORT       string
-	SFTP_SERVER     string
-	SFTP_PORT       string
-	SFTP_USER       string
-	SFTP_PASS       string
-	DATADOG_HOST    string
-	DATADOG_API_KEY string
-	API_PORT        string
+	VERSION           string
+	ENVIRONMENT       string
+	MAGIC_KEY         string
+	MQTT_BROKER       string
+	MQTT_PORT         string
+	SFTP_SERVER       string
+	SFTP_PORT         string
+	SFTP_USER         string
+	SFTP_PASS         string
+	ARTIFACT_SOURCE   string
+	ARTIFACT_URL      string
+	ARTIFACT_TOKEN    string
+	UPDATE_PUBLIC_KEY string
+	DATADOG_HOST      string
+	DATADOG_API_KEY   string
+	API_PORT          string
 )
 
 func init() {
@@ -30,6 +34,10 @@ func init() {
 	initializeVar(&SFTP_PORT, "SFTP_PORT")
 	initializeVar(&SFTP_USER, "SFTP_USER")
 	initializeVar(&SFTP_PASS, "SFTP_PASS")
+	initializeVar(&ARTIFACT_SOURCE, "ARTIFACT_SOURCE")
+	initializeVar(&ARTIFACT_URL, "ARTIFACT_URL")
+	initializeVar(&ARTIFACT_TOKEN, "ARTIFACT_TOKEN")
+	initializeVar(&UPDATE_PUBLIC_KEY, "UPDATE_PUBLIC_KEY")
 	initializeVar(&DATADOG_HOST, "DATADOG_HOST")
 	initializeVar(&DATADOG_API_KEY, "DATADOG_API_KEY")
 	initializeVar(&API_PORT, "API_PORT")
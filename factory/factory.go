@@ -0,0 +1,236 @@
+// Package factory runs the factory test of the board: it starts the test sequence of the STM32,
+// runs the Linux-side checks, reports each result to the STM32 and produces a signed report.
+package factory
+
+import (
+	"bytes"
+	"charles_communicator"
+	"common"
+	"context"
+	"device_info"
+	"errors"
+	"event_control"
+	"fmt"
+	"gablogger"
+	"initializer"
+	"network_info"
+	"os"
+	"path/filepath"
+	"peripherals"
+	"sync"
+	"time"
+)
+
+var Logger = gablogger.Logger()
+
+const (
+	CHECK_ETHERNET = "ethernet"
+	CHECK_MODEM    = "modem"
+	CHECK_EEPROM   = "eeprom"
+)
+
+var ErrTestRunning = errors.New("factory test already running")
+
+// eepromTestPattern is written to the EEPROM and read back, then the original bytes are restored
+var eepromTestPattern = []byte{0xA5, 0x5A, 0xC3, 0x3C}
+
+// CheckResult is the outcome of a Linux-side check. Reported tells whether the result was
+// acknowledged by the STM32.
+type CheckResult struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Reported   bool   `json:"reported"`
+}
+
+type check struct {
+	name string
+	// command reports the result to the STM32
+	command uint8
+	run     func(ctx context.Context) (string, error)
+}
+
+var checks = []check{
+	{name: CHECK_ETHERNET, command: charles_communicator.MSG_CMD_TEST_ETHERNET_RESULT, run: checkEthernet},
+	{name: CHECK_MODEM, command: charles_communicator.MSG_CMD_TEST_MODEM_RESULT, run: checkModem},
+	{name: CHECK_EEPROM, command: charles_communicator.MSG_CMD_TEST_EEPROM_RESULT, run: checkEeprom},
+}
+
+var runMutex sync.Mutex
+var running bool
+var lastReport *Report
+
+var reportEventId int
+
+// GetReportEventId is the event fired with the signed JSON report at the end of each factory test.
+func GetReportEventId() int {
+	if reportEventId == 0 {
+		reportEventId = event_control.CreateEventId()
+	}
+	return reportEventId
+}
+
+// Run starts the STM32 test sequence, runs the Linux-side checks, reports each result to the
+// STM32 and saves the signed report in the configured directory. The report is returned even
+// when it cannot be signed or saved, along with the error.
+func Run(ctx context.Context) (*Report, error) {
+	runMutex.Lock()
+	if running {
+		runMutex.Unlock()
+		return nil, ErrTestRunning
+	}
+	running = true
+	runMutex.Unlock()
+	defer func() {
+		runMutex.Lock()
+		running = false
+		runMutex.Unlock()
+	}()
+
+	Logger.Infoln("Starting factory test")
+	if err := peripherals.StartTestSequence(ctx); err != nil {
+		return nil, fmt.Errorf("cannot start the STM32 test sequence: %w", err)
+	}
+
+	report := &Report{StartedAt: time.Now().UTC(), CharlesGoVersion: common.VERSION, Passed: true}
+	report.DeviceId, _ = device_info.GetDeviceId()
+	report.FirmwareVersion, _ = peripherals.GetFirmwareVersionContext(ctx)
+	for _, c := range checks {
+		result := runCheck(ctx, c)
+		if err := peripherals.SendTestResult(ctx, c.command, result.Passed); err != nil {
+			Logger.Errorf("Cannot report the %s factory test result to the STM32: %v", c.name, err)
+		} else {
+			result.Reported = true
+		}
+		report.Passed = report.Passed && result.Passed && result.Reported
+		report.Checks = append(report.Checks, result)
+	}
+	report.FinishedAt = time.Now().UTC()
+	Logger.Infof("Factory test finished, passed: %t", report.Passed)
+
+	err := finishReport(report)
+	runMutex.Lock()
+	lastReport = report
+	runMutex.Unlock()
+	return report, err
+}
+
+// LastReport returns the report of the last factory test, nil if none ran since startup.
+func LastReport() *Report {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	return lastReport
+}
+
+// finishReport signs and saves the report and publishes it through the report event.
+func finishReport(report *Report) error {
+	if err := report.Sign(initializer.GetFactoryTestSigningKey()); err != nil {
+		Logger.Errorf("Cannot sign the factory test report: %v", err)
+		return err
+	}
+	data, err := report.MarshalIndent()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(initializer.GetFactoryTestReportDir(), fmt.Sprintf("report-%s.json", report.StartedAt.Format("20060102T150405Z")))
+	if err := saveReport(path, data); err != nil {
+		Logger.Errorf("Cannot save the factory test report: %v", err)
+		return err
+	}
+	Logger.Infoln("Factory test report saved to", path)
+	event_control.CallRegisteredEventFunctions(GetReportEventId(), 0, 0, string(data))
+	return nil
+}
+
+func saveReport(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func runCheck(ctx context.Context, c check) CheckResult {
+	start := time.Now()
+	detail, err := c.run(ctx)
+	result := CheckResult{Name: c.name, Passed: err == nil, Detail: detail, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Detail = err.Error()
+		Logger.Warnf("Factory test %s failed: %v", c.name, err)
+	}
+	return result
+}
+
+func checkEthernet(ctx context.Context) (string, error) {
+	name := initializer.GetFactoryTestEthernetInterface()
+	hasCarrier, err := network_info.HasCarrier(name)
+	if err != nil {
+		return "", err
+	}
+	if !hasCarrier {
+		return "", fmt.Errorf("no link on %s", name)
+	}
+	return "link up on " + name, nil
+}
+
+func checkModem(ctx context.Context) (string, error) {
+	return findDevices(initializer.GetFactoryTestModemDevices())
+}
+
+// findDevices succeeds when a device node matches one of the glob patterns.
+func findDevices(patterns []string) (string, error) {
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		if len(matches) > 0 {
+			return "found " + matches[0], nil
+		}
+	}
+	return "", fmt.Errorf("no device matches %v", patterns)
+}
+
+// checkEeprom lifts the EEPROM write protection through the STM32 for the read/write test and
+// restores it afterwards.
+func checkEeprom(ctx context.Context) (string, error) {
+	if err := peripherals.DisableEepromWriteProtection(ctx); err != nil {
+		return "", fmt.Errorf("cannot disable the write protection: %w", err)
+	}
+	defer func() {
+		if err := peripherals.EnableEepromWriteProtection(context.Background()); err != nil {
+			Logger.Errorf("Cannot enable the EEPROM write protection: %v", err)
+		}
+	}()
+	return testEepromReadWrite(initializer.GetFactoryTestEepromPath(), int64(initializer.GetFactoryTestEepromTestOffset()))
+}
+
+// testEepromReadWrite writes the test pattern at offset, reads it back and restores the
+// original bytes.
+func testEepromReadWrite(path string, offset int64) (string, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	original := make([]byte, len(eepromTestPattern))
+	if _, err := file.ReadAt(original, offset); err != nil {
+		return "", fmt.Errorf("cannot read: %w", err)
+	}
+	if _, err := file.WriteAt(eepromTestPattern, offset); err != nil {
+		return "", fmt.Errorf("cannot write: %w", err)
+	}
+	readBack := make([]byte, len(eepromTestPattern))
+	_, readErr := file.ReadAt(readBack, offset)
+	if _, err := file.WriteAt(original, offset); err != nil {
+		return "", fmt.Errorf("cannot restore the original bytes: %w", err)
+	}
+	if readErr != nil {
+		return "", fmt.Errorf("cannot read back: %w", readErr)
+	}
+	if !bytes.Equal(readBack, eepromTestPattern) {
+		return "", fmt.Errorf("read back %X instead of %X", readBack, eepromTestPattern)
+	}
+	return fmt.Sprintf("%d bytes written and read back at offset %d", len(eepromTestPattern), offset), nil
+}
@@ -0,0 +1,77 @@
+package factory
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSigningKey(t *testing.T) (string, ed25519.PublicKey) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Cannot encode key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	return path, publicKey
+}
+
+func TestSignedReportVerifies(t *testing.T) {
+	keyPath, publicKey := writeSigningKey(t)
+	report := &Report{
+		DeviceId:   "00:11:22:33:44:55",
+		StartedAt:  time.Now().UTC(),
+		FinishedAt: time.Now().UTC(),
+		Passed:     true,
+		Checks:     []CheckResult{{Name: CHECK_EEPROM, Passed: true, Reported: true}},
+	}
+	if err := report.Sign(keyPath); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	data, _ := report.MarshalIndent()
+
+	verified, err := VerifyReport(data, publicKey)
+	if err != nil || verified.DeviceId != report.DeviceId || !verified.Passed {
+		t.Fatalf("Expected the report to verify, got: %+v %v", verified, err)
+	}
+
+	tampered := bytes.Replace(data, []byte(`"passed": true`), []byte(`"passed": false`), 1)
+	if _, err := VerifyReport(tampered, publicKey); err == nil {
+		t.Errorf("Expected a tampered report to be rejected")
+	}
+}
+
+func TestEepromReadWriteRestoresBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eeprom")
+	content := bytes.Repeat([]byte{0x11}, 32)
+	os.WriteFile(path, content, 0o600)
+
+	if _, err := testEepromReadWrite(path, 8); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, content) {
+		t.Errorf("Expected the original bytes restored, got: %X", after)
+	}
+	if _, err := testEepromReadWrite(path, 30); err == nil {
+		t.Errorf("Expected an error past the end of the EEPROM")
+	}
+}
+
+func TestFindDevices(t *testing.T) {
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "cdc-wdm0"), nil, 0o600)
+
+	if _, err := findDevices([]string{filepath.Join(directory, "ttyUSB*"), filepath.Join(directory, "cdc-wdm*")}); err != nil {
+		t.Errorf("Expected the modem to be found, got: %v", err)
+	}
+	if _, err := findDevices([]string{filepath.Join(directory, "ttyUSB*")}); err == nil {
+		t.Errorf("Expected no modem found")
+	}
+}
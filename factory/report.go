@@ -0,0 +1,90 @@
+package factory
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Report is the result of a factory test. Signature is the base64 Ed25519 signature of the JSON
+// encoding of the report without its signature.
+type Report struct {
+	DeviceId         string        `json:"device_id"`
+	CharlesGoVersion string        `json:"charlesgo_version"`
+	FirmwareVersion  string        `json:"firmware_version"`
+	StartedAt        time.Time     `json:"started_at"`
+	FinishedAt       time.Time     `json:"finished_at"`
+	Passed           bool          `json:"passed"`
+	Checks           []CheckResult `json:"checks"`
+	Signature        string        `json:"signature,omitempty"`
+}
+
+func (r *Report) signedPayload() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign signs the report with the Ed25519 private key of a PKCS #8 PEM file.
+func (r *Report) Sign(keyPath string) error {
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		return err
+	}
+	payload, err := r.signedPayload()
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+func (r *Report) MarshalIndent() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// VerifyReport decodes a JSON report and checks its signature with the public key.
+func VerifyReport(data []byte, publicKey ed25519.PublicKey) (*Report, error) {
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(report.Signature)
+	if err != nil || report.Signature == "" {
+		return nil, errors.New("report not signed")
+	}
+	payload, err := report.signedPayload()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return nil, errors.New("invalid report signature")
+	}
+	return &report, nil
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return privateKey, nil
+}
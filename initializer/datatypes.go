@@ -1,10 +1,18 @@
 package initializer
 
+import "time"
+
 type config struct {
 	deviceConfig deviceConfig
 	supervisor   supervisorConfig
 	mqtt         mqttConfig
 	updater      updaterConfig
+	serial       serialConfig
+	watchdog     watchdogConfig
+	factoryTest  factoryTestConfig
+	provisioning provisioningConfig
+	rpc          rpcConfig
+	powerCycle   powerCycleConfig
 }
 
 type supervisorConfig struct {
@@ -19,7 +27,64 @@ type mqttConfig struct {
 	IsEnabled bool
 }
 
+type rpcConfig struct {
+	IsEnabled bool
+}
+
 type updaterConfig struct {
-	IsEnabledStm32   bool
-	IsEnabledHlk7628 bool
+	IsEnabledStm32       bool
+	IsEnabledHlk7628     bool
+	HTTPSCAFile          string
+	HTTPSClientCert      string
+	HTTPSClientKey       string
+	MaxDownloadKBps      int
+	SFTPHostFingerprints []string
+	SFTPKnownHosts       string
+	SFTPClientKey        string
+	SFTPInsecureHostKey  bool
+	PinnedHlk7628Version string
+	PinnedStm32Version   string
+}
+
+type serialConfig struct {
+	Device                string
+	Baud                  int
+	ProbeDevices          []string
+	ReconnectInitialDelay time.Duration
+	ReconnectMaxDelay     time.Duration
+	PacingInterval        time.Duration
+	MaxProtocolVersion    int
+	CaptureFile           string
+	CaptureMaxSizeKB      int
+	CaptureMaxFiles       int
+}
+
+type watchdogConfig struct {
+	IsEnabled         bool
+	Timeout           time.Duration
+	Actions           []string
+	ResetScript       string
+	KnownGoodFirmware string
+}
+
+type factoryTestConfig struct {
+	EthernetInterface string
+	ModemDevices      []string
+	EepromPath        string
+	EepromTestOffset  int
+	ReportDir         string
+	SigningKey        string
+}
+
+type provisioningConfig struct {
+	BatchNumber  string
+	AnatelNumber string
+	PCBRevision  string
+}
+
+type powerCycleConfig struct {
+	MinInterval   time.Duration
+	VerifyTimeout time.Duration
+	PoEInterface  string
+	AuditLog      string
 }
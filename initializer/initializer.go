@@ -3,10 +3,40 @@ package initializer
 import (
 	"fmt"
 	"gablogger"
+	"strings"
+	"time"
 
 	goIni "gopkg.in/ini.v1"
 )
 
+const (
+	DEFAULT_SERIAL_DEVICE                     = "/dev/ttyS1"
+	DEFAULT_SERIAL_BAUD                       = 115200
+	DEFAULT_SERIAL_RECONNECT_INITIAL_DELAY_MS = 500
+	DEFAULT_SERIAL_RECONNECT_MAX_DELAY_MS     = 30000
+	DEFAULT_SERIAL_PACING_INTERVAL_MS         = 100
+	DEFAULT_SERIAL_MAX_PROTOCOL_VERSION       = 1
+	DEFAULT_SERIAL_CAPTURE_MAX_SIZE_KB        = 1024
+	DEFAULT_SERIAL_CAPTURE_MAX_FILES          = 3
+
+	DEFAULT_WATCHDOG_TIMEOUT_S           = 30
+	DEFAULT_WATCHDOG_ACTIONS             = "reopen,alarm"
+	DEFAULT_WATCHDOG_RESET_SCRIPT        = "/opt/gabriel/bin/reset_stm32.sh"
+	DEFAULT_WATCHDOG_KNOWN_GOOD_FIRMWARE = "/opt/gabriel/share/stm32_known_good.bin"
+
+	DEFAULT_FACTORY_TEST_ETHERNET_INTERFACE = "eth0"
+	DEFAULT_FACTORY_TEST_MODEM_DEVICES      = "/dev/cdc-wdm*,/dev/ttyUSB*"
+	DEFAULT_FACTORY_TEST_EEPROM_PATH        = "/sys/bus/i2c/devices/0-0050/eeprom"
+	DEFAULT_FACTORY_TEST_EEPROM_TEST_OFFSET = 496
+	DEFAULT_FACTORY_TEST_REPORT_DIR         = "/opt/gabriel/factory_test"
+	DEFAULT_FACTORY_TEST_SIGNING_KEY        = "/etc/gabriel/factory_test_key.pem"
+
+	DEFAULT_POWER_CYCLE_MIN_INTERVAL_S   = 300
+	DEFAULT_POWER_CYCLE_VERIFY_TIMEOUT_S = 120
+	DEFAULT_POWER_CYCLE_POE_INTERFACE    = "eth0"
+	DEFAULT_POWER_CYCLE_AUDIT_LOG        = "/opt/gabriel/log/power_cycle.log"
+)
+
 var ini config
 var Logger = gablogger.Logger()
 
@@ -21,6 +51,12 @@ func LoadConfig(filePath string) {
 		loadDeviceConfig(cfg)
 		loadMqttConfig(cfg)
 		loadUpdaterConfig(cfg)
+		loadSerialConfig(cfg)
+		loadWatchdogConfig(cfg)
+		loadFactoryTestConfig(cfg)
+		loadProvisioningConfig(cfg)
+		loadRPCConfig(cfg)
+		loadPowerCycleConfig(cfg)
 	} else {
 		initializeDefaultConfig()
 	}
@@ -29,9 +65,36 @@ func LoadConfig(filePath string) {
 func initializeDefaultConfig() {
 	ini.supervisor.IsEnabled = true
 	ini.mqtt.IsEnabled = true
+	ini.rpc.IsEnabled = true
 	ini.deviceConfig.Label = ""
 	ini.updater.IsEnabledHlk7628 = true
 	ini.updater.IsEnabledStm32 = true
+	ini.serial.Device = DEFAULT_SERIAL_DEVICE
+	ini.serial.Baud = DEFAULT_SERIAL_BAUD
+	ini.serial.ProbeDevices = nil
+	ini.serial.ReconnectInitialDelay = DEFAULT_SERIAL_RECONNECT_INITIAL_DELAY_MS * time.Millisecond
+	ini.serial.ReconnectMaxDelay = DEFAULT_SERIAL_RECONNECT_MAX_DELAY_MS * time.Millisecond
+	ini.serial.PacingInterval = DEFAULT_SERIAL_PACING_INTERVAL_MS * time.Millisecond
+	ini.serial.MaxProtocolVersion = DEFAULT_SERIAL_MAX_PROTOCOL_VERSION
+	ini.serial.CaptureFile = ""
+	ini.serial.CaptureMaxSizeKB = DEFAULT_SERIAL_CAPTURE_MAX_SIZE_KB
+	ini.serial.CaptureMaxFiles = DEFAULT_SERIAL_CAPTURE_MAX_FILES
+	ini.watchdog.IsEnabled = true
+	ini.watchdog.Timeout = DEFAULT_WATCHDOG_TIMEOUT_S * time.Second
+	ini.watchdog.Actions = splitList(DEFAULT_WATCHDOG_ACTIONS)
+	ini.watchdog.ResetScript = DEFAULT_WATCHDOG_RESET_SCRIPT
+	ini.watchdog.KnownGoodFirmware = DEFAULT_WATCHDOG_KNOWN_GOOD_FIRMWARE
+	ini.factoryTest.EthernetInterface = DEFAULT_FACTORY_TEST_ETHERNET_INTERFACE
+	ini.factoryTest.ModemDevices = splitList(DEFAULT_FACTORY_TEST_MODEM_DEVICES)
+	ini.factoryTest.EepromPath = DEFAULT_FACTORY_TEST_EEPROM_PATH
+	ini.factoryTest.EepromTestOffset = DEFAULT_FACTORY_TEST_EEPROM_TEST_OFFSET
+	ini.factoryTest.ReportDir = DEFAULT_FACTORY_TEST_REPORT_DIR
+	ini.factoryTest.SigningKey = DEFAULT_FACTORY_TEST_SIGNING_KEY
+	ini.provisioning = provisioningConfig{}
+	ini.powerCycle.MinInterval = DEFAULT_POWER_CYCLE_MIN_INTERVAL_S * time.Second
+	ini.powerCycle.VerifyTimeout = DEFAULT_POWER_CYCLE_VERIFY_TIMEOUT_S * time.Second
+	ini.powerCycle.PoEInterface = DEFAULT_POWER_CYCLE_POE_INTERFACE
+	ini.powerCycle.AuditLog = DEFAULT_POWER_CYCLE_AUDIT_LOG
 }
 
 func loadDeviceConfig(cfg *goIni.File) {
@@ -49,6 +112,26 @@ func loadUpdaterConfig(cfg *goIni.File) {
 	if err != nil {
 		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
 	}
+
+	ini.updater.MaxDownloadKBps, err = getIntValue(cfg, "UPDATE", "MAX_DOWNLOAD_KBPS", 0)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+
+	ini.updater.SFTPInsecureHostKey, err = getBoolValue(cfg, "UPDATE", "SFTP_INSECURE_HOST_KEY", false)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+
+	section := cfg.Section("UPDATE")
+	ini.updater.HTTPSCAFile = section.Key("HTTPS_CA_FILE").String()
+	ini.updater.HTTPSClientCert = section.Key("HTTPS_CLIENT_CERT").String()
+	ini.updater.HTTPSClientKey = section.Key("HTTPS_CLIENT_KEY").String()
+	ini.updater.SFTPHostFingerprints = splitList(section.Key("SFTP_HOST_FINGERPRINTS").String())
+	ini.updater.SFTPKnownHosts = section.Key("SFTP_KNOWN_HOSTS").String()
+	ini.updater.SFTPClientKey = section.Key("SFTP_CLIENT_KEY").String()
+	ini.updater.PinnedHlk7628Version = section.Key("PINNED_HLK7628_VERSION").String()
+	ini.updater.PinnedStm32Version = section.Key("PINNED_STM32_VERSION").String()
 }
 
 func loadMqttConfig(cfg *goIni.File) {
@@ -59,6 +142,32 @@ func loadMqttConfig(cfg *goIni.File) {
 	}
 }
 
+func loadRPCConfig(cfg *goIni.File) {
+	var err error
+	ini.rpc.IsEnabled, err = getBoolValue(cfg, "RPC", "ENABLE", true)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+}
+
+func loadPowerCycleConfig(cfg *goIni.File) {
+	minInterval, err := getIntValue(cfg, "POWER_CYCLE", "MIN_INTERVAL_S", DEFAULT_POWER_CYCLE_MIN_INTERVAL_S)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.powerCycle.MinInterval = time.Duration(minInterval) * time.Second
+
+	verifyTimeout, err := getIntValue(cfg, "POWER_CYCLE", "VERIFY_TIMEOUT_S", DEFAULT_POWER_CYCLE_VERIFY_TIMEOUT_S)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.powerCycle.VerifyTimeout = time.Duration(verifyTimeout) * time.Second
+
+	section := cfg.Section("POWER_CYCLE")
+	ini.powerCycle.PoEInterface = section.Key("POE_INTERFACE").MustString(DEFAULT_POWER_CYCLE_POE_INTERFACE)
+	ini.powerCycle.AuditLog = section.Key("AUDIT_LOG").MustString(DEFAULT_POWER_CYCLE_AUDIT_LOG)
+}
+
 func loadSupervisorConfig(cfg *goIni.File) {
 	var err error
 	ini.supervisor.IsEnabled, err = getBoolValue(cfg, "SUPERVISOR", "ENABLE", true)
@@ -67,6 +176,102 @@ func loadSupervisorConfig(cfg *goIni.File) {
 	}
 }
 
+func loadSerialConfig(cfg *goIni.File) {
+	section := cfg.Section("SERIAL")
+	ini.serial.Device = section.Key("DEVICE").MustString(DEFAULT_SERIAL_DEVICE)
+	ini.serial.ProbeDevices = splitList(section.Key("PROBE_DEVICES").String())
+
+	var err error
+	ini.serial.Baud, err = getIntValue(cfg, "SERIAL", "BAUD", DEFAULT_SERIAL_BAUD)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+
+	initialDelay, err := getIntValue(cfg, "SERIAL", "RECONNECT_INITIAL_DELAY_MS", DEFAULT_SERIAL_RECONNECT_INITIAL_DELAY_MS)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.serial.ReconnectInitialDelay = time.Duration(initialDelay) * time.Millisecond
+	maxDelay, err := getIntValue(cfg, "SERIAL", "RECONNECT_MAX_DELAY_MS", DEFAULT_SERIAL_RECONNECT_MAX_DELAY_MS)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.serial.ReconnectMaxDelay = time.Duration(maxDelay) * time.Millisecond
+
+	pacingInterval, err := getIntValue(cfg, "SERIAL", "PACING_INTERVAL_MS", DEFAULT_SERIAL_PACING_INTERVAL_MS)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.serial.PacingInterval = time.Duration(pacingInterval) * time.Millisecond
+
+	ini.serial.MaxProtocolVersion, err = getIntValue(cfg, "SERIAL", "MAX_PROTOCOL_VERSION", DEFAULT_SERIAL_MAX_PROTOCOL_VERSION)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+
+	ini.serial.CaptureFile = cfg.Section("SERIAL").Key("CAPTURE_FILE").String()
+	ini.serial.CaptureMaxSizeKB, err = getIntValue(cfg, "SERIAL", "CAPTURE_MAX_SIZE_KB", DEFAULT_SERIAL_CAPTURE_MAX_SIZE_KB)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.serial.CaptureMaxFiles, err = getIntValue(cfg, "SERIAL", "CAPTURE_MAX_FILES", DEFAULT_SERIAL_CAPTURE_MAX_FILES)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+}
+
+func loadWatchdogConfig(cfg *goIni.File) {
+	var err error
+	ini.watchdog.IsEnabled, err = getBoolValue(cfg, "WATCHDOG", "ENABLE", true)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+
+	timeout, err := getIntValue(cfg, "WATCHDOG", "TIMEOUT_S", DEFAULT_WATCHDOG_TIMEOUT_S)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+	ini.watchdog.Timeout = time.Duration(timeout) * time.Second
+
+	section := cfg.Section("WATCHDOG")
+	ini.watchdog.Actions = splitList(section.Key("ACTIONS").MustString(DEFAULT_WATCHDOG_ACTIONS))
+	ini.watchdog.ResetScript = section.Key("RESET_SCRIPT").MustString(DEFAULT_WATCHDOG_RESET_SCRIPT)
+	ini.watchdog.KnownGoodFirmware = section.Key("KNOWN_GOOD_FIRMWARE").MustString(DEFAULT_WATCHDOG_KNOWN_GOOD_FIRMWARE)
+}
+
+func loadFactoryTestConfig(cfg *goIni.File) {
+	section := cfg.Section("FACTORY_TEST")
+	ini.factoryTest.EthernetInterface = section.Key("ETHERNET_INTERFACE").MustString(DEFAULT_FACTORY_TEST_ETHERNET_INTERFACE)
+	ini.factoryTest.ModemDevices = splitList(section.Key("MODEM_DEVICES").MustString(DEFAULT_FACTORY_TEST_MODEM_DEVICES))
+	ini.factoryTest.EepromPath = section.Key("EEPROM_PATH").MustString(DEFAULT_FACTORY_TEST_EEPROM_PATH)
+	ini.factoryTest.ReportDir = section.Key("REPORT_DIR").MustString(DEFAULT_FACTORY_TEST_REPORT_DIR)
+	ini.factoryTest.SigningKey = section.Key("SIGNING_KEY").MustString(DEFAULT_FACTORY_TEST_SIGNING_KEY)
+
+	var err error
+	ini.factoryTest.EepromTestOffset, err = getIntValue(cfg, "FACTORY_TEST", "EEPROM_TEST_OFFSET", DEFAULT_FACTORY_TEST_EEPROM_TEST_OFFSET)
+	if err != nil {
+		Logger.WithField("invalid-value", "config-file").Errorln(err, "Using default value.")
+	}
+}
+
+func loadProvisioningConfig(cfg *goIni.File) {
+	section := cfg.Section("PROVISIONING")
+	ini.provisioning.BatchNumber = section.Key("BATCH_NUMBER").String()
+	ini.provisioning.AnatelNumber = section.Key("ANATEL_NUMBER").String()
+	ini.provisioning.PCBRevision = section.Key("PCB_REVISION").String()
+}
+
+// splitList splits a comma separated value, ignoring the blank items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getBoolValue(cfg *goIni.File, section, key string, defaultValue bool) (bool, error) {
 	rawEnableField := cfg.Section(section).Key(key)
 	if rawEnableField != nil {
@@ -80,6 +285,19 @@ func getBoolValue(cfg *goIni.File, section, key string, defaultValue bool) (bool
 	return defaultValue, fmt.Errorf("Field '%s %s' not found", section, key)
 }
 
+// getIntValue returns defaultValue without error when the key is not present, since the
+// integer fields are optional.
+func getIntValue(cfg *goIni.File, section, key string, defaultValue int) (int, error) {
+	if !cfg.Section(section).HasKey(key) {
+		return defaultValue, nil
+	}
+	value, err := cfg.Section(section).Key(key).Int()
+	if err != nil {
+		return defaultValue, fmt.Errorf("Cannot decode '%s %s'. %v", section, key, err)
+	}
+	return value, nil
+}
+
 func GetLabel() string {
 	return ini.deviceConfig.Label
 }
@@ -92,6 +310,11 @@ func IsMqttEnabled() bool {
 	return ini.mqtt.IsEnabled
 }
 
+// IsRPCEnabled tells whether the STM32 operations can be run remotely through MQTT.
+func IsRPCEnabled() bool {
+	return ini.rpc.IsEnabled
+}
+
 func IsHlk7628UpdateEnabled() bool {
 	return ini.updater.IsEnabledHlk7628
 }
@@ -99,3 +322,190 @@ func IsHlk7628UpdateEnabled() bool {
 func IsStm32UpdateEnabled() bool {
 	return ini.updater.IsEnabledStm32
 }
+
+// GetUpdateHTTPSCAFile is the PEM file of the CAs trusted by the HTTPS artifact source, empty to
+// trust the system CAs.
+func GetUpdateHTTPSCAFile() string {
+	return ini.updater.HTTPSCAFile
+}
+
+// GetUpdateHTTPSClientCert is the PEM client certificate of the HTTPS artifact source, empty
+// when the server does not require mutual TLS.
+func GetUpdateHTTPSClientCert() string {
+	return ini.updater.HTTPSClientCert
+}
+
+// GetUpdateSFTPHostFingerprints are the SHA256 fingerprints of the accepted SFTP host keys, as
+// printed by ssh-keygen -l.
+func GetUpdateSFTPHostFingerprints() []string {
+	return ini.updater.SFTPHostFingerprints
+}
+
+// GetUpdateSFTPKnownHosts is a known_hosts file of the accepted SFTP host keys.
+func GetUpdateSFTPKnownHosts() string {
+	return ini.updater.SFTPKnownHosts
+}
+
+// GetUpdateSFTPClientKey is the private key the device authenticates with on the SFTP server,
+// empty to only use the password.
+func GetUpdateSFTPClientKey() string {
+	return ini.updater.SFTPClientKey
+}
+
+// GetUpdateSFTPInsecureHostKey accepts any SFTP server when no host key is pinned. Only meant
+// for development servers.
+func GetUpdateSFTPInsecureHostKey() bool {
+	return ini.updater.SFTPInsecureHostKey
+}
+
+// GetUpdatePinnedHlk7628Version is the only HLK7628 version this device installs, empty to follow
+// the releases.
+func GetUpdatePinnedHlk7628Version() string {
+	return ini.updater.PinnedHlk7628Version
+}
+
+// GetUpdatePinnedStm32Version is the only STM32 firmware version this device installs, empty to
+// follow the releases.
+func GetUpdatePinnedStm32Version() string {
+	return ini.updater.PinnedStm32Version
+}
+
+// GetUpdateMaxDownloadKBps limits the rate of the update downloads, 0 for no limit.
+func GetUpdateMaxDownloadKBps() int {
+	return ini.updater.MaxDownloadKBps
+}
+
+// GetUpdateHTTPSClientKey is the PEM private key of GetUpdateHTTPSClientCert.
+func GetUpdateHTTPSClientKey() string {
+	return ini.updater.HTTPSClientKey
+}
+
+// GetSerialDevice returns the STM32 serial device of [SERIAL] DEVICE. It is not used when the
+// --stm32-port flag gives another device or address.
+func GetSerialDevice() string {
+	return ini.serial.Device
+}
+
+func GetSerialBaud() int {
+	return ini.serial.Baud
+}
+
+// GetSerialProbeDevices returns the glob patterns of the ttys probed when no STM32 answers on
+// the serial device, empty when the probing is disabled.
+func GetSerialProbeDevices() []string {
+	return ini.serial.ProbeDevices
+}
+
+// GetSerialReconnectDelays returns the first and the longest wait between two attempts to
+// reopen the STM32 port.
+func GetSerialReconnectDelays() (time.Duration, time.Duration) {
+	return ini.serial.ReconnectInitialDelay, ini.serial.ReconnectMaxDelay
+}
+
+func GetSerialPacingInterval() time.Duration {
+	return ini.serial.PacingInterval
+}
+
+func GetSerialMaxProtocolVersion() int {
+	return ini.serial.MaxProtocolVersion
+}
+
+// GetSerialCaptureFile returns the file where the STM32 messages are captured, empty when the
+// capture is disabled.
+func GetSerialCaptureFile() string {
+	return ini.serial.CaptureFile
+}
+
+func GetSerialCaptureMaxSizeKB() int {
+	return ini.serial.CaptureMaxSizeKB
+}
+
+func GetSerialCaptureMaxFiles() int {
+	return ini.serial.CaptureMaxFiles
+}
+
+func IsWatchdogEnabled() bool {
+	return ini.watchdog.IsEnabled
+}
+
+// GetWatchdogTimeout returns the longest interval accepted between two watchdog GETs of the STM32.
+func GetWatchdogTimeout() time.Duration {
+	return ini.watchdog.Timeout
+}
+
+// GetWatchdogActions returns the names of the escalation actions, in the order they are taken.
+func GetWatchdogActions() []string {
+	return ini.watchdog.Actions
+}
+
+func GetWatchdogResetScript() string {
+	return ini.watchdog.ResetScript
+}
+
+// GetWatchdogKnownGoodFirmware returns where the last firmware flashed successfully is kept.
+func GetWatchdogKnownGoodFirmware() string {
+	return ini.watchdog.KnownGoodFirmware
+}
+
+func GetFactoryTestEthernetInterface() string {
+	return ini.factoryTest.EthernetInterface
+}
+
+// GetFactoryTestModemDevices returns the glob patterns of the device nodes created when the
+// modem is enumerated.
+func GetFactoryTestModemDevices() []string {
+	return ini.factoryTest.ModemDevices
+}
+
+func GetFactoryTestEepromPath() string {
+	return ini.factoryTest.EepromPath
+}
+
+// GetFactoryTestEepromTestOffset returns the offset of the EEPROM bytes written and restored by
+// the factory test, which must not hold provisioning data.
+func GetFactoryTestEepromTestOffset() int {
+	return ini.factoryTest.EepromTestOffset
+}
+
+func GetFactoryTestReportDir() string {
+	return ini.factoryTest.ReportDir
+}
+
+// GetFactoryTestSigningKey returns the PEM file of the Ed25519 key signing the factory test reports.
+func GetFactoryTestSigningKey() string {
+	return ini.factoryTest.SigningKey
+}
+
+// GetProvisioningBatchNumber returns the batch number written to the EEPROM at startup, empty
+// to leave it unchanged. The same applies to the Anatel number and the PCB revision.
+func GetProvisioningBatchNumber() string {
+	return ini.provisioning.BatchNumber
+}
+
+func GetProvisioningAnatelNumber() string {
+	return ini.provisioning.AnatelNumber
+}
+
+func GetProvisioningPCBRevision() string {
+	return ini.provisioning.PCBRevision
+}
+
+// GetPowerCycleMinInterval is the minimum time between two remote power-cycles of the same target.
+func GetPowerCycleMinInterval() time.Duration {
+	return ini.powerCycle.MinInterval
+}
+
+// GetPowerCycleVerifyTimeout is how long an interface has to come back after a power-cycle.
+func GetPowerCycleVerifyTimeout() time.Duration {
+	return ini.powerCycle.VerifyTimeout
+}
+
+// GetPowerCyclePoEInterface is the interface checked after a PoE power-cycle.
+func GetPowerCyclePoEInterface() string {
+	return ini.powerCycle.PoEInterface
+}
+
+// GetPowerCycleAuditLog is the file the power-cycles are appended to.
+func GetPowerCycleAuditLog() string {
+	return ini.powerCycle.AuditLog
+}
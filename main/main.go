@@ -3,13 +3,16 @@ package main
 import (
 	"api"
 	"charles_communicator"
+	"context"
 	"device_info"
+	"factory"
 	"flag"
 	"gablogger"
 	"initializer"
 	"monitor"
 	mqtt "mqtt_connector"
 	"peripherals"
+	"rpc"
 	"socketxp"
 	"sync"
 	"updater"
@@ -23,6 +26,8 @@ var Logger = gablogger.Logger()
 func main() {
 	//PARSE ARGUMENTS
 	initFilePath := flag.String("config", "", "Specify the file path for initialization")
+	factoryTest := flag.Bool("factory-test", false, "Run the factory test once the modules are started")
+	stm32Port := flag.String("stm32-port", "", "Specify the STM32 serial device or a tcp://host:port address, overriding [SERIAL] DEVICE")
 	flag.Parse()
 	initializer.LoadConfig(*initFilePath)
 	var mqtt_client_ptr *mqttPaho.Client = nil
@@ -35,7 +40,11 @@ func main() {
 	gablogger.ConfigureDatadog(deviceId)
 
 	// Initialize and get a pointer to a CharlesCommunicatorHandler instance
-	charles_communicator.InitCC()
+	if *stm32Port == "" {
+		charles_communicator.InitCC()
+	} else {
+		charles_communicator.InitCCWithTransport(charles_communicator.NewTransport(*stm32Port, initializer.GetSerialBaud()))
+	}
 	CCHandler := charles_communicator.GetCharlesCommunicatorHandler()
 	go CCHandler.Start()
 
@@ -49,11 +58,11 @@ func main() {
 	mqtt.InitMQTTClient()
 	updater.InitUpdater()
 	socketxp.InitSocketXP()
+	rpc.InitRPC()
 
-	// Send OS version and Serial Number to STM32 display
+	// Send OS version to STM32 display
 	osVersion, _ := device_info.GetOSVersion()
 	peripherals.SetOsVersion(osVersion)
-	peripherals.SetSerialNumber(deviceId)
 
 	// MQTT SETUP
 	// register topics to subscribe
@@ -61,14 +70,44 @@ func main() {
 	mqtt.RegisterSubscription(socketxp.Handler.CredentialTopic, socketxp.UpdateCredentialsCallback)
 	mqtt.RegisterSubscription(updater.Handler.Hlk7628Topic, updater.UpdaterHlk7628Callback)
 	mqtt.RegisterSubscription(updater.Handler.Stm32Topic, updater.UpdaterStm32Callback)
+	mqtt.RegisterSubscription(rpc.Handler.RequestTopic, rpc.RequestCallback)
 	// connect to broker after registering topics
 	mqtt.Connect(mqtt_client_ptr)
 
 	// OBSERVABILITY
 	monitor.Monitor(mqtt_client_ptr)
 
+	// Provision the EEPROM once the monitor publishes its alarms. It is only written when its
+	// content differs
+	err = peripherals.Provision(context.Background(), peripherals.ProvisioningData{
+		SerialNumber: deviceId,
+		BatchNumber:  initializer.GetProvisioningBatchNumber(),
+		AnatelNumber: initializer.GetProvisioningAnatelNumber(),
+		PCBRevision:  initializer.GetProvisioningPCBRevision(),
+	})
+	if err != nil {
+		Logger.Errorln("EEPROM provisioning failed:", err)
+	}
+
+	if *factoryTest {
+		go runFactoryTest()
+	}
+
 	// INFINITE LOOP NOT TO EXIT MAIN
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	wg.Wait()
 }
+
+// runFactoryTest runs the factory test requested with --factory-test. The report is published
+// by the monitor.
+func runFactoryTest() {
+	report, err := factory.Run(context.Background())
+	if err != nil {
+		Logger.Errorln("Factory test failed:", err)
+		return
+	}
+	if !report.Passed {
+		Logger.Errorln("Factory test did not pass")
+	}
+}
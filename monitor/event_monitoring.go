@@ -1,13 +1,54 @@
 package monitor
 
-import "charles_communicator"
+import (
+	"charles_communicator"
+	"peripherals"
+	"scheduler"
+)
 
 func sendTamperEvent(messageType, command uint8, message string, externalData interface{}) {
 	publishMetric(topicTamperStatus, message)
 }
 
 func sendPowerSourceEvent(messageType, command uint8, message string, externalData interface{}) {
-	publishMetric(topicPowerSource, message)
+	// An unexpected source is published as UNKNOWN, with the raw answer in data
+	source, _ := peripherals.ParsePowerSource(message)
+	publishMetricValue(topicPowerSource, message, source)
+}
+
+func sendWatchdogAlarmEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicStm32Watchdog, message)
+}
+
+func sendLinkStateEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicStm32LinkState, message)
+}
+
+// handleMaintenanceEvent pauses the STM32 telemetry while the STM32 link is in maintenance and
+// publishes the firmware version read when leaving the maintenance, which may have changed.
+func handleMaintenanceEvent(messageType, command uint8, message string, externalData interface{}) {
+	switch message {
+	case charles_communicator.MAINTENANCE_STARTED:
+		scheduler.PauseTag(stm32JobsTag)
+	case charles_communicator.MAINTENANCE_FINISHED:
+		scheduler.ResumeTag(stm32JobsTag)
+		version := charles_communicator.GetMaintenanceFirmwareVersion()
+		if firmwareVersion, ok := charles_communicator.LookupCommand(charles_communicator.MSG_CMD_FIRMWARE_VERSION); ok && version != "" {
+			publishCommandValue(firmwareVersion.TelemetryTopic, firmwareVersion.Id, version)
+		}
+	}
+}
+
+func sendFactoryTestReport(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicFactoryTestReport, message)
+}
+
+func sendEepromAlarmEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicEepromProtection, message)
+}
+
+func sendPowerCycleEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicPowerCycle, message)
 }
 
 func sendBuzzerEvent(messageType, command uint8, message string, externalData interface{}) {
@@ -39,3 +80,15 @@ func sendUpdateSTM32Event(messageType, command uint8, message string, externalDa
 func sendUpdateHLK7628Event(messageType, command uint8, message string, externalData interface{}) {
 	publishMetric(topicUpdateHLK7628, message)
 }
+
+func sendUpdateDownloadEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicUpdateDownload, message)
+}
+
+func sendUpdateRejectedEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicUpdateRejected, message)
+}
+
+func sendHostKeyMismatchEvent(messageType, command uint8, message string, externalData interface{}) {
+	publishMetric(topicSFTPHostKey, message)
+}
@@ -1,8 +1,10 @@
 package monitor
 
 import (
+	"charles_communicator"
 	"device_info"
 	"event_control"
+	"factory"
 	"gablogger"
 	"network_info"
 	"peripherals"
@@ -16,6 +18,9 @@ import (
 
 var Logger = gablogger.Logger()
 
+// stm32JobsTag tags the scheduled jobs sending requests to the STM32
+const stm32JobsTag = "stm32"
+
 var MQTTClient mqtt.Client
 
 func Monitor(mqtt_client_ptr *mqtt.Client) {
@@ -25,12 +30,23 @@ func Monitor(mqtt_client_ptr *mqtt.Client) {
 	event_control.RegisterToReceiveEvent(peripherals.GetTamperEventId(), sendTamperEvent, nil)
 	event_control.RegisterToReceiveEvent(peripherals.GetPowerSourceEventId(), sendPowerSourceEvent, nil)
 	event_control.RegisterToReceiveEvent(peripherals.GetBuzzerEventId(), sendBuzzerEvent, nil)
+	event_control.RegisterToReceiveEvent(peripherals.GetWatchdogAlarmEventId(), sendWatchdogAlarmEvent, nil)
+	event_control.RegisterToReceiveEvent(peripherals.GetEepromAlarmEventId(), sendEepromAlarmEvent, nil)
+	event_control.RegisterToReceiveEvent(peripherals.GetPowerCycleEventId(), sendPowerCycleEvent, nil)
+	event_control.RegisterToReceiveEvent(charles_communicator.GetLinkStateEventId(), sendLinkStateEvent, nil)
+	event_control.RegisterToReceiveEvent(charles_communicator.GetMaintenanceEventId(), handleMaintenanceEvent, nil)
+	event_control.RegisterToReceiveEvent(factory.GetReportEventId(), sendFactoryTestReport, nil)
 
 	event_control.RegisterToReceiveEvent(updater.GetSTM32pdateEventId(), sendUpdateSTM32Event, nil)
 	event_control.RegisterToReceiveEvent(updater.GetHLK7628UpdateEventId(), sendUpdateHLK7628Event, nil)
+	event_control.RegisterToReceiveEvent(updater.GetDownloadProgressEventId(), sendUpdateDownloadEvent, nil)
+	event_control.RegisterToReceiveEvent(updater.GetUpdateRejectedEventId(), sendUpdateRejectedEvent, nil)
+	event_control.RegisterToReceiveEvent(updater.GetHostKeyMismatchEventId(), sendHostKeyMismatchEvent, nil)
 
 	publishMetricFromFunction(topicOsVersion, device_info.GetOSVersion)
-	publishMetricFromFunction(topicStm32FirmwareVersion, peripherals.GetFirmwareVersion)
+	if firmwareVersion, ok := charles_communicator.LookupCommand(charles_communicator.MSG_CMD_FIRMWARE_VERSION); ok {
+		publishMetricFromFunction(firmwareVersion.TelemetryTopic, peripherals.GetFirmwareVersion)
+	}
 	publishMetricFromFunction(topicCharlesGoVersion, device_info.GetCharlesGoVersion)
 
 	if scheduler.InitScheduler() != nil {
@@ -44,34 +60,15 @@ func Monitor(mqtt_client_ptr *mqtt.Client) {
 
 	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicOsVersion, device_info.GetOSVersion)
 
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicSTM32Temperature, peripherals.GetSTM32Temperature)
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicStm32FirmwareVersion, peripherals.GetFirmwareVersion)
-
-	// Delay for 3 seconds using time.Sleep to prevent sending multiple messages simultaneously to the STM32, causing message timeout
-	// This ensures a pause between messages and avoids potential issues.
-	time.Sleep(time.Second * 3)
-
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicPcbBatchNumber, peripherals.GetPCBBatch)
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicPcbReview, peripherals.GetPCBReview)
-	time.Sleep(time.Second * 3)
-
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicSimCardCarrier, peripherals.GetSIMCardCarrier)
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicHasBMS, peripherals.GetHasBMS)
-	time.Sleep(time.Second * 3)
+	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicStm32LinkStatistics, peripherals.GetLinkStatisticsJSON)
 
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicBatteryLevel, peripherals.GetBatteryLevel)
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicIccid, peripherals.GetSIMCardICCID)
-	time.Sleep(time.Second * 3)
-
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicModemSignal, peripherals.GetModemSignalStrength)
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicSimCardType, peripherals.GetSIMCardType)
-	time.Sleep(time.Second * 3)
-
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicModemConnType, peripherals.GetModemConnectionType)
-	time.Sleep(time.Second * 3)
-
-	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicModemConnBand, peripherals.GetModemConnectionBand)
-	time.Sleep(time.Second * 3)
+	// The STM32 telemetry comes from the command registry, and is paused while the STM32 link is
+	// in maintenance
+	for _, command := range charles_communicator.Commands() {
+		if command.TelemetryTopic != "" {
+			scheduler.RegisterTaggedFunctionToSchedule(stm32JobsTag, time.Minute*5, publishCommandMetric, command.TelemetryTopic, command.Id)
+		}
+	}
 
 	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicConnectionInUse, network_info.GetPriorityRoute)
 	scheduler.RegisterFunctionToSchedule(time.Minute*5, publishMetricFromFunction, topicModemConnectionStatus, network_info.GetModemInterfaceStatus)
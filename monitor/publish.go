@@ -3,13 +3,17 @@ package monitor
 import (
 	"encoding/json"
 	"fmt"
+	"peripherals"
 	"time"
 	"utils"
 )
 
+// mqttPublishMessage carries the value as a string in Data and, for the STM32 commands with a
+// typed getter, as a number, boolean or object in Value.
 type mqttPublishMessage struct {
-	Data string    `json:"data"`
-	Date time.Time `json:"date"`
+	Data  string      `json:"data"`
+	Value interface{} `json:"value,omitempty"`
+	Date  time.Time   `json:"date"`
 }
 
 func publishMetricFromFunction(topic string, getMetricFunction func() (string, error)) {
@@ -21,11 +25,36 @@ func publishMetricFromFunction(topic string, getMetricFunction func() (string, e
 	publishMetric(topic, value)
 }
 
+// publishCommandMetric publishes the answer of the STM32 to a GET of a command of the registry.
+func publishCommandMetric(topic string, command uint8) {
+	data, err := peripherals.GetValue(command)
+	if err != nil {
+		Logger.Error("Cannot get data to publish in topic ", topic, ". Reason: ", err)
+		return
+	}
+	publishCommandValue(topic, command, data)
+}
+
+// publishCommandValue publishes data, answered by the STM32 to a GET of command, with its typed
+// value.
+func publishCommandValue(topic string, command uint8, data string) {
+	value, _, err := peripherals.DecodeValue(command, data)
+	if err != nil {
+		Logger.Warn("Publishing topic ", topic, " without a typed value. Reason: ", err)
+	}
+	publishMetricValue(topic, data, value)
+}
+
 func publishMetric(topic, value string) {
+	publishMetricValue(topic, value, nil)
+}
+
+func publishMetricValue(topic, data string, value interface{}) {
 	path := fmt.Sprintf("devices/%s/monitoring/%s", utils.GetUserName(), topic)
 	payload := mqttPublishMessage{
-		Data: value,
-		Date: time.Now(),
+		Data:  data,
+		Value: value,
+		Date:  time.Now(),
 	}
 
 	jsonPayload, err := json.Marshal(payload)
@@ -35,5 +64,5 @@ func publishMetric(topic, value string) {
 	}
 
 	MQTTClient.Publish(path, 1, false, jsonPayload)
-	Logger.Debug("Publish \"", value, "\" -> \"", path, "\" topic.")
+	Logger.Debug("Publish \"", data, "\" -> \"", path, "\" topic.")
 }
@@ -3,27 +3,16 @@ package monitor
 const (
 	topicSocketxpStatus = "socketxp_status"
 
-	topicSTM32Temperature = "stm32_temperature"
+	topicStm32LinkStatistics = "stm32_link_statistics"
+	topicStm32Watchdog       = "stm32_watchdog"
+	topicStm32LinkState      = "stm32_link_state"
 
 	topicMacAddress = "mac_address"
 
-	topicOsVersion            = "os_version"
-	topicStm32FirmwareVersion = "stm32_firmware_version"
-	topicCharlesGoVersion     = "charlesgo_version"
+	topicOsVersion        = "os_version"
+	topicCharlesGoVersion = "charlesgo_version"
 
-	topicPcbBatchNumber = "pcb_batch_number"
-	topicPcbReview      = "pcb_review"
-
-	topicPowerSource  = "power_source"
-	topicHasBMS       = "has_bms"
-	topicBatteryLevel = "battery_level"
-
-	topicIccid          = "iccid"
-	topicModemSignal    = "modem_signal"
-	topicSimCardType    = "sim_card_type"
-	topicSimCardCarrier = "sim_card_carrier"
-	topicModemConnType  = "modem_conn_type"
-	topicModemConnBand  = "modem_conn_band"
+	topicPowerSource = "power_source"
 
 	topicTamperStatus = "tamper_status"
 
@@ -33,6 +22,13 @@ const (
 	topicModemConnectionStatus = "modem_connection_status"
 	topicWiredonnectionStatus  = "wired_connection_status"
 
-	topicUpdateSTM32   = "update_stm32_status"
-	topicUpdateHLK7628 = "update_hlk7628_status"
+	topicFactoryTestReport = "factory_test_report"
+	topicEepromProtection  = "eeprom_protection"
+	topicPowerCycle        = "power_cycle"
+
+	topicUpdateSTM32    = "update_stm32_status"
+	topicUpdateHLK7628  = "update_hlk7628_status"
+	topicUpdateDownload = "update_download_progress"
+	topicUpdateRejected = "update_rejected"
+	topicSFTPHostKey    = "sftp_host_key_mismatch"
 )
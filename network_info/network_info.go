@@ -10,6 +10,11 @@ import (
 
 var Logger = gablogger.Logger()
 
+const (
+	WIRED_INTERFACE = "eth0.2"
+	MODEM_INTERFACE = "wwan0"
+)
+
 func GetPriorityRoute() (string, error) {
 	routes, err := netlink.RouteList(nil, int(netlink.FAMILY_ALL))
 	if err != nil {
@@ -58,12 +63,12 @@ func getIpFromInterface(interfaceName string) (string, error) {
 }
 
 func GetWiredInterfaceStatus() (string, error) {
-	ip, err := getIpFromInterface("eth0.2")
+	ip, err := getIpFromInterface(WIRED_INTERFACE)
 	if err != nil {
 		Logger.Error(err)
 		return ip, err
 	}
-	if checkConnectivity("eth0.2") {
+	if checkConnectivity(WIRED_INTERFACE) {
 		return "available", nil
 	} else {
 		return "unavailable", nil
@@ -71,12 +76,12 @@ func GetWiredInterfaceStatus() (string, error) {
 }
 
 func GetModemInterfaceStatus() (string, error) {
-	ip, err := getIpFromInterface("wwan0")
+	ip, err := getIpFromInterface(MODEM_INTERFACE)
 	if err != nil {
 		Logger.Error(err)
 		return ip, err
 	}
-	if checkConnectivity("wwan0") {
+	if checkConnectivity(MODEM_INTERFACE) {
 		return "available", nil
 	} else {
 		return "unavailable", nil
@@ -87,3 +92,12 @@ func checkConnectivity(networkInterface string) bool {
 	_, err := exec.Command("ping", "-I", networkInterface, "-w", "5", "-c", "1", "google.com").CombinedOutput()
 	return err == nil
 }
+
+// HasCarrier tells whether the interface detects a cable, i.e. its link is up.
+func HasCarrier(interfaceName string) (bool, error) {
+	iface, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		return false, fmt.Errorf("interface '%s' not found: %v", interfaceName, err)
+	}
+	return iface.Attrs().OperState == netlink.OperUp, nil
+}
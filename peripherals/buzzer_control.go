@@ -2,7 +2,9 @@ package peripherals
 
 import (
 	"charles_communicator"
+	"context"
 	"event_control"
+	"strconv"
 )
 
 func setupBuzzerControl() {
@@ -30,3 +32,14 @@ func activateBuzzerByTamper(messageType, command uint8, message string, external
 		}
 	}
 }
+
+// EnableBuzzer makes the STM32 sound the buzzer for the given number of seconds.
+func EnableBuzzer(ctx context.Context, seconds int) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_BUZZER_ENABLE, strconv.Itoa(seconds))
+	return err
+}
+
+func DisableBuzzer(ctx context.Context) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_BUZZER_DISABLE, "")
+	return err
+}
@@ -1,11 +1,16 @@
 package peripherals
 
-import "charles_communicator"
+import (
+	"charles_communicator"
+	"context"
+)
 
-func setEepromDisableWriteProtection() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+func DisableEepromWriteProtection(ctx context.Context) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION, "")
+	return err
 }
 
-func setEepromEnableWriteProtection() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+func EnableEepromWriteProtection(ctx context.Context) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION, "")
+	return err
 }
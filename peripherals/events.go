@@ -9,26 +9,32 @@ var eventTamperId int
 var eventWatchdogId int
 var eventBuzzerId int
 var eventPowerSourceId int
+var eventWatchdogAlarmId int
 
-func respGetWatchdog(messageType, command uint8, message string, messageToken, externalData interface{}) {
-	Logger.Debugln("Watchdog response message sent")
-	CCHandler.SendRespMessage(messageToken.(*charles_communicator.CharlesMessage), "OK")
-	event_control.CallRegisteredEventFunctions(GetWatchdogEventId(), messageType, command, message)
+// The STM32 requests are answered with "OK" by the handler once the subscribers returned.
+
+func respGetWatchdog(message *charles_communicator.InboundMessage) error {
+	Logger.Debugln("Watchdog request received")
+	if watchdog != nil {
+		watchdog.Kick()
+	}
+	event_control.CallRegisteredEventFunctions(GetWatchdogEventId(), message.Type, message.Command, message.Data)
+	return nil
 }
 
-func respSetTamperEvent(messageType, command uint8, message string, messageToken, externalData interface{}) {
-	CCHandler.SendRespMessage(messageToken.(*charles_communicator.CharlesMessage), "OK")
-	event_control.CallRegisteredEventFunctions(GetTamperEventId(), messageType, command, message)
+func respSetTamperEvent(message *charles_communicator.InboundMessage) error {
+	event_control.CallRegisteredEventFunctions(GetTamperEventId(), message.Type, message.Command, message.Data)
+	return nil
 }
 
-func respBuzzerEvent(messageType, command uint8, message string, messageToken, externalData interface{}) {
-	CCHandler.SendRespMessage(messageToken.(*charles_communicator.CharlesMessage), "OK")
-	event_control.CallRegisteredEventFunctions(GetBuzzerEventId(), messageType, command, message)
+func respBuzzerEvent(message *charles_communicator.InboundMessage) error {
+	event_control.CallRegisteredEventFunctions(GetBuzzerEventId(), message.Type, message.Command, message.Data)
+	return nil
 }
 
-func respPowerSourceEvent(messageType, command uint8, message string, messageToken, externalData interface{}) {
-	CCHandler.SendRespMessage(messageToken.(*charles_communicator.CharlesMessage), "OK")
-	event_control.CallRegisteredEventFunctions(GetPowerSourceEventId(), messageType, command, message)
+func respPowerSourceEvent(message *charles_communicator.InboundMessage) error {
+	event_control.CallRegisteredEventFunctions(GetPowerSourceEventId(), message.Type, message.Command, message.Data)
+	return nil
 }
 
 func GetTamperEventId() int {
@@ -58,3 +64,12 @@ func GetPowerSourceEventId() int {
 	}
 	return eventPowerSourceId
 }
+
+// GetWatchdogAlarmEventId is the event fired with the status when the "alarm" action is taken,
+// and with "recovered" when the STM32 recovers after an alarm.
+func GetWatchdogAlarmEventId() int {
+	if eventWatchdogAlarmId == 0 {
+		eventWatchdogAlarmId = event_control.CreateEventId()
+	}
+	return eventWatchdogAlarmId
+}
@@ -1,27 +1,36 @@
 package peripherals
 
-import "charles_communicator"
+import (
+	"charles_communicator"
+	"context"
+)
 
 func GetModemSignalStrength() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_MODEM_SIGNAL, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_MODEM_SIGNAL)
 }
 
 func GetModemConnectionType() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_MODEM_CONN_TYPE, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_MODEM_CONN_TYPE)
 }
 
 func GetModemConnectionBand() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_MODEM_CONN_BAND, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_MODEM_CONN_BAND)
 }
 
 func GetSIMCardType() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_SIM_TYPE, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_SIM_TYPE)
 }
 
 func GetSIMCardICCID() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_SIM_ICCID, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_SIM_ICCID)
 }
 
 func GetSIMCardCarrier() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_SIM_CARRIER, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_SIM_CARRIER)
+}
+
+// resetModem makes the STM32 reset the modem. Remote resets go through PowerCycleModem.
+func resetModem(ctx context.Context) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_MODEM_RESET, "")
+	return err
 }
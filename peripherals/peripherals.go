@@ -2,6 +2,7 @@ package peripherals
 
 import (
 	"charles_communicator"
+	"context"
 	"gablogger"
 )
 
@@ -12,10 +13,35 @@ var CCHandler *charles_communicator.CharlesCommunicatorHandler
 func Setup(ccHandler *charles_communicator.CharlesCommunicatorHandler) {
 	CCHandler = ccHandler
 
-	CCHandler.RegisterFunctionToRcvMsg(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_GET_WATCHDOG, respGetWatchdog, nil)
-	CCHandler.RegisterFunctionToRcvMsg(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_TAMPER_EVENT, respSetTamperEvent, nil)
-	CCHandler.RegisterFunctionToRcvMsg(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_BUZZER_DISABLE, respBuzzerEvent, nil)
-	CCHandler.RegisterFunctionToRcvMsg(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_POWER_SOURCE, respPowerSourceEvent, nil)
+	CCHandler.Subscribe(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_GET_WATCHDOG, respGetWatchdog)
+	CCHandler.Subscribe(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_TAMPER_EVENT, respSetTamperEvent)
+	CCHandler.Subscribe(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_BUZZER_DISABLE, respBuzzerEvent)
+	CCHandler.Subscribe(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_POWER_SOURCE, respPowerSourceEvent)
 
 	setupBuzzerControl()
+	setupWatchdog()
+}
+
+// GetValue sends a GET of a command of the registry to the STM32 and returns the response
+// data, waiting the Timeout of the command for each attempt.
+func GetValue(command uint8) (string, error) {
+	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, command, "", charles_communicator.CommandTimeout(command))
+}
+
+// GetValueContext sends a GET to the STM32 and returns the response data. It gives up when
+// ctx is done.
+func GetValueContext(ctx context.Context, command uint8) (string, error) {
+	response, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_GET, command, "")
+	if err != nil {
+		return "", err
+	}
+	return response.Data, nil
+}
+
+// ContextGetter returns GetValueContext bound to a command, as served by the API for the
+// commands with an APIPath.
+func ContextGetter(command uint8) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		return GetValueContext(ctx, command)
+	}
 }
@@ -0,0 +1,250 @@
+package peripherals
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"event_control"
+	"fmt"
+	"initializer"
+	"network_info"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	POWER_CYCLE_MODEM = "modem"
+	POWER_CYCLE_POE   = "poe"
+)
+
+const (
+	POWER_CYCLE_STARTED    = "started"
+	POWER_CYCLE_REFUSED    = "refused"
+	POWER_CYCLE_FAILED     = "failed"
+	POWER_CYCLE_VERIFIED   = "verified"
+	POWER_CYCLE_UNVERIFIED = "unverified"
+)
+
+// VERIFY_POLL_INTERVAL is the period at which the interface is checked after a power-cycle
+const VERIFY_POLL_INTERVAL = 5 * time.Second
+
+// VERIFY_DOWN_GRACE is how long an interface not seen going down must stay up before the
+// power-cycle is verified, in case it went down and up between two checks
+const VERIFY_DOWN_GRACE = 30 * time.Second
+
+var (
+	ErrRateLimited = errors.New("power-cycled too recently")
+	ErrOnlyUplink  = errors.New("modem is the only active uplink")
+)
+
+// PowerCycleOptions describes who asked for a power-cycle. Force allows resetting the modem when
+// it is the only active uplink; it does not bypass the rate limit.
+type PowerCycleOptions struct {
+	Requester string
+	Force     bool
+}
+
+// AuditEntry is a line of the power-cycle audit log. Each power-cycle writes the outcome of the
+// request, then the outcome of the verification.
+type AuditEntry struct {
+	Date      time.Time `json:"date"`
+	Target    string    `json:"target"`
+	Requester string    `json:"requester"`
+	Forced    bool      `json:"forced"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// powerCycler applies the interlocks around the STM32 resets. The functions are replaced in tests.
+type powerCycler struct {
+	mutex         sync.Mutex
+	lastCycle     map[string]time.Time
+	minInterval   time.Duration
+	verifyTimeout time.Duration
+	pollInterval  time.Duration
+	downGrace     time.Duration
+	reset         map[string]func(ctx context.Context) error
+	interfaces    map[string]string
+	priorityRoute func() (string, error)
+	wiredStatus   func() (string, error)
+	interfaceUp   func(name string) (bool, error)
+	audit         func(entry AuditEntry)
+}
+
+var cycler *powerCycler
+var cyclerOnce sync.Once
+
+var powerCycleEventId int
+
+// GetPowerCycleEventId is the event fired with the JSON AuditEntry of each power-cycle outcome.
+func GetPowerCycleEventId() int {
+	if powerCycleEventId == 0 {
+		powerCycleEventId = event_control.CreateEventId()
+	}
+	return powerCycleEventId
+}
+
+func getPowerCycler() *powerCycler {
+	cyclerOnce.Do(func() {
+		cycler = &powerCycler{
+			lastCycle:     make(map[string]time.Time),
+			minInterval:   initializer.GetPowerCycleMinInterval(),
+			verifyTimeout: initializer.GetPowerCycleVerifyTimeout(),
+			pollInterval:  VERIFY_POLL_INTERVAL,
+			downGrace:     VERIFY_DOWN_GRACE,
+			reset: map[string]func(ctx context.Context) error{
+				POWER_CYCLE_MODEM: resetModem,
+				POWER_CYCLE_POE:   resetPoE,
+			},
+			interfaces: map[string]string{
+				POWER_CYCLE_MODEM: network_info.MODEM_INTERFACE,
+				POWER_CYCLE_POE:   initializer.GetPowerCyclePoEInterface(),
+			},
+			priorityRoute: network_info.GetPriorityRoute,
+			wiredStatus:   network_info.GetWiredInterfaceStatus,
+			interfaceUp:   network_info.HasCarrier,
+			audit:         writeAuditEntry,
+		}
+	})
+	return cycler
+}
+
+// PowerCycleModem makes the STM32 reset the modem. It is refused with ErrRateLimited when the
+// modem was power-cycled less than the configured interval ago, and with ErrOnlyUplink when the
+// modem carries the default route without a working wired connection, unless forced. Once the
+// STM32 accepts the reset, the modem interface is checked in the background until it comes back
+// or the verification times out. Every outcome is written to the audit log.
+func PowerCycleModem(ctx context.Context, options PowerCycleOptions) error {
+	return getPowerCycler().powerCycle(ctx, POWER_CYCLE_MODEM, options)
+}
+
+// PowerCyclePoE makes the STM32 power-cycle the PoE output, with the same rate limit,
+// verification and audit as PowerCycleModem.
+func PowerCyclePoE(ctx context.Context, options PowerCycleOptions) error {
+	return getPowerCycler().powerCycle(ctx, POWER_CYCLE_POE, options)
+}
+
+func (c *powerCycler) powerCycle(ctx context.Context, target string, options PowerCycleOptions) error {
+	entry := AuditEntry{Target: target, Requester: options.Requester, Forced: options.Force}
+	if err := c.reserve(target, options); err != nil {
+		entry.Outcome, entry.Detail = POWER_CYCLE_REFUSED, err.Error()
+		c.record(entry)
+		return err
+	}
+
+	if err := c.reset[target](ctx); err != nil {
+		c.release(target)
+		entry.Outcome, entry.Detail = POWER_CYCLE_FAILED, err.Error()
+		c.record(entry)
+		return err
+	}
+	entry.Outcome = POWER_CYCLE_STARTED
+	c.record(entry)
+	go c.verify(entry)
+	return nil
+}
+
+// reserve checks the interlocks and records the power-cycle, so concurrent requests are rate
+// limited as well. The uplinks are checked before taking the lock, as it may take a few seconds.
+func (c *powerCycler) reserve(target string, options PowerCycleOptions) error {
+	onlyUplink := target == POWER_CYCLE_MODEM && !options.Force && c.isOnlyUplink()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if last, ok := c.lastCycle[target]; ok && time.Since(last) < c.minInterval {
+		return fmt.Errorf("%w: %s power-cycled %s ago", ErrRateLimited, target, time.Since(last).Round(time.Second))
+	}
+	if onlyUplink {
+		return ErrOnlyUplink
+	}
+	c.lastCycle[target] = time.Now()
+	return nil
+}
+
+// release forgets a power-cycle the STM32 did not apply.
+func (c *powerCycler) release(target string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.lastCycle, target)
+}
+
+// isOnlyUplink tells whether the default route goes through the modem while the wired
+// connection is not available. When the route cannot be read, the modem is assumed to be the
+// only uplink.
+func (c *powerCycler) isOnlyUplink() bool {
+	route, err := c.priorityRoute()
+	if err != nil {
+		Logger.Warnln("Cannot read the priority route, assuming the modem is the only uplink:", err)
+		return true
+	}
+	if route != c.interfaces[POWER_CYCLE_MODEM] {
+		return false
+	}
+	wiredStatus, err := c.wiredStatus()
+	return err != nil || wiredStatus != "available"
+}
+
+// verify waits for the interface of the target to go down, then to come back up. An interface
+// never seen down is only verified once it stayed up for the down grace period.
+func (c *powerCycler) verify(entry AuditEntry) {
+	name := c.interfaces[entry.Target]
+	start := time.Now()
+	deadline := start.Add(c.verifyTimeout)
+	wentDown := false
+	for {
+		time.Sleep(c.pollInterval)
+		up, _ := c.interfaceUp(name)
+		if !up {
+			wentDown = true
+		} else if wentDown {
+			entry.Outcome, entry.Detail = POWER_CYCLE_VERIFIED, name+" down then up"
+			break
+		} else if time.Since(start) >= c.downGrace {
+			entry.Outcome, entry.Detail = POWER_CYCLE_VERIFIED, fmt.Sprintf("%s up, not seen down in %s", name, c.downGrace)
+			break
+		}
+		if time.Now().After(deadline) {
+			entry.Outcome, entry.Detail = POWER_CYCLE_UNVERIFIED, fmt.Sprintf("%s not up after %s", name, c.verifyTimeout)
+			break
+		}
+	}
+	c.record(entry)
+}
+
+func (c *powerCycler) record(entry AuditEntry) {
+	entry.Date = time.Now().UTC()
+	if entry.Outcome == POWER_CYCLE_FAILED || entry.Outcome == POWER_CYCLE_UNVERIFIED {
+		Logger.Errorf("Power-cycle %s requested by %s: %s %s", entry.Target, entry.Requester, entry.Outcome, entry.Detail)
+	} else {
+		Logger.Infof("Power-cycle %s requested by %s: %s %s", entry.Target, entry.Requester, entry.Outcome, entry.Detail)
+	}
+	c.audit(entry)
+}
+
+// writeAuditEntry appends the entry to the audit log as a JSON line and publishes it through
+// the power-cycle event.
+func writeAuditEntry(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		Logger.Errorln("Cannot encode power-cycle audit entry:", err)
+		return
+	}
+	event_control.CallRegisteredEventFunctions(GetPowerCycleEventId(), 0, 0, string(line))
+
+	path := initializer.GetPowerCycleAuditLog()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		Logger.Errorln("Cannot create power-cycle audit log directory:", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		Logger.Errorln("Cannot open power-cycle audit log:", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		Logger.Errorln("Cannot write power-cycle audit log:", err)
+	}
+}
@@ -0,0 +1,190 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"context"
+	"errors"
+	"network_info"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUplinks records the resets and audit entries of a powerCycler. route is the priority
+// route, wired the wired status and up tells whether the interfaces are up, after the states
+// of the first checks when set.
+type fakeUplinks struct {
+	mutex    sync.Mutex
+	resets   []string
+	entries  []AuditEntry
+	route    string
+	routeErr error
+	wired    string
+	up       bool
+	states   []bool
+	failing  bool
+	audited  chan AuditEntry
+}
+
+func (f *fakeUplinks) powerCycler() *powerCycler {
+	reset := func(target string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if f.failing {
+				return charles_communicator.ErrTimeout
+			}
+			f.resets = append(f.resets, target)
+			return nil
+		}
+	}
+	f.audited = make(chan AuditEntry, 16)
+	return &powerCycler{
+		lastCycle:     make(map[string]time.Time),
+		minInterval:   time.Minute,
+		verifyTimeout: 30 * time.Millisecond,
+		pollInterval:  5 * time.Millisecond,
+		downGrace:     15 * time.Millisecond,
+		reset: map[string]func(ctx context.Context) error{
+			POWER_CYCLE_MODEM: reset(POWER_CYCLE_MODEM),
+			POWER_CYCLE_POE:   reset(POWER_CYCLE_POE),
+		},
+		interfaces: map[string]string{
+			POWER_CYCLE_MODEM: network_info.MODEM_INTERFACE,
+			POWER_CYCLE_POE:   "eth0",
+		},
+		priorityRoute: func() (string, error) { return f.route, f.routeErr },
+		wiredStatus:   func() (string, error) { return f.wired, nil },
+		interfaceUp: func(name string) (bool, error) {
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if len(f.states) > 0 {
+				up := f.states[0]
+				f.states = f.states[1:]
+				return up, nil
+			}
+			return f.up, nil
+		},
+		audit: func(entry AuditEntry) {
+			f.mutex.Lock()
+			f.entries = append(f.entries, entry)
+			f.mutex.Unlock()
+			f.audited <- entry
+		},
+	}
+}
+
+func (f *fakeUplinks) waitOutcome(t *testing.T, outcome string) {
+	t.Helper()
+	for {
+		select {
+		case entry := <-f.audited:
+			if entry.Outcome == outcome {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No %s audit entry", outcome)
+		}
+	}
+}
+
+func TestPowerCycleRateLimited(t *testing.T) {
+	uplinks := &fakeUplinks{route: network_info.WIRED_INTERFACE, wired: "available", up: true}
+	cycler := uplinks.powerCycler()
+
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_VERIFIED)
+	err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test", Force: true})
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited even when forced, got: %v", err)
+	}
+	// The targets are limited separately
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_MODEM, PowerCycleOptions{Requester: "test"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(uplinks.resets) != 2 {
+		t.Errorf("Expected 2 resets, got: %v", uplinks.resets)
+	}
+}
+
+func TestPowerCycleModemOnlyUplink(t *testing.T) {
+	uplinks := &fakeUplinks{route: network_info.MODEM_INTERFACE, wired: "unavailable", up: true}
+	cycler := uplinks.powerCycler()
+
+	err := cycler.powerCycle(context.Background(), POWER_CYCLE_MODEM, PowerCycleOptions{Requester: "test"})
+	if !errors.Is(err, ErrOnlyUplink) || len(uplinks.resets) != 0 {
+		t.Fatalf("Expected ErrOnlyUplink without reset, got: %v %v", err, uplinks.resets)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_REFUSED)
+
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_MODEM, PowerCycleOptions{Requester: "test", Force: true}); err != nil {
+		t.Fatalf("Expected a forced reset, got: %v", err)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_VERIFIED)
+	if !uplinks.entries[1].Forced {
+		t.Errorf("Expected the forced reset audited as forced: %+v", uplinks.entries[1])
+	}
+}
+
+func TestPowerCycleModemUnknownRoute(t *testing.T) {
+	uplinks := &fakeUplinks{routeErr: errors.New("no route"), wired: "available", up: true}
+	cycler := uplinks.powerCycler()
+
+	err := cycler.powerCycle(context.Background(), POWER_CYCLE_MODEM, PowerCycleOptions{Requester: "test"})
+	if !errors.Is(err, ErrOnlyUplink) || len(uplinks.resets) != 0 {
+		t.Fatalf("Expected ErrOnlyUplink without the route, got: %v %v", err, uplinks.resets)
+	}
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_MODEM, PowerCycleOptions{Requester: "test", Force: true}); err != nil {
+		t.Errorf("Expected a forced reset, got: %v", err)
+	}
+}
+
+func TestPowerCycleVerifiesDownThenUp(t *testing.T) {
+	uplinks := &fakeUplinks{route: network_info.WIRED_INTERFACE, wired: "available", up: true, states: []bool{false, true}}
+	cycler := uplinks.powerCycler()
+	cycler.downGrace = time.Hour
+
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_VERIFIED)
+}
+
+func TestPowerCycleNotVerifiedBeforeGoingDown(t *testing.T) {
+	uplinks := &fakeUplinks{route: network_info.WIRED_INTERFACE, wired: "available", up: true}
+	cycler := uplinks.powerCycler()
+	cycler.downGrace = time.Hour
+
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_UNVERIFIED)
+}
+
+func TestPowerCycleFailedResetNotRateLimited(t *testing.T) {
+	uplinks := &fakeUplinks{route: network_info.WIRED_INTERFACE, wired: "available", failing: true}
+	cycler := uplinks.powerCycler()
+
+	err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test"})
+	if !errors.Is(err, charles_communicator.ErrTimeout) {
+		t.Fatalf("Expected the reset error, got: %v", err)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_FAILED)
+
+	uplinks.failing = false
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test"}); err != nil {
+		t.Errorf("Expected a retry to be allowed after a failed reset, got: %v", err)
+	}
+}
+
+func TestPowerCycleUnverified(t *testing.T) {
+	uplinks := &fakeUplinks{route: network_info.WIRED_INTERFACE, wired: "available", up: false}
+	cycler := uplinks.powerCycler()
+
+	if err := cycler.powerCycle(context.Background(), POWER_CYCLE_POE, PowerCycleOptions{Requester: "test"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uplinks.waitOutcome(t, POWER_CYCLE_UNVERIFIED)
+}
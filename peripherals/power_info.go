@@ -1,15 +1,24 @@
 package peripherals
 
-import "charles_communicator"
+import (
+	"charles_communicator"
+	"context"
+)
 
 func GetPowerSource() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_POWER_SOURCE, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_POWER_SOURCE)
 }
 
 func GetHasBMS() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_HAS_BMS, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_HAS_BMS)
 }
 
 func GetBatteryLevel() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_BATTERY_LEVEL, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_BATTERY_LEVEL)
+}
+
+// resetPoE makes the STM32 power-cycle the PoE output. Remote resets go through PowerCyclePoE.
+func resetPoE(ctx context.Context) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_POE_RESET, "")
+	return err
 }
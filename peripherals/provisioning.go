@@ -0,0 +1,188 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"context"
+	"errors"
+	"event_control"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	PROTECT_ATTEMPTS      = 3
+	PROTECT_INITIAL_DELAY = time.Second
+)
+
+const (
+	EEPROM_PROTECTED   = "protected"
+	EEPROM_UNPROTECTED = "unprotected"
+)
+
+var (
+	ErrProvisioningVerify = errors.New("provisioning read-back mismatch")
+	ErrEepromUnprotected  = errors.New("EEPROM left without write protection")
+)
+
+// ProvisioningData is written to the EEPROM by Provision. Empty fields are left unchanged.
+type ProvisioningData struct {
+	SerialNumber string
+	BatchNumber  string
+	AnatelNumber string
+	PCBRevision  string
+}
+
+type provisioningField struct {
+	name    string
+	command uint8
+	value   func(ProvisioningData) string
+}
+
+var provisioningFields = []provisioningField{
+	{"serial number", charles_communicator.MSG_CMD_SERIAL_NUMBER, func(d ProvisioningData) string { return d.SerialNumber }},
+	{"batch number", charles_communicator.MSG_CMD_BATCH_NUMBER, func(d ProvisioningData) string { return d.BatchNumber }},
+	{"Anatel number", charles_communicator.MSG_CMD_ANATEL_NUMBER, func(d ProvisioningData) string { return d.AnatelNumber }},
+	{"PCB revision", charles_communicator.MSG_CMD_PCB_REV, func(d ProvisioningData) string { return d.PCBRevision }},
+}
+
+// provisioner runs the provisioning transaction over get and set, which send GETs and SETs to
+// the STM32.
+type provisioner struct {
+	get          func(ctx context.Context, command uint8) (string, error)
+	set          func(ctx context.Context, command uint8, data string) error
+	protectDelay time.Duration
+}
+
+var eepromAlarmEventId int
+
+// GetEepromAlarmEventId is the event fired with EEPROM_UNPROTECTED when the EEPROM write
+// protection fails to be enabled again after provisioning, and with EEPROM_PROTECTED when a
+// retry succeeds.
+func GetEepromAlarmEventId() int {
+	if eepromAlarmEventId == 0 {
+		eepromAlarmEventId = event_control.CreateEventId()
+	}
+	return eepromAlarmEventId
+}
+
+func newProvisioner() *provisioner {
+	return &provisioner{
+		get: GetValueContext,
+		set: func(ctx context.Context, command uint8, data string) error {
+			_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, command, data)
+			return err
+		},
+		protectDelay: PROTECT_INITIAL_DELAY,
+	}
+}
+
+// Provision writes the non-empty fields of data to the EEPROM as one transaction: the fields
+// already holding their value are skipped, the others are written with the write protection
+// lifted and read back. When a write or a read-back fails, the fields already written are
+// restored. The write protection is always enabled again, retrying on failure; if it cannot be,
+// the returned error matches ErrEepromUnprotected and an alarm is published.
+func Provision(ctx context.Context, data ProvisioningData) error {
+	return newProvisioner().provision(ctx, data)
+}
+
+func (p *provisioner) provision(ctx context.Context, data ProvisioningData) (err error) {
+	type change struct {
+		field    provisioningField
+		value    string
+		previous string
+	}
+	var changes []change
+	for _, field := range provisioningFields {
+		value := field.value(data)
+		if value == "" {
+			continue
+		}
+		current, getErr := p.get(ctx, field.command)
+		if getErr == nil && current == value {
+			continue
+		}
+		changes = append(changes, change{field: field, value: value, previous: current})
+	}
+	if len(changes) == 0 {
+		Logger.Infoln("EEPROM already provisioned")
+		return nil
+	}
+
+	// The protection is enabled even when disabling it fails, since a timed out SET may have
+	// been applied by the STM32
+	defer func() {
+		if protectErr := p.protect(); protectErr != nil {
+			err = errors.Join(err, protectErr)
+		}
+	}()
+	if err := p.set(ctx, charles_communicator.MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION, ""); err != nil {
+		return fmt.Errorf("cannot disable the EEPROM write protection: %w", err)
+	}
+
+	var written []change
+	for _, c := range changes {
+		Logger.Infof("Provisioning the %s %s", c.field.name, c.value)
+		err = p.set(ctx, c.field.command, c.value)
+		if err == nil {
+			written = append(written, c)
+			err = p.verify(ctx, c.field, c.value)
+		}
+		if err != nil {
+			err = fmt.Errorf("cannot provision the %s: %w", c.field.name, err)
+			break
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	for i := len(written) - 1; i >= 0; i-- {
+		c := written[i]
+		if c.previous == "" {
+			continue
+		}
+		if restoreErr := p.set(context.Background(), c.field.command, c.previous); restoreErr != nil {
+			Logger.Errorf("Cannot restore the %s %s: %v", c.field.name, c.previous, restoreErr)
+		}
+	}
+	return err
+}
+
+func (p *provisioner) verify(ctx context.Context, field provisioningField, value string) error {
+	readBack, err := p.get(ctx, field.command)
+	if err != nil {
+		return fmt.Errorf("cannot read back: %w", err)
+	}
+	if readBack != value {
+		return fmt.Errorf("%w: wrote %q, read %q", ErrProvisioningVerify, value, readBack)
+	}
+	return nil
+}
+
+// protect enables the write protection, retrying with a doubling delay. It does not depend on
+// the provisioning context, so a canceled provisioning still leaves the EEPROM protected.
+func (p *provisioner) protect() error {
+	delay := p.protectDelay
+	var errs []string
+	for attempt := 1; attempt <= PROTECT_ATTEMPTS; attempt++ {
+		err := p.set(context.Background(), charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION, "")
+		if err == nil {
+			if attempt > 1 {
+				event_control.CallRegisteredEventFunctions(GetEepromAlarmEventId(), 0, 0, EEPROM_PROTECTED)
+			}
+			return nil
+		}
+		Logger.Warnf("Cannot enable the EEPROM write protection (attempt %d): %v", attempt, err)
+		errs = append(errs, err.Error())
+		if attempt == 1 {
+			event_control.CallRegisteredEventFunctions(GetEepromAlarmEventId(), 0, 0, EEPROM_UNPROTECTED)
+		}
+		if attempt < PROTECT_ATTEMPTS {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	Logger.Errorln("EEPROM left without write protection")
+	return fmt.Errorf("%w: %s", ErrEepromUnprotected, strings.Join(errs, "; "))
+}
@@ -0,0 +1,123 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeEeprom stores the values set by the provisioner. failSet makes the SETs of a command fail
+// and corrupt makes a command store a different value than the one set.
+type fakeEeprom struct {
+	values    map[uint8]string
+	sets      []uint8
+	failSet   map[uint8]int
+	corrupt   map[uint8]bool
+	protected bool
+}
+
+func newFakeEeprom() *fakeEeprom {
+	return &fakeEeprom{values: map[uint8]string{}, failSet: map[uint8]int{}, corrupt: map[uint8]bool{}, protected: true}
+}
+
+func (e *fakeEeprom) provisioner() *provisioner {
+	return &provisioner{
+		get: func(ctx context.Context, command uint8) (string, error) {
+			return e.values[command], nil
+		},
+		set: func(ctx context.Context, command uint8, data string) error {
+			e.sets = append(e.sets, command)
+			if e.failSet[command] > 0 {
+				e.failSet[command]--
+				return charles_communicator.ErrTimeout
+			}
+			switch command {
+			case charles_communicator.MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION:
+				e.protected = false
+			case charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION:
+				e.protected = true
+			default:
+				if e.corrupt[command] {
+					data += "?"
+				}
+				e.values[command] = data
+			}
+			return nil
+		},
+	}
+}
+
+func TestProvisionSkipsUnchangedEeprom(t *testing.T) {
+	eeprom := newFakeEeprom()
+	eeprom.values[charles_communicator.MSG_CMD_SERIAL_NUMBER] = "SN1"
+	eeprom.values[charles_communicator.MSG_CMD_BATCH_NUMBER] = "B1"
+
+	err := eeprom.provisioner().provision(context.Background(), ProvisioningData{SerialNumber: "SN1", BatchNumber: "B1"})
+	if err != nil || len(eeprom.sets) != 0 {
+		t.Errorf("Expected nothing written, got: %v %v", eeprom.sets, err)
+	}
+}
+
+func TestProvisionWritesChangedFields(t *testing.T) {
+	eeprom := newFakeEeprom()
+	eeprom.values[charles_communicator.MSG_CMD_SERIAL_NUMBER] = "SN1"
+
+	err := eeprom.provisioner().provision(context.Background(), ProvisioningData{SerialNumber: "SN1", AnatelNumber: "A1", PCBRevision: "R2"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := []uint8{charles_communicator.MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION, charles_communicator.MSG_CMD_ANATEL_NUMBER,
+		charles_communicator.MSG_CMD_PCB_REV, charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION}
+	if len(eeprom.sets) != len(expected) {
+		t.Fatalf("Expected SETs %v, got: %v", expected, eeprom.sets)
+	}
+	for i := range expected {
+		if eeprom.sets[i] != expected[i] {
+			t.Fatalf("Expected SETs %v, got: %v", expected, eeprom.sets)
+		}
+	}
+	if !eeprom.protected {
+		t.Errorf("Expected the EEPROM protected")
+	}
+}
+
+func TestProvisionRestoresOnReadBackMismatch(t *testing.T) {
+	eeprom := newFakeEeprom()
+	eeprom.values[charles_communicator.MSG_CMD_SERIAL_NUMBER] = "OLD"
+	eeprom.corrupt[charles_communicator.MSG_CMD_BATCH_NUMBER] = true
+
+	err := eeprom.provisioner().provision(context.Background(), ProvisioningData{SerialNumber: "NEW", BatchNumber: "B1"})
+	if !errors.Is(err, ErrProvisioningVerify) {
+		t.Fatalf("Expected ErrProvisioningVerify, got: %v", err)
+	}
+	if eeprom.values[charles_communicator.MSG_CMD_SERIAL_NUMBER] != "OLD" || !eeprom.protected {
+		t.Errorf("Expected the serial number restored and the EEPROM protected, got: %v %t", eeprom.values, eeprom.protected)
+	}
+}
+
+func TestProvisionRetriesProtection(t *testing.T) {
+	eeprom := newFakeEeprom()
+	eeprom.failSet[charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION] = PROTECT_ATTEMPTS - 1
+	if err := eeprom.provisioner().provision(context.Background(), ProvisioningData{SerialNumber: "SN1"}); err != nil || !eeprom.protected {
+		t.Fatalf("Expected the protection enabled after retries, got: %v", err)
+	}
+
+	eeprom = newFakeEeprom()
+	eeprom.failSet[charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION] = PROTECT_ATTEMPTS
+	err := eeprom.provisioner().provision(context.Background(), ProvisioningData{SerialNumber: "SN1"})
+	if !errors.Is(err, ErrEepromUnprotected) {
+		t.Errorf("Expected ErrEepromUnprotected, got: %v", err)
+	}
+}
+
+func TestProvisionProtectsWhenDisableFails(t *testing.T) {
+	eeprom := newFakeEeprom()
+	eeprom.failSet[charles_communicator.MSG_CMD_EEPROM_DISABLE_WRITE_PROTECTION] = 1
+	if err := eeprom.provisioner().provision(context.Background(), ProvisioningData{SerialNumber: "SN1"}); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if last := eeprom.sets[len(eeprom.sets)-1]; last != charles_communicator.MSG_CMD_EEPROM_ENABLE_WRITE_PROTECTION {
+		t.Errorf("Expected the protection enabled, got: %v", eeprom.sets)
+	}
+}
@@ -2,31 +2,35 @@ package peripherals
 
 import (
 	"charles_communicator"
-	"errors"
+	"context"
+	"encoding/json"
 )
 
 func GetSTM32Temperature() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_STM32_TEMPERATURE, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_STM32_TEMPERATURE)
 }
 
 func GetFirmwareVersion() (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_FIRMWARE_VERSION, "", charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+	return GetValue(charles_communicator.MSG_CMD_FIRMWARE_VERSION)
 }
 
-func SetOsVersion(osVersion string) (string, error) {
-	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_OS_VERSION, osVersion, charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+func GetFirmwareVersionContext(ctx context.Context) (string, error) {
+	return GetValueContext(ctx, charles_communicator.MSG_CMD_FIRMWARE_VERSION)
 }
 
-func SetSerialNumber(serialNumber string) (string, error) {
-	if _, err := setEepromDisableWriteProtection(); err != nil {
-		return "", errors.New("unable to disable write protection")
-	}
-
-	data, erro := CCHandler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_SERIAL_NUMBER, serialNumber, charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
+func GetLinkStatistics() charles_communicator.LinkStatistics {
+	return CCHandler.Statistics()
+}
 
-	if _, err := setEepromEnableWriteProtection(); err != nil {
-		return "", errors.New("unable to enable write protection")
+// GetLinkStatisticsJSON returns the STM32 link counters as a JSON object.
+func GetLinkStatisticsJSON() (string, error) {
+	statistics, err := json.Marshal(GetLinkStatistics())
+	if err != nil {
+		return "", err
 	}
+	return string(statistics), nil
+}
 
-	return data, erro
+func SetOsVersion(osVersion string) (string, error) {
+	return CCHandler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_OS_VERSION, osVersion, charles_communicator.WAIT_MESSAGE_RESPONSE_TIMEOUT)
 }
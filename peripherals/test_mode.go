@@ -0,0 +1,28 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"context"
+)
+
+const (
+	TEST_RESULT_PASS = "PASS"
+	TEST_RESULT_FAIL = "FAIL"
+)
+
+// StartTestSequence makes the STM32 start its factory test sequence.
+func StartTestSequence(ctx context.Context) error {
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_TEST_START, "")
+	return err
+}
+
+// SendTestResult reports to the STM32 the result of a Linux-side factory test, with one of the
+// MSG_CMD_TEST_*_RESULT commands.
+func SendTestResult(ctx context.Context, command uint8, passed bool) error {
+	result := TEST_RESULT_FAIL
+	if passed {
+		result = TEST_RESULT_PASS
+	}
+	_, err := CCHandler.SendMessageContext(ctx, charles_communicator.MSG_TYPE_SET, command, result)
+	return err
+}
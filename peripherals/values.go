@@ -0,0 +1,222 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidValue is returned by the typed getters when the STM32 answers a value that cannot
+// be parsed or is out of range.
+var ErrInvalidValue = errors.New("invalid value")
+
+const (
+	MIN_MODEM_SIGNAL_DBM      = -120
+	MAX_MODEM_SIGNAL_DBM      = -20
+	MIN_STM32_TEMPERATURE_C   = -40.0
+	MAX_STM32_TEMPERATURE_C   = 125.0
+	MIN_BATTERY_LEVEL_PERCENT = 0
+	MAX_BATTERY_LEVEL_PERCENT = 100
+)
+
+const (
+	SIGNAL_QUALITY_EXCELLENT = "excellent"
+	SIGNAL_QUALITY_GOOD      = "good"
+	SIGNAL_QUALITY_FAIR      = "fair"
+	SIGNAL_QUALITY_POOR      = "poor"
+)
+
+// PowerSource is the power source answered by the STM32. The firmwares are not documented to
+// answer only AC or BATTERY, so any other answer is POWER_SOURCE_UNKNOWN.
+type PowerSource string
+
+const (
+	POWER_SOURCE_AC      PowerSource = "AC"
+	POWER_SOURCE_BATTERY PowerSource = "BATTERY"
+	POWER_SOURCE_UNKNOWN PowerSource = "UNKNOWN"
+)
+
+// SIMType is the SIM card type answered by the STM32, SIM_TYPE_UNKNOWN for any answer other
+// than physical or esim.
+type SIMType string
+
+const (
+	SIM_TYPE_PHYSICAL SIMType = "physical"
+	SIM_TYPE_ESIM     SIMType = "esim"
+	SIM_TYPE_UNKNOWN  SIMType = "unknown"
+)
+
+// ModemSignal is the modem signal strength and its quality bucket.
+type ModemSignal struct {
+	Dbm     int    `json:"dbm"`
+	Quality string `json:"quality"`
+}
+
+func signalQuality(dbm int) string {
+	switch {
+	case dbm >= -70:
+		return SIGNAL_QUALITY_EXCELLENT
+	case dbm >= -85:
+		return SIGNAL_QUALITY_GOOD
+	case dbm >= -100:
+		return SIGNAL_QUALITY_FAIR
+	default:
+		return SIGNAL_QUALITY_POOR
+	}
+}
+
+func invalidValue(command uint8, data string, reason string) error {
+	return fmt.Errorf("%w: %s '%s' %s", ErrInvalidValue, charles_communicator.CommandToString(command), data, reason)
+}
+
+func ParseModemSignal(data string) (ModemSignal, error) {
+	dbm, err := strconv.Atoi(strings.TrimSpace(data))
+	if err != nil {
+		return ModemSignal{}, invalidValue(charles_communicator.MSG_CMD_MODEM_SIGNAL, data, "is not an integer")
+	}
+	if dbm < MIN_MODEM_SIGNAL_DBM || dbm > MAX_MODEM_SIGNAL_DBM {
+		return ModemSignal{}, invalidValue(charles_communicator.MSG_CMD_MODEM_SIGNAL, data, "is out of range")
+	}
+	return ModemSignal{Dbm: dbm, Quality: signalQuality(dbm)}, nil
+}
+
+func ParseBatteryLevel(data string) (int, error) {
+	level, err := strconv.Atoi(strings.TrimSpace(data))
+	if err != nil {
+		return 0, invalidValue(charles_communicator.MSG_CMD_BATTERY_LEVEL, data, "is not an integer")
+	}
+	if level < MIN_BATTERY_LEVEL_PERCENT || level > MAX_BATTERY_LEVEL_PERCENT {
+		return 0, invalidValue(charles_communicator.MSG_CMD_BATTERY_LEVEL, data, "is out of range")
+	}
+	return level, nil
+}
+
+func ParseSTM32Temperature(data string) (float64, error) {
+	temperature, err := strconv.ParseFloat(strings.TrimSpace(data), 64)
+	if err != nil {
+		return 0, invalidValue(charles_communicator.MSG_CMD_STM32_TEMPERATURE, data, "is not a number")
+	}
+	if temperature < MIN_STM32_TEMPERATURE_C || temperature > MAX_STM32_TEMPERATURE_C {
+		return 0, invalidValue(charles_communicator.MSG_CMD_STM32_TEMPERATURE, data, "is out of range")
+	}
+	return temperature, nil
+}
+
+// ParsePowerSource never fails: an answer other than AC or BATTERY is POWER_SOURCE_UNKNOWN, the
+// raw answer staying available to the callers.
+func ParsePowerSource(data string) (PowerSource, error) {
+	switch source := PowerSource(strings.ToUpper(strings.TrimSpace(data))); source {
+	case POWER_SOURCE_AC, POWER_SOURCE_BATTERY:
+		return source, nil
+	default:
+		return POWER_SOURCE_UNKNOWN, nil
+	}
+}
+
+// ParseSIMType never fails: an answer other than physical or esim is SIM_TYPE_UNKNOWN.
+func ParseSIMType(data string) (SIMType, error) {
+	switch simType := SIMType(strings.ToLower(strings.TrimSpace(data))); simType {
+	case SIM_TYPE_PHYSICAL, SIM_TYPE_ESIM:
+		return simType, nil
+	default:
+		return SIM_TYPE_UNKNOWN, nil
+	}
+}
+
+func ParseHasBMS(data string) (bool, error) {
+	switch strings.TrimSpace(data) {
+	case "1":
+		return true, nil
+	case "0":
+		return false, nil
+	default:
+		return false, invalidValue(charles_communicator.MSG_CMD_HAS_BMS, data, "is not 0 or 1")
+	}
+}
+
+// valueDecoders are the parsers of the commands with a typed getter.
+var valueDecoders = map[uint8]func(string) (interface{}, error){
+	charles_communicator.MSG_CMD_MODEM_SIGNAL:      untyped(ParseModemSignal),
+	charles_communicator.MSG_CMD_BATTERY_LEVEL:     untyped(ParseBatteryLevel),
+	charles_communicator.MSG_CMD_STM32_TEMPERATURE: untyped(ParseSTM32Temperature),
+	charles_communicator.MSG_CMD_POWER_SOURCE:      untyped(ParsePowerSource),
+	charles_communicator.MSG_CMD_SIM_TYPE:          untyped(ParseSIMType),
+	charles_communicator.MSG_CMD_HAS_BMS:           untyped(ParseHasBMS),
+}
+
+func untyped[T any](parse func(string) (T, error)) func(string) (interface{}, error) {
+	return func(data string) (interface{}, error) {
+		return parse(data)
+	}
+}
+
+// DecodeValue parses the data answered by the STM32 to a GET of a command. The second result is
+// false when the command has no typed getter, the data being its only value.
+func DecodeValue(command uint8, data string) (interface{}, bool, error) {
+	decode, ok := valueDecoders[command]
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := decode(data)
+	return value, true, err
+}
+
+func getTypedValue[T any](ctx context.Context, command uint8, parse func(string) (T, error)) (T, error) {
+	data, err := GetValueContext(ctx, command)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return parse(data)
+}
+
+func GetModemSignal() (ModemSignal, error) {
+	return GetModemSignalContext(context.Background())
+}
+
+func GetModemSignalContext(ctx context.Context) (ModemSignal, error) {
+	return getTypedValue(ctx, charles_communicator.MSG_CMD_MODEM_SIGNAL, ParseModemSignal)
+}
+
+func GetBatteryPercentage() (int, error) {
+	return GetBatteryPercentageContext(context.Background())
+}
+
+func GetBatteryPercentageContext(ctx context.Context) (int, error) {
+	return getTypedValue(ctx, charles_communicator.MSG_CMD_BATTERY_LEVEL, ParseBatteryLevel)
+}
+
+func GetSTM32TemperatureCelsius() (float64, error) {
+	return GetSTM32TemperatureCelsiusContext(context.Background())
+}
+
+func GetSTM32TemperatureCelsiusContext(ctx context.Context) (float64, error) {
+	return getTypedValue(ctx, charles_communicator.MSG_CMD_STM32_TEMPERATURE, ParseSTM32Temperature)
+}
+
+func GetPowerSourceType() (PowerSource, error) {
+	return GetPowerSourceTypeContext(context.Background())
+}
+
+func GetPowerSourceTypeContext(ctx context.Context) (PowerSource, error) {
+	return getTypedValue(ctx, charles_communicator.MSG_CMD_POWER_SOURCE, ParsePowerSource)
+}
+
+func GetSIMType() (SIMType, error) {
+	return GetSIMTypeContext(context.Background())
+}
+
+func GetSIMTypeContext(ctx context.Context) (SIMType, error) {
+	return getTypedValue(ctx, charles_communicator.MSG_CMD_SIM_TYPE, ParseSIMType)
+}
+
+func HasBMS() (bool, error) {
+	return HasBMSContext(context.Background())
+}
+
+func HasBMSContext(ctx context.Context) (bool, error) {
+	return getTypedValue(ctx, charles_communicator.MSG_CMD_HAS_BMS, ParseHasBMS)
+}
@@ -0,0 +1,70 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"errors"
+	"testing"
+)
+
+func TestParseModemSignal(t *testing.T) {
+	tests := map[string]ModemSignal{
+		"-65":  {Dbm: -65, Quality: SIGNAL_QUALITY_EXCELLENT},
+		" -71": {Dbm: -71, Quality: SIGNAL_QUALITY_GOOD},
+		"-100": {Dbm: -100, Quality: SIGNAL_QUALITY_FAIR},
+		"-113": {Dbm: -113, Quality: SIGNAL_QUALITY_POOR},
+	}
+	for data, expected := range tests {
+		signal, err := ParseModemSignal(data)
+		if err != nil || signal != expected {
+			t.Errorf("Expected %+v for '%s', got: %+v %v", expected, data, signal, err)
+		}
+	}
+	for _, data := range []string{"", "strong", "-200", "10"} {
+		if _, err := ParseModemSignal(data); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("Expected ErrInvalidValue for '%s', got: %v", data, err)
+		}
+	}
+}
+
+func TestParseOutOfRangeValues(t *testing.T) {
+	if level, err := ParseBatteryLevel("100"); err != nil || level != 100 {
+		t.Errorf("Expected 100, got: %d %v", level, err)
+	}
+	if _, err := ParseBatteryLevel("101"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("Expected ErrInvalidValue for 101%%, got: %v", err)
+	}
+	if temperature, err := ParseSTM32Temperature("36.5"); err != nil || temperature != 36.5 {
+		t.Errorf("Expected 36.5, got: %f %v", temperature, err)
+	}
+	if _, err := ParseSTM32Temperature("300"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("Expected ErrInvalidValue for 300 C, got: %v", err)
+	}
+}
+
+func TestParseEnums(t *testing.T) {
+	if source, err := ParsePowerSource("battery"); err != nil || source != POWER_SOURCE_BATTERY {
+		t.Errorf("Expected BATTERY, got: %s %v", source, err)
+	}
+	if source, err := ParsePowerSource("SOLAR"); err != nil || source != POWER_SOURCE_UNKNOWN {
+		t.Errorf("Expected UNKNOWN, got: %s %v", source, err)
+	}
+	if simType, err := ParseSIMType("physical"); err != nil || simType != SIM_TYPE_PHYSICAL {
+		t.Errorf("Expected physical, got: %s %v", simType, err)
+	}
+	if simType, err := ParseSIMType("nano"); err != nil || simType != SIM_TYPE_UNKNOWN {
+		t.Errorf("Expected unknown, got: %s %v", simType, err)
+	}
+	if hasBMS, err := ParseHasBMS("0"); err != nil || hasBMS {
+		t.Errorf("Expected false, got: %v %v", hasBMS, err)
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	value, typed, err := DecodeValue(charles_communicator.MSG_CMD_BATTERY_LEVEL, "42")
+	if err != nil || !typed || value != 42 {
+		t.Errorf("Expected typed 42, got: %v %v %v", value, typed, err)
+	}
+	if _, typed, err := DecodeValue(charles_communicator.MSG_CMD_SIM_ICCID, "8955"); typed || err != nil {
+		t.Errorf("Expected ICCID without typed value, got: %v %v", typed, err)
+	}
+}
@@ -0,0 +1,289 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"errors"
+	"event_control"
+	"fmt"
+	"initializer"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	WATCHDOG_ACTION_REOPEN  = "reopen"
+	WATCHDOG_ACTION_ALARM   = "alarm"
+	WATCHDOG_ACTION_RESET   = "reset"
+	WATCHDOG_ACTION_REFLASH = "reflash"
+)
+
+const (
+	WATCHDOG_STATUS_HEALTHY   = "healthy"
+	WATCHDOG_STATUS_SILENT    = "silent"
+	WATCHDOG_STATUS_WEDGED    = "wedged"
+	WATCHDOG_STATUS_RECOVERED = "recovered"
+)
+
+// WATCHDOG_CHECKS_PER_TIMEOUT is the number of health checks per watchdog timeout, so a silent
+// STM32 is detected at most a fraction of the timeout late.
+const WATCHDOG_CHECKS_PER_TIMEOUT = 4
+
+// WatchdogSupervisor checks, several times per timeout, that the STM32 sent a watchdog GET and
+// answered the requests sent to it. A silent STM32 stops sending watchdog GETs; a wedged one keeps
+// sending them but lets the requests time out without answering any. While the STM32 is unhealthy
+// one action is taken per timeout, in the configured order, until it recovers or the actions are
+// exhausted.
+type WatchdogSupervisor struct {
+	mutex       sync.Mutex
+	timeout     time.Duration
+	actionNames []string
+	actions     map[string]func() error
+	statistics  func() charles_communicator.LinkStatistics
+	lastKick    time.Time
+	status      string
+	nextAction  int
+	lastAction  time.Time
+	alarmRaised bool
+	suspended   bool
+	// responses and timeouts of the link at the last response
+	lastResponses uint64
+	lastTimeouts  uint64
+	stop          chan struct{}
+}
+
+var watchdog *WatchdogSupervisor
+var reflashFunction func() error
+
+func NewWatchdogSupervisor(timeout time.Duration, actionNames []string, statistics func() charles_communicator.LinkStatistics) *WatchdogSupervisor {
+	s := &WatchdogSupervisor{
+		timeout:     timeout,
+		actionNames: actionNames,
+		statistics:  statistics,
+		lastKick:    time.Now(),
+		status:      WATCHDOG_STATUS_HEALTHY,
+	}
+	initial := statistics()
+	s.lastResponses, s.lastTimeouts = initial.Latency.Count, initial.Timeouts
+	s.actions = map[string]func() error{
+		WATCHDOG_ACTION_REOPEN:  reopenPort,
+		WATCHDOG_ACTION_ALARM:   s.raiseAlarm,
+		WATCHDOG_ACTION_RESET:   resetSTM32,
+		WATCHDOG_ACTION_REFLASH: reflashSTM32,
+	}
+	return s
+}
+
+// SetAction replaces the function run by an escalation action.
+func (s *WatchdogSupervisor) SetAction(name string, action func() error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.actions[name] = action
+}
+
+// Kick records a watchdog GET of the STM32.
+func (s *WatchdogSupervisor) Kick() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastKick = time.Now()
+}
+
+// Suspend stops the supervision while the STM32 is expected to be silent, e.g. when flashing it.
+func (s *WatchdogSupervisor) Suspend() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.suspended = true
+}
+
+// Resume restarts the supervision, giving the STM32 a full timeout to send its watchdog GET.
+func (s *WatchdogSupervisor) Resume() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.suspended = false
+	s.lastKick = time.Now()
+	statistics := s.statistics()
+	s.lastResponses, s.lastTimeouts = statistics.Latency.Count, statistics.Timeouts
+}
+
+func (s *WatchdogSupervisor) Status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+func (s *WatchdogSupervisor) Start() {
+	s.mutex.Lock()
+	if s.stop != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.stop = make(chan struct{})
+	stop := s.stop
+	s.mutex.Unlock()
+
+	ticker := time.NewTicker(s.timeout / WATCHDOG_CHECKS_PER_TIMEOUT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.check(now)
+		}
+	}
+}
+
+func (s *WatchdogSupervisor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// check evaluates the STM32 health and takes the next escalation action when it is unhealthy and
+// no action was taken for a timeout. The action runs without holding the lock, so it can take as
+// long as flashing the STM32.
+func (s *WatchdogSupervisor) check(now time.Time) {
+	s.mutex.Lock()
+	if s.suspended {
+		s.mutex.Unlock()
+		return
+	}
+
+	statistics := s.statistics()
+	responses, timeouts := statistics.Latency.Count, statistics.Timeouts
+	status := WATCHDOG_STATUS_HEALTHY
+	if now.Sub(s.lastKick) > s.timeout {
+		status = WATCHDOG_STATUS_SILENT
+	} else if timeouts > s.lastTimeouts && responses == s.lastResponses {
+		status = WATCHDOG_STATUS_WEDGED
+	}
+	// The STM32 stays wedged until it answers a request
+	if responses != s.lastResponses {
+		s.lastResponses, s.lastTimeouts = responses, timeouts
+	}
+
+	if status == WATCHDOG_STATUS_HEALTHY {
+		wasUnhealthy := s.status != WATCHDOG_STATUS_HEALTHY
+		alarmRaised := s.alarmRaised
+		s.status, s.nextAction, s.lastAction, s.alarmRaised = status, 0, time.Time{}, false
+		s.mutex.Unlock()
+		if wasUnhealthy {
+			Logger.Infoln("STM32 watchdog recovered")
+		}
+		if alarmRaised {
+			event_control.CallRegisteredEventFunctions(GetWatchdogAlarmEventId(), 0, 0, WATCHDOG_STATUS_RECOVERED)
+		}
+		return
+	}
+
+	if s.status != status {
+		Logger.Warnf("STM32 watchdog detected a %s STM32", status)
+	}
+	s.status = status
+	if s.nextAction >= len(s.actionNames) || now.Sub(s.lastAction) < s.timeout {
+		s.mutex.Unlock()
+		return
+	}
+	name := s.actionNames[s.nextAction]
+	action := s.actions[name]
+	s.nextAction++
+	s.lastAction = now
+	exhausted := s.nextAction == len(s.actionNames)
+	s.mutex.Unlock()
+
+	Logger.Warnf("STM32 watchdog escalation: %s", name)
+	if action == nil {
+		Logger.Errorf("Unknown STM32 watchdog action %s", name)
+	} else if err := action(); err != nil {
+		Logger.Errorf("STM32 watchdog action %s failed: %v", name, err)
+	}
+	if exhausted {
+		Logger.Errorln("STM32 watchdog escalation exhausted, waiting for the STM32 to recover")
+	}
+}
+
+// raiseAlarm publishes the current status through the watchdog alarm event.
+func (s *WatchdogSupervisor) raiseAlarm() error {
+	s.mutex.Lock()
+	s.alarmRaised = true
+	status := s.status
+	s.mutex.Unlock()
+	event_control.CallRegisteredEventFunctions(GetWatchdogAlarmEventId(), 0, 0, status)
+	return nil
+}
+
+func reopenPort() error {
+	CCHandler.ClosePort()
+	if !CCHandler.OpenPort() {
+		return errors.New("cannot reopen the STM32 port")
+	}
+	return nil
+}
+
+func resetSTM32() error {
+	script := initializer.GetWatchdogResetScript()
+	if script == "" {
+		return errors.New("no reset script configured")
+	}
+	output, err := exec.Command(script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return nil
+}
+
+func reflashSTM32() error {
+	if reflashFunction == nil {
+		return errors.New("no reflash function registered")
+	}
+	return reflashFunction()
+}
+
+// setupWatchdog starts the supervision of the STM32 when the watchdog is enabled. Without the
+// supervisor nothing answers the watchdog GETs, so the watchdog would take a healthy STM32 for
+// silent and escalate: it is not started.
+func setupWatchdog() {
+	if !initializer.IsWatchdogEnabled() {
+		return
+	}
+	if !initializer.IsSupervisorEnable() {
+		Logger.Infoln("Supervisor disabled, STM32 watchdog disabled")
+		return
+	}
+	if initializer.GetWatchdogTimeout() <= 0 {
+		Logger.Errorln("Invalid STM32 watchdog timeout, supervisor disabled")
+		return
+	}
+	watchdog = NewWatchdogSupervisor(initializer.GetWatchdogTimeout(), initializer.GetWatchdogActions(), CCHandler.Statistics)
+	go watchdog.Start()
+}
+
+// SetWatchdogReflash registers the function flashing the known-good firmware, taken by the
+// "reflash" escalation action.
+func SetWatchdogReflash(reflash func() error) {
+	reflashFunction = reflash
+}
+
+// SuspendWatchdog stops the STM32 supervision until ResumeWatchdog is called.
+func SuspendWatchdog() {
+	if watchdog != nil {
+		watchdog.Suspend()
+	}
+}
+
+func ResumeWatchdog() {
+	if watchdog != nil {
+		watchdog.Resume()
+	}
+}
+
+// GetWatchdogStatus returns the STM32 health seen by the watchdog supervisor.
+func GetWatchdogStatus() (string, error) {
+	if watchdog == nil {
+		return "", errors.New("watchdog supervisor disabled")
+	}
+	return watchdog.Status(), nil
+}
@@ -0,0 +1,141 @@
+package peripherals
+
+import (
+	"charles_communicator"
+	"initializer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeLink struct {
+	responses uint64
+	timeouts  uint64
+}
+
+func (l *fakeLink) statistics() charles_communicator.LinkStatistics {
+	return charles_communicator.LinkStatistics{Timeouts: l.timeouts, Latency: charles_communicator.LatencyHistogram{Count: l.responses}}
+}
+
+func newTestWatchdog(link *fakeLink, taken *[]string) *WatchdogSupervisor {
+	names := []string{WATCHDOG_ACTION_REOPEN, WATCHDOG_ACTION_RESET, WATCHDOG_ACTION_REFLASH}
+	s := NewWatchdogSupervisor(time.Second, names, link.statistics)
+	for _, name := range names {
+		name := name
+		s.SetAction(name, func() error {
+			*taken = append(*taken, name)
+			return nil
+		})
+	}
+	return s
+}
+
+func TestWatchdogEscalatesWhileSilent(t *testing.T) {
+	var taken []string
+	s := newTestWatchdog(&fakeLink{}, &taken)
+	start := time.Now()
+
+	s.check(start.Add(500 * time.Millisecond))
+	if len(taken) != 0 || s.Status() != WATCHDOG_STATUS_HEALTHY {
+		t.Fatalf("Expected healthy without action, got: %s %v", s.Status(), taken)
+	}
+	for i := 2; i <= 5; i++ {
+		s.check(start.Add(time.Duration(i) * time.Second))
+	}
+	if strings.Join(taken, ",") != "reopen,reset,reflash" || s.Status() != WATCHDOG_STATUS_SILENT {
+		t.Errorf("Expected every action once while silent, got: %s %v", s.Status(), taken)
+	}
+
+	s.Kick()
+	s.check(time.Now())
+	if s.Status() != WATCHDOG_STATUS_HEALTHY {
+		t.Errorf("Expected healthy after a kick, got: %s", s.Status())
+	}
+	s.check(time.Now().Add(2 * time.Second))
+	if taken[len(taken)-1] != WATCHDOG_ACTION_REOPEN {
+		t.Errorf("Expected the escalation to start over, got: %v", taken)
+	}
+}
+
+func TestWatchdogDetectsWedgedSTM32(t *testing.T) {
+	var taken []string
+	link := &fakeLink{responses: 10}
+	s := newTestWatchdog(link, &taken)
+
+	s.Kick()
+	s.check(time.Now())
+	link.timeouts = 3
+	s.Kick()
+	s.check(time.Now())
+	if s.Status() != WATCHDOG_STATUS_WEDGED || strings.Join(taken, ",") != "reopen" {
+		t.Fatalf("Expected wedged with a reopen, got: %s %v", s.Status(), taken)
+	}
+
+	link.timeouts, link.responses = 4, 11
+	s.Kick()
+	s.check(time.Now())
+	if s.Status() != WATCHDOG_STATUS_HEALTHY {
+		t.Errorf("Expected healthy once answered, got: %s", s.Status())
+	}
+}
+
+func TestWatchdogTakesOneActionPerTimeout(t *testing.T) {
+	var taken []string
+	link := &fakeLink{responses: 10}
+	s := newTestWatchdog(link, &taken)
+	start := time.Now()
+
+	link.timeouts = 1
+	for i := 1; i <= 8; i++ {
+		now := start.Add(time.Duration(i) * time.Second / WATCHDOG_CHECKS_PER_TIMEOUT)
+		s.lastKick = now
+		s.check(now)
+		if s.Status() != WATCHDOG_STATUS_WEDGED {
+			t.Fatalf("Expected to stay wedged without a response, got: %s", s.Status())
+		}
+	}
+	if strings.Join(taken, ",") != "reopen,reset" {
+		t.Errorf("Expected 2 actions in 2 timeouts, got: %v", taken)
+	}
+}
+
+func TestSuspendedWatchdogTakesNoAction(t *testing.T) {
+	var taken []string
+	s := newTestWatchdog(&fakeLink{}, &taken)
+
+	s.Suspend()
+	s.check(time.Now().Add(time.Minute))
+	s.Resume()
+	s.check(time.Now())
+	if len(taken) != 0 {
+		t.Errorf("Expected no action while suspended, got: %v", taken)
+	}
+}
+
+func TestWatchdogNotStartedWithoutSupervisor(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.ini")
+	content := "[SUPERVISOR]\nENABLE=false\n[WATCHDOG]\nENABLE=true\nTIMEOUT_S=1\nACTIONS=reopen,alarm,reset,reflash\n"
+	if err := os.WriteFile(config, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	initializer.LoadConfig(config)
+	t.Cleanup(func() { initializer.LoadConfig("") })
+	reflashed := false
+	SetWatchdogReflash(func() error {
+		reflashed = true
+		return nil
+	})
+	t.Cleanup(func() { SetWatchdogReflash(nil) })
+
+	setupWatchdog()
+	if watchdog != nil {
+		watchdog.Stop()
+		watchdog = nil
+		t.Fatalf("Expected no watchdog supervision without the supervisor")
+	}
+	if _, err := GetWatchdogStatus(); err == nil || reflashed {
+		t.Errorf("Expected the watchdog disabled without escalation, got reflashed=%v", reflashed)
+	}
+}
@@ -0,0 +1,207 @@
+// Package rpc lets the backend operators run whitelisted peripherals operations through MQTT.
+// Requests are received on devices/<user>/rpc/request and each one is answered on
+// devices/<user>/rpc/response with the id of the request.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gablogger"
+	"initializer"
+	"peripherals"
+	"sync"
+	"time"
+	"utils"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var Logger = gablogger.Logger()
+var Handler *RPC
+
+const (
+	REQUEST_TIMEOUT = 30 * time.Second
+	// RECENT_REQUESTS is the number of answered requests kept to answer a redelivered request
+	// without running it again
+	RECENT_REQUESTS = 64
+)
+
+var (
+	ErrUnknownMethod = errors.New("unknown method")
+	ErrInvalidParams = errors.New("invalid params")
+)
+
+type RPC struct {
+	RequestTopic  string
+	ResponseTopic string
+	mutex         sync.Mutex
+	recent        map[string]*recentRequest
+	recentIds     []string
+}
+
+// recentRequest is a request being run or recently answered. done is closed once response is
+// set.
+type recentRequest struct {
+	done     chan struct{}
+	response *Response
+}
+
+type Request struct {
+	Id     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response carries the result of the method, or the reason it failed in Error.
+type Response struct {
+	Id     string      `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Date   time.Time   `json:"date"`
+}
+
+// requestIdKey carries the id of the request in the context of its method, for the audit logs.
+type requestIdKey struct{}
+
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+type method func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// methods is the whitelist of the operations that can be run remotely.
+var methods = map[string]method{
+	"modem.signal": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return peripherals.GetModemSignalContext(ctx)
+	},
+	"modem.reset": powerCycle(peripherals.PowerCycleModem),
+	"poe.reset":   powerCycle(peripherals.PowerCyclePoE),
+	"buzzer.enable": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var buzzerParams struct {
+			Seconds int `json:"seconds"`
+		}
+		if err := json.Unmarshal(params, &buzzerParams); err != nil || buzzerParams.Seconds <= 0 {
+			return nil, fmt.Errorf("%w: expected a positive \"seconds\"", ErrInvalidParams)
+		}
+		if err := peripherals.EnableBuzzer(ctx, buzzerParams.Seconds); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	},
+	"buzzer.disable": withoutResult(peripherals.DisableBuzzer),
+}
+
+func withoutResult(operation func(ctx context.Context) error) method {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		if err := operation(ctx); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	}
+}
+
+// powerCycle runs a power-cycle with its interlocks. The modem can be reset while it is the
+// only uplink with {"force": true}.
+func powerCycle(operation func(ctx context.Context, options peripherals.PowerCycleOptions) error) method {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var powerCycleParams struct {
+			Force bool `json:"force"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &powerCycleParams); err != nil {
+				return nil, fmt.Errorf("%w: expected a boolean \"force\"", ErrInvalidParams)
+			}
+		}
+		options := peripherals.PowerCycleOptions{Requester: "rpc " + requestId(ctx), Force: powerCycleParams.Force}
+		if err := operation(ctx, options); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	}
+}
+
+func InitRPC() {
+	username := utils.GetUserName()
+	Handler = &RPC{
+		RequestTopic:  fmt.Sprintf("devices/%s/rpc/request", username),
+		ResponseTopic: fmt.Sprintf("devices/%s/rpc/response", username),
+		recent:        make(map[string]*recentRequest),
+	}
+}
+
+// RequestCallback runs the requested method and publishes its response. It does not block the
+// MQTT client while the STM32 answers.
+func RequestCallback(client mqtt.Client, message mqtt.Message) {
+	if !initializer.IsRPCEnabled() {
+		Logger.Warnln("Ignoring RPC request, RPC disabled")
+		return
+	}
+	payload := message.Payload()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		response, err := json.Marshal(Handler.handleRequest(ctx, payload))
+		if err != nil {
+			Logger.Errorln("Cannot encode RPC response:", err)
+			return
+		}
+		client.Publish(Handler.ResponseTopic, 1, false, response)
+	}()
+}
+
+// handleRequest decodes and runs a request. A request whose id is running or was recently
+// answered, as redelivered by MQTT, gets the same response without running the method again.
+func (r *RPC) handleRequest(ctx context.Context, payload []byte) *Response {
+	var request Request
+	if err := json.Unmarshal(payload, &request); err != nil || request.Id == "" {
+		Logger.Warnln("Invalid RPC request:", string(payload))
+		return &Response{Id: request.Id, Error: "invalid request", Date: time.Now()}
+	}
+	recent, first := r.reserve(request.Id)
+	if !first {
+		Logger.Infof("RPC request %s already received", request.Id)
+		select {
+		case <-recent.done:
+			return recent.response
+		case <-ctx.Done():
+			return &Response{Id: request.Id, Error: ctx.Err().Error(), Date: time.Now()}
+		}
+	}
+
+	Logger.Infof("RPC request %s: %s", request.Id, request.Method)
+	ctx = context.WithValue(ctx, requestIdKey{}, request.Id)
+	response := &Response{Id: request.Id}
+	if run, ok := methods[request.Method]; !ok {
+		response.Error = fmt.Sprintf("%v: %s", ErrUnknownMethod, request.Method)
+	} else if result, err := run(ctx, request.Params); err != nil {
+		Logger.Errorf("RPC request %s failed: %v", request.Id, err)
+		response.Error = err.Error()
+	} else {
+		response.Result = result
+	}
+	response.Date = time.Now()
+	recent.response = response
+	close(recent.done)
+	return response
+}
+
+// reserve records the request id before its method runs, so a concurrent redelivery waits for
+// its response. It tells whether the id was not known.
+func (r *RPC) reserve(id string) (*recentRequest, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if recent, ok := r.recent[id]; ok {
+		return recent, false
+	}
+	if len(r.recentIds) == RECENT_REQUESTS {
+		delete(r.recent, r.recentIds[0])
+		r.recentIds = r.recentIds[1:]
+	}
+	recent := &recentRequest{done: make(chan struct{})}
+	r.recent[id] = recent
+	r.recentIds = append(r.recentIds, id)
+	return recent, true
+}
@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestRPC(t *testing.T, testMethods map[string]method) *RPC {
+	saved := methods
+	methods = testMethods
+	t.Cleanup(func() { methods = saved })
+	return &RPC{recent: make(map[string]*recentRequest)}
+}
+
+func TestHandleRequestRunsWhitelistedMethods(t *testing.T) {
+	r := newTestRPC(t, map[string]method{
+		"poe.reset": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			return "OK", nil
+		},
+		"modem.reset": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			return nil, errors.New("timeout")
+		},
+	})
+
+	if response := r.handleRequest(context.Background(), []byte(`{"id":"1","method":"poe.reset"}`)); response.Id != "1" || response.Result != "OK" || response.Error != "" {
+		t.Errorf("Expected OK, got: %+v", response)
+	}
+	if response := r.handleRequest(context.Background(), []byte(`{"id":"2","method":"modem.reset"}`)); response.Error != "timeout" {
+		t.Errorf("Expected the method error, got: %+v", response)
+	}
+	if response := r.handleRequest(context.Background(), []byte(`{"id":"3","method":"shell"}`)); !strings.HasPrefix(response.Error, ErrUnknownMethod.Error()) {
+		t.Errorf("Expected an unknown method, got: %+v", response)
+	}
+	if response := r.handleRequest(context.Background(), []byte(`{"method":"poe.reset"}`)); response.Error != "invalid request" {
+		t.Errorf("Expected an invalid request without id, got: %+v", response)
+	}
+}
+
+func TestRedeliveredRequestRunsOnce(t *testing.T) {
+	calls := 0
+	r := newTestRPC(t, map[string]method{
+		"poe.reset": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			calls++
+			return "OK", nil
+		},
+	})
+
+	request := []byte(`{"id":"abc","method":"poe.reset"}`)
+	first := r.handleRequest(context.Background(), request)
+	second := r.handleRequest(context.Background(), request)
+	if calls != 1 || first != second {
+		t.Errorf("Expected a single run with the same response, got: %d runs", calls)
+	}
+
+	for i := 0; i < RECENT_REQUESTS; i++ {
+		r.handleRequest(context.Background(), []byte(`{"id":"`+strings.Repeat("x", i+1)+`","method":"poe.reset"}`))
+	}
+	r.handleRequest(context.Background(), request)
+	if calls != RECENT_REQUESTS+2 {
+		t.Errorf("Expected the oldest request forgotten, got: %d runs", calls)
+	}
+}
+
+func TestConcurrentRedeliveryWaitsForFirstRun(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	r := newTestRPC(t, map[string]method{
+		"modem.reset": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			calls++
+			close(started)
+			<-release
+			return "OK", nil
+		},
+	})
+
+	request := []byte(`{"id":"abc","method":"modem.reset"}`)
+	responses := make(chan *Response, 2)
+	go func() { responses <- r.handleRequest(context.Background(), request) }()
+	<-started
+	go func() { responses <- r.handleRequest(context.Background(), request) }()
+	close(release)
+
+	first, second := <-responses, <-responses
+	if calls != 1 || first != second || first.Result != "OK" {
+		t.Errorf("Expected a single run with the same response, got: %d runs, %+v %+v", calls, first, second)
+	}
+}
+
+func TestBuzzerEnableValidatesParams(t *testing.T) {
+	for _, params := range []string{``, `{}`, `{"seconds":0}`, `{"seconds":"ten"}`} {
+		_, err := methods["buzzer.enable"](context.Background(), json.RawMessage(params))
+		if !errors.Is(err, ErrInvalidParams) {
+			t.Errorf("Expected ErrInvalidParams for %q, got: %v", params, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	cron "github.com/go-co-op/gocron/v2"
@@ -11,6 +12,10 @@ import (
 
 var scheduler cron.Scheduler
 
+// pausedTags holds the tags whose jobs are skipped until ResumeTag is called
+var pausedTags = make(map[string]bool)
+var pausedTagsMutex sync.Mutex
+
 func InitScheduler() error {
 	if scheduler != nil {
 		return nil
@@ -25,6 +30,12 @@ func InitScheduler() error {
 }
 
 func RegisterFunctionToSchedule(duration time.Duration, function interface{}, parameters ...interface{}) (interface{}, error) {
+	return RegisterTaggedFunctionToSchedule("", duration, function, parameters...)
+}
+
+// RegisterTaggedFunctionToSchedule schedules a function like RegisterFunctionToSchedule, skipping
+// its runs while its tag is paused with PauseTag.
+func RegisterTaggedFunctionToSchedule(tag string, duration time.Duration, function interface{}, parameters ...interface{}) (interface{}, error) {
 	if scheduler == nil {
 		return nil, fmt.Errorf("the scheduler needs to be initialized")
 	}
@@ -42,9 +53,21 @@ func RegisterFunctionToSchedule(duration time.Duration, function interface{}, pa
 		return nil, fmt.Errorf("incorrect number of parameters. Expected %d, got %d", expectedParams, actualParams)
 	}
 
+	arguments, err := callArguments(funcType, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	task := cron.NewTask(func() {
+		if tag != "" && isTagPaused(tag) {
+			return
+		}
+		reflect.ValueOf(function).Call(arguments)
+	})
+
 	job, err := scheduler.NewJob(
 		cron.DurationJob(duration),
-		cron.NewTask(function, parameters...),
+		task,
 	)
 
 	if err != nil {
@@ -53,6 +76,28 @@ func RegisterFunctionToSchedule(duration time.Duration, function interface{}, pa
 	return job.ID(), nil
 }
 
+// callArguments converts the parameters to the arguments of a function of type funcType, a nil
+// parameter giving the zero value of its argument, and checks that they can be passed to it.
+func callArguments(funcType reflect.Type, parameters []interface{}) ([]reflect.Value, error) {
+	arguments := make([]reflect.Value, len(parameters))
+	for i, parameter := range parameters {
+		argumentType := funcType.In(i)
+		if parameter == nil {
+			switch argumentType.Kind() {
+			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
+				arguments[i] = reflect.Zero(argumentType)
+				continue
+			}
+			return nil, fmt.Errorf("parameter %d cannot be nil, expected %s", i, argumentType)
+		}
+		arguments[i] = reflect.ValueOf(parameter)
+		if !arguments[i].Type().AssignableTo(argumentType) {
+			return nil, fmt.Errorf("incorrect type of parameter %d. Expected %s, got %s", i, argumentType, arguments[i].Type())
+		}
+	}
+	return arguments, nil
+}
+
 func RemoveFunctionFromSchedule(jobId interface{}) error {
 	if scheduler == nil {
 		return fmt.Errorf("the scheduler needs to be initialized")
@@ -69,3 +114,22 @@ func RemoveFunctionFromSchedule(jobId interface{}) error {
 
 	return nil
 }
+
+// PauseTag skips the runs of the jobs registered with the tag until ResumeTag is called.
+func PauseTag(tag string) {
+	pausedTagsMutex.Lock()
+	defer pausedTagsMutex.Unlock()
+	pausedTags[tag] = true
+}
+
+func ResumeTag(tag string) {
+	pausedTagsMutex.Lock()
+	defer pausedTagsMutex.Unlock()
+	delete(pausedTags, tag)
+}
+
+func isTagPaused(tag string) bool {
+	pausedTagsMutex.Lock()
+	defer pausedTagsMutex.Unlock()
+	return pausedTags[tag]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// faultInjector decides which faults are applied to each frame answered by the simulator.
+type faultInjector struct {
+	mutex       sync.Mutex
+	random      *rand.Rand
+	dropRate    float64
+	errorRate   float64
+	garbageRate float64
+	delay       time.Duration
+	delayJitter time.Duration
+}
+
+func newFaultInjector(seed int64) *faultInjector {
+	return &faultInjector{random: rand.New(rand.NewSource(seed))}
+}
+
+func (f *faultInjector) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.random.Float64() < rate
+}
+
+// shouldDrop reports whether a request must be left without answer.
+func (f *faultInjector) shouldDrop() bool {
+	return f.chance(f.dropRate)
+}
+
+// shouldReplyError reports whether a request must be answered with an ERROR frame.
+func (f *faultInjector) shouldReplyError() bool {
+	return f.chance(f.errorRate)
+}
+
+// replyDelay returns how long the simulator waits before answering a request.
+func (f *faultInjector) replyDelay() time.Duration {
+	if f.delayJitter <= 0 {
+		return f.delay
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.delay + time.Duration(f.random.Int63n(int64(f.delayJitter)))
+}
+
+// garbage returns random bytes to be written before a frame, or nil.
+func (f *faultInjector) garbage() []byte {
+	if !f.chance(f.garbageRate) {
+		return nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	noise := make([]byte, 1+f.random.Intn(16))
+	for i := range noise {
+		noise[i] = byte(f.random.Intn(256))
+	}
+	return noise
+}
@@ -0,0 +1,5 @@
+module stm32sim
+
+go 1.21.1
+
+require golang.org/x/sys v0.15.0
@@ -0,0 +1,94 @@
+// stm32sim simulates the STM32 side of the Charles protocol, so CharlesGo can run on x64 without
+// the physical board. Start it with -listen to serve CharlesGo over TCP or with -pty to create a
+// pseudo-terminal, then point CharlesGo to it with --stm32-port.
+package main
+
+import (
+	"charles_communicator"
+	"flag"
+	"gablogger"
+	"net"
+	"time"
+)
+
+var Logger = gablogger.Logger()
+
+func main() {
+	listenAddress := flag.String("listen", "", "Serve CharlesGo over TCP in this address (e.g. 127.0.0.1:5555)")
+	usePTY := flag.Bool("pty", false, "Serve CharlesGo over a pseudo-terminal")
+	valuesFilePath := flag.String("values", "", "Specify a JSON file with the values answered to each command")
+	watchdogInterval := flag.Duration("watchdog-interval", 10*time.Second, "Interval between watchdog GETs, 0 disables them")
+	tamperInterval := flag.Duration("tamper-interval", 0, "Interval between tamper events, 0 disables them")
+	powerInterval := flag.Duration("power-source-interval", 0, "Interval between power source events, 0 disables them")
+	dropRate := flag.Float64("drop-rate", 0, "Probability of leaving a request without answer")
+	errorRate := flag.Float64("error-rate", 0, "Probability of answering a request with ERROR")
+	garbageRate := flag.Float64("garbage-rate", 0, "Probability of writing garbage bytes before a frame")
+	delay := flag.Duration("delay", 0, "Delay before answering a request")
+	delayJitter := flag.Duration("delay-jitter", 0, "Random delay added to -delay")
+	protocolVersion := flag.Uint("protocol-version", charles_communicator.PROTOCOL_VERSION, "Highest protocol version accepted in the handshake, 0 emulates firmwares without handshake")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "Seed used by the fault injection")
+	flag.Parse()
+
+	values, events, err := loadSimulatorConfig(*valuesFilePath)
+	if err != nil {
+		Logger.Fatalln("Cannot load values.", err)
+	}
+
+	faults := newFaultInjector(*seed)
+	faults.dropRate = *dropRate
+	faults.errorRate = *errorRate
+	faults.garbageRate = *garbageRate
+	faults.delay = *delay
+	faults.delayJitter = *delayJitter
+
+	simulator := NewSimulator(values, events, faults)
+	simulator.maxProtocolVersion = uint8(min(*protocolVersion, charles_communicator.PROTOCOL_VERSION))
+	simulator.watchdogInterval = *watchdogInterval
+	simulator.tamperInterval = *tamperInterval
+	simulator.powerInterval = *powerInterval
+
+	switch {
+	case *usePTY:
+		servePTY(simulator)
+	case *listenAddress != "":
+		serveTCP(simulator, *listenAddress)
+	default:
+		Logger.Fatalln("Use -listen or -pty to choose how CharlesGo reaches the simulator")
+	}
+}
+
+func serveTCP(simulator *Simulator, address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		Logger.Fatalln("Cannot listen in", address, err)
+	}
+	Logger.Infof("STM32 simulator listening in %s, use --stm32-port tcp://%s", address, listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			Logger.Errorln("Cannot accept connection:", err)
+			continue
+		}
+		Logger.Infoln("CharlesGo connected from", conn.RemoteAddr())
+		err = simulator.Serve(conn)
+		Logger.Infoln("CharlesGo disconnected:", err)
+		conn.Close()
+	}
+}
+
+func servePTY(simulator *Simulator) {
+	master, slavePath, err := openPTY()
+	if err != nil {
+		Logger.Fatalln("Cannot create pty.", err)
+	}
+	defer master.Close()
+	Logger.Infof("STM32 simulator ready, use --stm32-port %s", slavePath)
+
+	// The master side fails while CharlesGo has the slave closed, so keep serving
+	for {
+		err := simulator.Serve(master)
+		Logger.Debugln("Pty not ready:", err)
+		time.Sleep(time.Second)
+	}
+}
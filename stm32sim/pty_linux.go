@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY creates a pseudo-terminal and returns its master side and the path of the slave,
+// which is given to CharlesGo through the --stm32-port flag.
+func openPTY() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("cannot unlock pty. %v", err)
+	}
+	ptyNumber, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("cannot get pty number. %v", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", ptyNumber), nil
+}
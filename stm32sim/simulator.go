@@ -0,0 +1,204 @@
+package main
+
+import (
+	"charles_communicator"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Simulator answers CharlesGo the way the STM32 firmware does, over any byte stream.
+type Simulator struct {
+	values           *valueScript
+	events           *valueScript
+	faults           *faultInjector
+	watchdogInterval time.Duration
+	tamperInterval   time.Duration
+	powerInterval    time.Duration
+	writeMutex       sync.Mutex
+	msgIdMutex       sync.Mutex
+	msgIdControl     uint16
+	settableCommands map[uint8]bool
+	// maxProtocolVersion is the highest version accepted in the handshake, with
+	// PROTOCOL_VERSION_ASCII the simulator behaves like the firmwares without handshake
+	maxProtocolVersion uint8
+	versionMutex       sync.Mutex
+	linkVersion        uint8
+	decoder            *charles_communicator.FrameDecoder
+}
+
+func NewSimulator(values, events *valueScript, faults *faultInjector) *Simulator {
+	return &Simulator{
+		values: values,
+		events: events,
+		faults: faults,
+		settableCommands: map[uint8]bool{
+			charles_communicator.MSG_CMD_SERIAL_NUMBER: true,
+			charles_communicator.MSG_CMD_BATCH_NUMBER:  true,
+			charles_communicator.MSG_CMD_ANATEL_NUMBER: true,
+			charles_communicator.MSG_CMD_OS_VERSION:    true,
+			charles_communicator.MSG_CMD_PCB_REV:       true,
+		},
+		maxProtocolVersion: charles_communicator.PROTOCOL_VERSION,
+	}
+}
+
+// Serve handles one connection until the stream fails.
+func (s *Simulator) Serve(stream io.ReadWriter) error {
+	done := make(chan struct{})
+	defer close(done)
+	s.setLinkVersion(charles_communicator.PROTOCOL_VERSION_ASCII)
+
+	s.schedule(done, stream, s.watchdogInterval, charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_GET_WATCHDOG)
+	s.schedule(done, stream, s.tamperInterval, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_TAMPER_EVENT)
+	s.schedule(done, stream, s.powerInterval, charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_POWER_SOURCE)
+
+	decoder := &charles_communicator.FrameDecoder{}
+	s.decoder = decoder
+	buf := make([]byte, 256)
+	for {
+		n, err := stream.Read(buf)
+		for _, b := range buf[:n] {
+			if message, complete := decoder.Feed(b); complete {
+				if message == nil {
+					Logger.Warnln("Discarding malformed frame")
+					continue
+				}
+				go s.handleMessage(stream, message)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Simulator) handleMessage(stream io.Writer, message *charles_communicator.CharlesMessage) {
+	Logger.Debugf("Received %s %s id=%d data=%q", charles_communicator.TypeToString(message.Type()),
+		charles_communicator.CommandToString(message.Command()), message.MessageId(), message.Data())
+
+	switch message.Type() {
+	case charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_TYPE_SET:
+	default:
+		// Answers to the requests started by the simulator
+		return
+	}
+
+	if message.Type() == charles_communicator.MSG_TYPE_GET && message.Command() == charles_communicator.MSG_CMD_PROTOCOL_VERSION {
+		s.negotiateProtocolVersion(stream, message)
+		return
+	}
+
+	if s.faults.shouldDrop() {
+		Logger.Infof("Dropping %s id=%d", charles_communicator.CommandToString(message.Command()), message.MessageId())
+		return
+	}
+	time.Sleep(s.faults.replyDelay())
+
+	if s.faults.shouldReplyError() {
+		s.reply(stream, message, charles_communicator.MSG_TYPE_ERROR, "simulated error")
+		return
+	}
+
+	if message.Type() == charles_communicator.MSG_TYPE_SET {
+		if s.settableCommands[message.Command()] {
+			s.values.set(message.Command(), message.Data())
+		}
+		s.reply(stream, message, charles_communicator.MSG_TYPE_RESP, "OK")
+		return
+	}
+
+	value, ok := s.values.next(message.Command())
+	if !ok {
+		s.reply(stream, message, charles_communicator.MSG_TYPE_ERROR, "unsupported command")
+		return
+	}
+	s.reply(stream, message, charles_communicator.MSG_TYPE_RESP, value)
+}
+
+func (s *Simulator) reply(stream io.Writer, request *charles_communicator.CharlesMessage, messageType uint8, data string) {
+	s.writeFrame(stream, request.Version(), messageType, request.Command(), request.MessageId(), data)
+}
+
+// negotiateProtocolVersion answers the handshake with the highest version supported by both sides
+// and uses it for the next frames.
+func (s *Simulator) negotiateProtocolVersion(stream io.Writer, request *charles_communicator.CharlesMessage) {
+	if s.maxProtocolVersion == charles_communicator.PROTOCOL_VERSION_ASCII {
+		s.reply(stream, request, charles_communicator.MSG_TYPE_ERROR, "unsupported command")
+		return
+	}
+	offeredVersion, err := strconv.Atoi(request.Data())
+	if err != nil || offeredVersion < charles_communicator.PROTOCOL_VERSION_ASCII {
+		s.reply(stream, request, charles_communicator.MSG_TYPE_ERROR, "invalid version")
+		return
+	}
+	version := min(uint8(min(offeredVersion, 255)), s.maxProtocolVersion)
+	// The handler may use the new version as soon as it reads the answer
+	s.decoder.SetBinaryFraming(version >= charles_communicator.PROTOCOL_VERSION_BINARY)
+	s.reply(stream, request, charles_communicator.MSG_TYPE_RESP, strconv.Itoa(int(version)))
+	s.setLinkVersion(version)
+	Logger.Infof("Using protocol version %d", version)
+}
+
+func (s *Simulator) setLinkVersion(version uint8) {
+	s.versionMutex.Lock()
+	defer s.versionMutex.Unlock()
+	s.linkVersion = version
+}
+
+func (s *Simulator) getLinkVersion() uint8 {
+	s.versionMutex.Lock()
+	defer s.versionMutex.Unlock()
+	return s.linkVersion
+}
+
+// schedule sends an unsolicited request every interval until done is closed.
+// A zero interval disables it.
+func (s *Simulator) schedule(done chan struct{}, stream io.Writer, interval time.Duration, messageType, command uint8) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				data, _ := s.events.next(command)
+				s.writeFrame(stream, s.getLinkVersion(), messageType, command, s.requestMessageId(), data)
+			}
+		}
+	}()
+}
+
+// requestMessageId returns even ids, CharlesGo uses the odd ones.
+func (s *Simulator) requestMessageId() uint16 {
+	s.msgIdMutex.Lock()
+	defer s.msgIdMutex.Unlock()
+	s.msgIdControl++
+	return 2 * s.msgIdControl
+}
+
+func (s *Simulator) writeFrame(stream io.Writer, version, messageType, command uint8, messageId uint16, data string) {
+	frame, err := charles_communicator.EncodeFrame(version, messageType, command, messageId, data)
+	if err != nil {
+		Logger.Errorln("Cannot encode frame:", err)
+		return
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if noise := s.faults.garbage(); noise != nil {
+		Logger.Infof("Writing %d garbage bytes", len(noise))
+		stream.Write(noise)
+	}
+	if _, err := stream.Write([]byte(frame)); err != nil {
+		Logger.Errorln("Cannot write frame:", err)
+		return
+	}
+	Logger.Debugf("Sent %q", frame)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"charles_communicator"
+	"initializer"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSimulator(t *testing.T, simulator *Simulator) *charles_communicator.CharlesCommunicatorHandler {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		simulator.Serve(conn)
+	}()
+
+	initializer.LoadConfig("")
+	handler := charles_communicator.NewCharlesCommunicatorHandler(charles_communicator.NewTCPTransport(listener.Addr().String()))
+	if !handler.OpenPort() {
+		t.Fatalf("Cannot connect to simulator")
+	}
+	go handler.Start()
+	t.Cleanup(handler.Stop)
+	return handler
+}
+
+func waitForBinaryProtocol(t *testing.T, handler *charles_communicator.CharlesCommunicatorHandler) {
+	deadline := time.Now().Add(2 * time.Second)
+	for handler.ProtocolVersion() != charles_communicator.PROTOCOL_VERSION_BINARY {
+		if time.Now().After(deadline) {
+			t.Fatalf("Protocol version 1 not negotiated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSimulatorAnswersScriptedValues(t *testing.T) {
+	values := newValueScript(map[uint8][]string{charles_communicator.MSG_CMD_MODEM_SIGNAL: {"-70", "-90"}})
+	handler := startSimulator(t, NewSimulator(values, newValueScript(nil), newFaultInjector(1)))
+
+	for _, expected := range []string{"-70", "-90", "-70"} {
+		data, err := handler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_MODEM_SIGNAL, "", 2000)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if data != expected {
+			t.Errorf("Expected %s, got: %s", expected, data)
+		}
+	}
+}
+
+func TestSimulatorStoresSetValues(t *testing.T) {
+	handler := startSimulator(t, NewSimulator(newValueScript(defaultValues), newValueScript(nil), newFaultInjector(1)))
+
+	if _, err := handler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_SERIAL_NUMBER, "AA-BB", 2000); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	data, err := handler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_SERIAL_NUMBER, "", 2000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != "AA-BB" {
+		t.Errorf("Expected AA-BB, got: %s", data)
+	}
+}
+
+func TestSimulatorInjectsErrors(t *testing.T) {
+	faults := newFaultInjector(1)
+	faults.errorRate = 1
+	handler := startSimulator(t, NewSimulator(newValueScript(defaultValues), newValueScript(nil), faults))
+
+	_, err := handler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_BATTERY_LEVEL, "", 2000)
+	if err == nil || err.Error() != "simulated error" {
+		t.Errorf("Expected simulated error, got: %v", err)
+	}
+}
+
+func TestSimulatorNegotiatesBinaryFrames(t *testing.T) {
+	handler := startSimulator(t, NewSimulator(newValueScript(defaultValues), newValueScript(nil), newFaultInjector(1)))
+
+	waitForBinaryProtocol(t, handler)
+
+	if _, err := handler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_SERIAL_NUMBER, "AA:BB;[CC]", 2000); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	data, err := handler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_SERIAL_NUMBER, "", 2000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != "AA:BB;[CC]" {
+		t.Errorf("Expected AA:BB;[CC], got: %s", data)
+	}
+}
+
+func TestSimulatorWithoutHandshakeKeepsAsciiFrames(t *testing.T) {
+	simulator := NewSimulator(newValueScript(defaultValues), newValueScript(nil), newFaultInjector(1))
+	simulator.maxProtocolVersion = charles_communicator.PROTOCOL_VERSION_ASCII
+	handler := startSimulator(t, simulator)
+
+	if _, err := handler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_PCB_REV, "", 2000); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if version := handler.ProtocolVersion(); version != charles_communicator.PROTOCOL_VERSION_ASCII {
+		t.Errorf("Expected protocol version 0, got: %d", version)
+	}
+}
+
+func TestSimulatorExchangesFragmentedMessages(t *testing.T) {
+	handler := startSimulator(t, NewSimulator(newValueScript(defaultValues), newValueScript(nil), newFaultInjector(1)))
+	handler.SetPacingInterval(0)
+
+	waitForBinaryProtocol(t, handler)
+
+	expected := strings.Repeat("0123456789", 200)
+	if _, err := handler.SendMessage(charles_communicator.MSG_TYPE_SET, charles_communicator.MSG_CMD_OS_VERSION, expected, 2000); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	data, err := handler.SendMessage(charles_communicator.MSG_TYPE_GET, charles_communicator.MSG_CMD_OS_VERSION, "", 2000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if data != expected {
+		t.Errorf("Expected the %d bytes set, got %d bytes", len(expected), len(data))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"charles_communicator"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// simulatorConfig is the optional JSON file loaded with the -values flag. Each command name
+// (as returned by charles_communicator.CommandToString) maps to a list of values: a single
+// value is answered forever, several values are answered in order, restarting at the end.
+//
+//	{
+//	  "values": {"MODEM_SIGNAL": ["-71", "-95"], "STM32_TEMPERATURE": ["36.5"]},
+//	  "events": {"TAMPER_EVENT": ["Open", "Close"]}
+//	}
+type simulatorConfig struct {
+	Values map[string][]string `json:"values"`
+	Events map[string][]string `json:"events"`
+}
+
+var defaultValues = map[uint8][]string{
+	charles_communicator.MSG_CMD_SIM_TYPE:          {"physical"},
+	charles_communicator.MSG_CMD_SIM_ICCID:         {"89550000000000000000"},
+	charles_communicator.MSG_CMD_SIM_CARRIER:       {"VIVO"},
+	charles_communicator.MSG_CMD_MODEM_SIGNAL:      {"-71"},
+	charles_communicator.MSG_CMD_SERIAL_NUMBER:     {"00:00:00:00:00:00"},
+	charles_communicator.MSG_CMD_BATCH_NUMBER:      {"1"},
+	charles_communicator.MSG_CMD_ANATEL_NUMBER:     {"000000000000"},
+	charles_communicator.MSG_CMD_OS_VERSION:        {""},
+	charles_communicator.MSG_CMD_FIRMWARE_VERSION:  {"simulator"},
+	charles_communicator.MSG_CMD_IS_UPGRADING:      {"0"},
+	charles_communicator.MSG_CMD_PCB_REV:           {"1"},
+	charles_communicator.MSG_CMD_HAS_BMS:           {"1"},
+	charles_communicator.MSG_CMD_POWER_SOURCE:      {"AC"},
+	charles_communicator.MSG_CMD_STM32_TEMPERATURE: {"36.5"},
+	charles_communicator.MSG_CMD_BATTERY_LEVEL:     {"100"},
+	charles_communicator.MSG_CMD_MODEM_CONN_TYPE:   {"LTE"},
+	charles_communicator.MSG_CMD_MODEM_CONN_BAND:   {"B3"},
+}
+
+var defaultEvents = map[uint8][]string{
+	charles_communicator.MSG_CMD_TAMPER_EVENT: {"Open", "Close"},
+	charles_communicator.MSG_CMD_POWER_SOURCE: {"AC", "BATTERY"},
+}
+
+// valueScript keeps the values answered for each command and the position of the next one.
+type valueScript struct {
+	mutex     sync.Mutex
+	values    map[uint8][]string
+	positions map[uint8]int
+}
+
+func newValueScript(values map[uint8][]string) *valueScript {
+	script := &valueScript{values: make(map[uint8][]string), positions: make(map[uint8]int)}
+	for command, commandValues := range values {
+		script.values[command] = append([]string{}, commandValues...)
+	}
+	return script
+}
+
+// next returns the next value for the command and false if the command has no value.
+func (s *valueScript) next(command uint8) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	commandValues := s.values[command]
+	if len(commandValues) == 0 {
+		return "", false
+	}
+	position := s.positions[command] % len(commandValues)
+	s.positions[command] = position + 1
+	return commandValues[position], true
+}
+
+// set replaces the values of a command, the way the STM32 stores what CharlesGo writes to it.
+func (s *valueScript) set(command uint8, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.values[command] = []string{value}
+	s.positions[command] = 0
+}
+
+func loadSimulatorConfig(path string) (*valueScript, *valueScript, error) {
+	values := newValueScript(defaultValues)
+	events := newValueScript(defaultEvents)
+	if path == "" {
+		return values, events, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config simulatorConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode %s. %v", path, err)
+	}
+
+	for name, commandValues := range config.Values {
+		command, err := commandFromName(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		values.values[command] = commandValues
+	}
+	for name, commandValues := range config.Events {
+		command, err := commandFromName(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		events.values[command] = commandValues
+	}
+	return values, events, nil
+}
+
+// commandFromName accepts a command name or its numeric id.
+func commandFromName(name string) (uint8, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 && id <= 255 {
+		return uint8(id), nil
+	}
+	for id := 0; id <= 255; id++ {
+		if charles_communicator.CommandToString(uint8(id)) == name {
+			return uint8(id), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown command %s", name)
+}
@@ -0,0 +1,322 @@
+package updater
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"event_control"
+	"fmt"
+	"initializer"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DOWNLOAD_CHUNK_SIZE is the granularity at which a partial download is verified and resumed
+	DOWNLOAD_CHUNK_SIZE = 256 * 1024
+	// DOWNLOAD_MAX_FAILURES is the number of consecutive attempts without progress before a
+	// download is given up
+	DOWNLOAD_MAX_FAILURES        = 5
+	DOWNLOAD_RETRY_INITIAL_DELAY = 5 * time.Second
+	DOWNLOAD_RETRY_MAX_DELAY     = 2 * time.Minute
+	DOWNLOAD_PROGRESS_INTERVAL   = 10 * time.Second
+)
+
+const (
+	// PART_SUFFIX is appended to the local path of a download in progress
+	PART_SUFFIX = ".part"
+	// MANIFEST_SUFFIX is appended to the path of the partial file for its progress manifest
+	MANIFEST_SUFFIX = ".json"
+)
+
+const (
+	DOWNLOAD_STATE_DOWNLOADING = "downloading"
+	DOWNLOAD_STATE_RETRYING    = "retrying"
+	DOWNLOAD_STATE_COMPLETED   = "completed"
+	DOWNLOAD_STATE_FAILED      = "failed"
+)
+
+// DownloadProgress is published through the download progress event. Percent is -1 when the
+// size of the artifact is unknown.
+type DownloadProgress struct {
+	File           string  `json:"file"`
+	State          string  `json:"state"`
+	Bytes          int64   `json:"bytes"`
+	Size           int64   `json:"size"`
+	Percent        float64 `json:"percent"`
+	BytesPerSecond int64   `json:"bytes_per_second"`
+}
+
+// downloadManifest records the verified part of a download: the SHA-256 of each complete chunk
+// written to the partial file, for the version ETag of the artifact.
+type downloadManifest struct {
+	Source     string   `json:"source"`
+	RemotePath string   `json:"remote_path"`
+	ETag       string   `json:"etag"`
+	Size       int64    `json:"size"`
+	ChunkSize  int64    `json:"chunk_size"`
+	Chunks     []string `json:"chunks"`
+}
+
+func (m *downloadManifest) verifiedSize() int64 {
+	return int64(len(m.Chunks)) * m.ChunkSize
+}
+
+// downloader downloads artifacts from source, keeping a partial file and its manifest so that a
+// download interrupted by a lost connection or a restart resumes from its last verified chunk.
+type downloader struct {
+	source            ArtifactSource
+	chunkSize         int64
+	maxBytesPerSecond int64
+	maxFailures       int
+	retryDelay        time.Duration
+	maxRetryDelay     time.Duration
+	progressInterval  time.Duration
+	progress          func(DownloadProgress)
+	lastProgress      time.Time
+}
+
+var downloadProgressEventId int
+
+// GetDownloadProgressEventId is the event fired with the JSON DownloadProgress of the updater
+// downloads, at most every DOWNLOAD_PROGRESS_INTERVAL while downloading.
+func GetDownloadProgressEventId() int {
+	if downloadProgressEventId == 0 {
+		downloadProgressEventId = event_control.CreateEventId()
+	}
+	return downloadProgressEventId
+}
+
+// downloadArtifact downloads remotePath from the artifact source of the updater to localPath.
+func downloadArtifact(ctx context.Context, remotePath, localPath string) error {
+	d := &downloader{
+		source:            Handler.source,
+		chunkSize:         DOWNLOAD_CHUNK_SIZE,
+		maxBytesPerSecond: int64(initializer.GetUpdateMaxDownloadKBps()) * 1024,
+		maxFailures:       DOWNLOAD_MAX_FAILURES,
+		retryDelay:        DOWNLOAD_RETRY_INITIAL_DELAY,
+		maxRetryDelay:     DOWNLOAD_RETRY_MAX_DELAY,
+		progressInterval:  DOWNLOAD_PROGRESS_INTERVAL,
+		progress:          publishDownloadProgress,
+	}
+	return d.download(ctx, remotePath, localPath)
+}
+
+func publishDownloadProgress(progress DownloadProgress) {
+	message, err := json.Marshal(progress)
+	if err != nil {
+		Logger.Errorln("Cannot encode the download progress:", err)
+		return
+	}
+	event_control.CallRegisteredEventFunctions(GetDownloadProgressEventId(), 0, 0, string(message))
+}
+
+// download retries, with a doubling delay, until the artifact is complete in localPath or
+// maxFailures consecutive attempts made no progress.
+func (d *downloader) download(ctx context.Context, remotePath, localPath string) error {
+	partPath := localPath + PART_SUFFIX
+	manifest := d.resume(remotePath, partPath)
+	delay := d.retryDelay
+	failures := 0
+	for {
+		progressed, err := d.fetch(ctx, manifest, partPath, localPath)
+		if err == nil {
+			break
+		}
+		if progressed {
+			failures, delay = 0, d.retryDelay
+		} else {
+			failures++
+		}
+		if ctx.Err() != nil || failures >= d.maxFailures || errors.Is(err, ErrHostKeyMismatch) || errors.Is(err, ErrHostKeyNotPinned) || errors.Is(err, ErrSourceUnavailable) {
+			d.report(localPath, DOWNLOAD_STATE_FAILED, manifest.verifiedSize(), manifest.Size, 0, true)
+			return fmt.Errorf("download of %s failed: %w", remotePath, err)
+		}
+		Logger.Warnf("Download of %s interrupted at %d bytes, retrying in %s: %v", remotePath, manifest.verifiedSize(), delay, err)
+		d.report(localPath, DOWNLOAD_STATE_RETRYING, manifest.verifiedSize(), manifest.Size, 0, true)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			d.report(localPath, DOWNLOAD_STATE_FAILED, manifest.verifiedSize(), manifest.Size, 0, true)
+			return ctx.Err()
+		}
+		delay = min(delay*2, d.maxRetryDelay)
+	}
+
+	if err := os.Rename(partPath, localPath); err != nil {
+		return err
+	}
+	removeFile(partPath + MANIFEST_SUFFIX)
+	Logger.Infof("Download of %s completed.", localPath)
+	return nil
+}
+
+// resume loads the manifest of a previous download of remotePath and keeps the chunks of the
+// partial file that still match it.
+func (d *downloader) resume(remotePath, partPath string) *downloadManifest {
+	fresh := &downloadManifest{Source: d.source.Name(), RemotePath: remotePath, Size: -1, ChunkSize: d.chunkSize}
+	data, err := os.ReadFile(partPath + MANIFEST_SUFFIX)
+	if err != nil {
+		return fresh
+	}
+	var manifest downloadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Source != fresh.Source ||
+		manifest.RemotePath != remotePath || manifest.ChunkSize != d.chunkSize {
+		return fresh
+	}
+	file, err := os.Open(partPath)
+	if err != nil {
+		return fresh
+	}
+	defer file.Close()
+
+	buffer := make([]byte, manifest.ChunkSize)
+	for i, expected := range manifest.Chunks {
+		if _, err := io.ReadFull(file, buffer); err != nil || chunkSum(buffer) != expected {
+			Logger.Warnf("Partial download %s differs from its manifest at chunk %d", partPath, i)
+			manifest.Chunks = manifest.Chunks[:i]
+			break
+		}
+	}
+	if len(manifest.Chunks) > 0 {
+		Logger.Infof("Resuming the download of %s at %d bytes", remotePath, manifest.verifiedSize())
+	}
+	return &manifest
+}
+
+// fetch downloads the artifact from the end of the verified chunks into the partial file. It
+// tells whether a chunk was verified, even when it fails.
+func (d *downloader) fetch(ctx context.Context, manifest *downloadManifest, partPath, localPath string) (bool, error) {
+	offset := manifest.verifiedSize()
+	if offset > 0 && offset == manifest.Size {
+		return false, os.Truncate(partPath, offset)
+	}
+	artifact, err := d.source.Open(ctx, manifest.RemotePath, offset, manifest.ETag)
+	if err != nil {
+		return false, err
+	}
+	defer artifact.Body.Close()
+	if artifact.Offset != offset {
+		if artifact.Offset != 0 {
+			return false, fmt.Errorf("%s returned offset %d instead of %d", d.source.Name(), artifact.Offset, offset)
+		}
+		Logger.Infof("%s changed, downloading it from the start", manifest.RemotePath)
+		manifest.Chunks, offset = nil, 0
+	}
+	manifest.ETag, manifest.Size = artifact.ETag, artifact.Size
+
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("failed to create local file: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(offset); err != nil {
+		return false, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := saveManifest(manifest, partPath+MANIFEST_SUFFIX); err != nil {
+		return false, err
+	}
+
+	var reader io.Reader = artifact.Body
+	if d.maxBytesPerSecond > 0 {
+		reader = &throttledReader{ctx: ctx, reader: reader, bytesPerSecond: d.maxBytesPerSecond, start: time.Now()}
+	}
+	start, written, progressed := time.Now(), offset, false
+	buffer := make([]byte, manifest.ChunkSize)
+	for {
+		n, readErr := io.ReadFull(reader, buffer)
+		if n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return progressed, err
+			}
+			written += int64(n)
+			if int64(n) == manifest.ChunkSize {
+				if err := file.Sync(); err != nil {
+					return progressed, err
+				}
+				manifest.Chunks = append(manifest.Chunks, chunkSum(buffer))
+				if err := saveManifest(manifest, partPath+MANIFEST_SUFFIX); err != nil {
+					return progressed, err
+				}
+				progressed = true
+			}
+			bytesPerSecond := int64(float64(written-offset) / max(time.Since(start).Seconds(), 0.001))
+			d.report(localPath, DOWNLOAD_STATE_DOWNLOADING, written, manifest.Size, bytesPerSecond, false)
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return progressed, fmt.Errorf("download error: %w", readErr)
+		}
+	}
+	if manifest.Size >= 0 && written != manifest.Size {
+		return progressed, fmt.Errorf("incomplete download: expected %d bytes, got %d bytes", manifest.Size, written)
+	}
+	d.report(localPath, DOWNLOAD_STATE_COMPLETED, written, manifest.Size, 0, true)
+	return progressed, file.Sync()
+}
+
+// report publishes the progress, at most every progressInterval unless forced.
+func (d *downloader) report(localPath, state string, bytes, size, bytesPerSecond int64, force bool) {
+	if !force && time.Since(d.lastProgress) < d.progressInterval {
+		return
+	}
+	d.lastProgress = time.Now()
+	percent := -1.0
+	if size > 0 {
+		percent = float64(bytes) / float64(size) * 100
+	}
+	d.progress(DownloadProgress{File: filepath.Base(localPath), State: state, Bytes: bytes, Size: size, Percent: percent, BytesPerSecond: bytesPerSecond})
+}
+
+func saveManifest(manifest *downloadManifest, path string) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	temporaryPath := path + ".tmp"
+	if err := os.WriteFile(temporaryPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
+
+func chunkSum(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+// throttledReader limits the average rate of reader to bytesPerSecond.
+type throttledReader struct {
+	ctx            context.Context
+	reader         io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the rate even within a chunk
+	if limit := max(r.bytesPerSecond/10, 1); int64(len(p)) > limit {
+		p = p[:limit]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	expected := time.Duration(float64(r.read) / float64(r.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Since(r.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
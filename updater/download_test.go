@@ -0,0 +1,191 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testChunkSize = 1000
+
+// fakeSource serves content. The body returned by the n-th Open fails after failAfter[n] bytes,
+// when set, and the offsets requested are recorded.
+type fakeSource struct {
+	content   []byte
+	etag      string
+	failAfter []int
+	offsets   []int64
+}
+
+var errConnectionLost = errors.New("connection lost")
+
+func (f *fakeSource) Name() string {
+	return "fake"
+}
+
+func (f *fakeSource) Open(ctx context.Context, remotePath string, offset int64, etag string) (*Artifact, error) {
+	f.offsets = append(f.offsets, offset)
+	if etag != f.etag {
+		offset = 0
+	}
+	var body io.Reader = bytes.NewReader(f.content[offset:])
+	if call := len(f.offsets) - 1; call < len(f.failAfter) {
+		body = io.MultiReader(io.LimitReader(body, int64(f.failAfter[call])), &failingReader{})
+	}
+	return &Artifact{Body: io.NopCloser(body), Offset: offset, Size: int64(len(f.content)), ETag: f.etag}, nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errConnectionLost
+}
+
+// progressRecorder keeps the states of the reported progress.
+type progressRecorder struct {
+	mutex  sync.Mutex
+	states []string
+}
+
+func (p *progressRecorder) record(progress DownloadProgress) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.states = append(p.states, progress.State)
+}
+
+func newTestDownloader(source ArtifactSource) *downloader {
+	return &downloader{
+		source:           source,
+		chunkSize:        testChunkSize,
+		maxFailures:      3,
+		retryDelay:       time.Millisecond,
+		maxRetryDelay:    time.Millisecond,
+		progressInterval: time.Hour,
+		progress:         func(DownloadProgress) {},
+	}
+}
+
+// writePartialDownload leaves the first chunks of content and their manifest, as an
+// interrupted download of remotePath would.
+func writePartialDownload(t *testing.T, d *downloader, localPath, remotePath string, content []byte, chunks int, etag string) {
+	t.Helper()
+	manifest := &downloadManifest{Source: d.source.Name(), RemotePath: remotePath, ETag: etag, Size: int64(len(content)), ChunkSize: d.chunkSize}
+	for i := 0; i < chunks; i++ {
+		manifest.Chunks = append(manifest.Chunks, chunkSum(content[int64(i)*d.chunkSize:int64(i+1)*d.chunkSize]))
+	}
+	if err := os.WriteFile(localPath+PART_SUFFIX, content[:int64(chunks)*d.chunkSize], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveManifest(manifest, localPath+PART_SUFFIX+MANIFEST_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadResumesAfterConnectionLost(t *testing.T) {
+	source := &fakeSource{content: bytes.Repeat([]byte("0123456789"), 550), etag: "v1", failAfter: []int{2500, 2500}}
+	recorder := &progressRecorder{}
+	d := newTestDownloader(source)
+	d.progress = recorder.record
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+
+	if err := d.download(context.Background(), "firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, source.content) {
+		t.Errorf("Downloaded content differs")
+	}
+	// The bytes of the incomplete chunk are downloaded again
+	if len(source.offsets) != 3 || source.offsets[1] != 2000 || source.offsets[2] != 4000 {
+		t.Errorf("Expected to resume at 2000 and 4000, got: %v", source.offsets)
+	}
+	for _, path := range []string{localPath + PART_SUFFIX, localPath + PART_SUFFIX + MANIFEST_SUFFIX} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s removed, got: %v", path, err)
+		}
+	}
+	retries := 0
+	for _, state := range recorder.states {
+		if state == DOWNLOAD_STATE_RETRYING {
+			retries++
+		}
+	}
+	if retries != 2 || recorder.states[len(recorder.states)-1] != DOWNLOAD_STATE_COMPLETED {
+		t.Errorf("Expected 2 retries then completed, got: %v", recorder.states)
+	}
+}
+
+func TestDownloadResumesAfterRestart(t *testing.T) {
+	source := &fakeSource{content: bytes.Repeat([]byte("0123456789"), 500), etag: "v1", failAfter: []int{3500, 0}}
+	d := newTestDownloader(source)
+	d.maxFailures = 1
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+
+	if err := d.download(context.Background(), "firmware.bin", localPath); !errors.Is(err, errConnectionLost) {
+		t.Fatalf("Expected the download to fail, got: %v", err)
+	}
+	restarted := newTestDownloader(source)
+	if err := restarted.download(context.Background(), "firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(source.offsets) != 3 || source.offsets[2] != 3000 {
+		t.Errorf("Expected to resume at 3000 after the restart, got: %v", source.offsets)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, source.content) {
+		t.Errorf("Downloaded content differs")
+	}
+}
+
+func TestDownloadDiscardsCorruptedChunks(t *testing.T) {
+	source := &fakeSource{content: bytes.Repeat([]byte("0123456789"), 500), etag: "v1"}
+	d := newTestDownloader(source)
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+	writePartialDownload(t, d, localPath, "firmware.bin", source.content, 4, "v1")
+	partial, _ := os.ReadFile(localPath + PART_SUFFIX)
+	partial[2500] = 'x'
+	os.WriteFile(localPath+PART_SUFFIX, partial, 0o644)
+
+	if err := d.download(context.Background(), "firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(source.offsets) != 1 || source.offsets[0] != 2000 {
+		t.Errorf("Expected to resume at the corrupted chunk, got: %v", source.offsets)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, source.content) {
+		t.Errorf("Downloaded content differs")
+	}
+}
+
+func TestDownloadGivesUpWithoutProgress(t *testing.T) {
+	source := &fakeSource{content: bytes.Repeat([]byte("0123456789"), 500), etag: "v1", failAfter: []int{1500, 100, 100, 100, 100}}
+	d := newTestDownloader(source)
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+
+	if err := d.download(context.Background(), "firmware.bin", localPath); !errors.Is(err, errConnectionLost) {
+		t.Fatalf("Expected the download to fail, got: %v", err)
+	}
+	// The first attempt verified a chunk, the next 3 made no progress
+	if len(source.offsets) != 4 {
+		t.Errorf("Expected 4 attempts, got: %v", source.offsets)
+	}
+}
+
+func TestDownloadBandwidthLimit(t *testing.T) {
+	source := &fakeSource{content: bytes.Repeat([]byte("0123456789"), 300), etag: "v1"}
+	d := newTestDownloader(source)
+	d.maxBytesPerSecond = 20000
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+
+	start := time.Now()
+	if err := d.download(context.Background(), "firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("Expected 3000 bytes at 20000 B/s to take 150ms, took %s", elapsed)
+	}
+}
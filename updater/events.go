@@ -1,11 +1,20 @@
 package updater
 
 import (
+	"encoding/json"
 	"event_control"
 )
 
+// HostKeyMismatch is published when the SFTP server presents a host key that is not pinned.
+type HostKeyMismatch struct {
+	Host        string `json:"host"`
+	KeyType     string `json:"key_type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
 var hlk7628UpdateEventId int
 var stm32UpdateEventId int
+var hostKeyMismatchEventId int
 
 func GetHLK7628UpdateEventId() int {
 	if hlk7628UpdateEventId == 0 {
@@ -28,3 +37,18 @@ func callSTM32Events(message string) {
 func callHLK7628Events(message string) {
 	event_control.CallRegisteredEventFunctions(GetHLK7628UpdateEventId(), 0, 0, message)
 }
+
+func GetHostKeyMismatchEventId() int {
+	if hostKeyMismatchEventId == 0 {
+		hostKeyMismatchEventId = event_control.CreateEventId()
+	}
+	return hostKeyMismatchEventId
+}
+
+func callHostKeyMismatchEvents(mismatch HostKeyMismatch) {
+	message, err := json.Marshal(mismatch)
+	if err != nil {
+		return
+	}
+	event_control.CallRegisteredEventFunctions(GetHostKeyMismatchEventId(), 0, 0, string(message))
+}
@@ -5,15 +5,12 @@ go 1.21.1
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/pkg/sftp v1.13.6
-	github.com/tidwall/gjson v1.17.0
 	golang.org/x/crypto v0.16.0
 )
 
 require (
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/kr/fs v0.1.0 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
-	github.com/tidwall/pretty v1.2.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
@@ -0,0 +1,150 @@
+package updater
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"initializer"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPS_RESPONSE_TIMEOUT bounds the wait for the response headers, not the download itself
+const HTTPS_RESPONSE_TIMEOUT = 30 * time.Second
+
+var ErrUnexpectedStatus = errors.New("unexpected HTTP status")
+
+// httpsSource reads the artifacts below baseURL, from a CDN or an S3-compatible bucket. An
+// offset is requested with a range request conditioned on the ETag with If-Range.
+type httpsSource struct {
+	baseURL *url.URL
+	token   string
+	client  *http.Client
+}
+
+// newHTTPSSource returns a source downloading from baseURL with the client. token, when not
+// empty, is sent as a bearer token, so baseURL and the redirects must be https.
+func newHTTPSSource(baseURL, token string, client *http.Client) (*httpsSource, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" {
+		return nil, fmt.Errorf("invalid artifact URL %q, https is required", baseURL)
+	}
+	httpsOnly := *client
+	httpsOnly.CheckRedirect = func(request *http.Request, via []*http.Request) error {
+		if request.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %q refused, https is required", request.URL.Redacted())
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(request, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &httpsSource{baseURL: parsed, token: token, client: &httpsOnly}, nil
+}
+
+// newHTTPSSourceFromConfig returns a source trusting the CA of [UPDATE] HTTPS_CA_FILE, or the
+// system CAs, and authenticating with the client certificate of HTTPS_CLIENT_CERT and
+// HTTPS_CLIENT_KEY when they are set.
+func newHTTPSSourceFromConfig(baseURL, token string) (*httpsSource, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := initializer.GetUpdateHTTPSCAFile(); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile, keyFile := initializer.GetUpdateHTTPSClientCert(), initializer.GetUpdateHTTPSClientKey()
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = HTTPS_RESPONSE_TIMEOUT
+	return newHTTPSSource(baseURL, token, &http.Client{Transport: transport})
+}
+
+func (s *httpsSource) Name() string {
+	return SOURCE_HTTPS
+}
+
+func (s *httpsSource) url(remotePath string) string {
+	artifactURL := *s.baseURL
+	artifactURL.Path = path.Join("/", s.baseURL.Path, remotePath)
+	return artifactURL.String()
+}
+
+// Open requests the artifact from offset when etag is a strong ETag, the whole artifact
+// otherwise. A weak ETag is not returned since it cannot be used with If-Range.
+func (s *httpsSource) Open(ctx context.Context, remotePath string, offset int64, etag string) (*Artifact, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(remotePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		request.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if offset > 0 && etag != "" {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", etag)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	artifact := &Artifact{Body: response.Body, Size: response.ContentLength}
+	if etag := response.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		artifact.ETag = etag
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return artifact, nil
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			response.Body.Close()
+			return nil, fmt.Errorf("invalid Content-Range %q for offset %d", response.Header.Get("Content-Range"), offset)
+		}
+		artifact.Offset, artifact.Size = start, total
+		return artifact, nil
+	default:
+		response.Body.Close()
+		return nil, fmt.Errorf("%w %s for %s", ErrUnexpectedStatus, response.Status, remotePath)
+	}
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total>".
+func parseContentRange(contentRange string) (start, total int64, err error) {
+	var end int64
+	var totalString string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &totalString); err != nil {
+		return 0, 0, err
+	}
+	if totalString == "*" {
+		return start, -1, nil
+	}
+	total, err = strconv.ParseInt(totalString, 10, 64)
+	return start, total, err
+}
@@ -0,0 +1,144 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// artifactServer serves content at /artifacts/stm32/firmware.bin with etag, and records the
+// Range header of the requests.
+type artifactServer struct {
+	content []byte
+	etag    string
+	ranges  []string
+}
+
+func (a *artifactServer) start(t *testing.T) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/artifacts/stm32/firmware.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		a.ranges = append(a.ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", a.etag)
+		http.ServeContent(w, r, "firmware.bin", time.Time{}, bytes.NewReader(a.content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestSource(t *testing.T, server *httptest.Server, token string) *httpsSource {
+	source, err := newHTTPSSource(server.URL+"/artifacts", token, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestHTTPSSourceDownload(t *testing.T) {
+	artifacts := &artifactServer{content: bytes.Repeat([]byte("firmware"), 1000), etag: `"v1"`}
+	d := newTestDownloader(newTestSource(t, artifacts.start(t), "secret"))
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+
+	if err := d.download(context.Background(), "stm32/firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, artifacts.content) {
+		t.Errorf("Downloaded %d bytes, expected %d", len(data), len(artifacts.content))
+	}
+}
+
+func TestHTTPSSourceResumesWithSameETag(t *testing.T) {
+	artifacts := &artifactServer{content: bytes.Repeat([]byte("firmware"), 1000), etag: `"v1"`}
+	d := newTestDownloader(newTestSource(t, artifacts.start(t), "secret"))
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+	writePartialDownload(t, d, localPath, "stm32/firmware.bin", artifacts.content, 3, `"v1"`)
+
+	if err := d.download(context.Background(), "stm32/firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(artifacts.ranges) != 1 || artifacts.ranges[0] != "bytes=3000-" {
+		t.Errorf("Expected a range request from 3000, got: %q", artifacts.ranges)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, artifacts.content) {
+		t.Errorf("Resumed download differs from the artifact")
+	}
+}
+
+func TestHTTPSSourceRestartsChangedArtifact(t *testing.T) {
+	artifacts := &artifactServer{content: bytes.Repeat([]byte("new firmware"), 500), etag: `"v2"`}
+	d := newTestDownloader(newTestSource(t, artifacts.start(t), "secret"))
+	localPath := filepath.Join(t.TempDir(), "firmware.bin")
+	writePartialDownload(t, d, localPath, "stm32/firmware.bin", bytes.Repeat([]byte("x"), 8000), 3, `"v1"`)
+
+	if err := d.download(context.Background(), "stm32/firmware.bin", localPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, artifacts.content) {
+		t.Errorf("Expected the changed artifact downloaded from the start")
+	}
+}
+
+func TestHTTPSSourceErrors(t *testing.T) {
+	artifacts := &artifactServer{content: []byte("firmware"), etag: `"v1"`}
+	server := artifacts.start(t)
+
+	_, err := newTestSource(t, server, "wrong").Open(context.Background(), "stm32/firmware.bin", 0, "")
+	if !errors.Is(err, ErrUnexpectedStatus) || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a 401 error, got: %v", err)
+	}
+	_, err = newTestSource(t, server, "secret").Open(context.Background(), "stm32/missing.bin", 0, "")
+	if !errors.Is(err, ErrUnexpectedStatus) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected a 404 error, got: %v", err)
+	}
+	for _, baseURL := range []string{"ftp://example.com", "http://example.com"} {
+		if _, err := newHTTPSSource(baseURL, "", http.DefaultClient); err == nil {
+			t.Errorf("Expected an invalid URL error for %s", baseURL)
+		}
+	}
+}
+
+func TestHTTPSSourceRefusesRedirectToHTTP(t *testing.T) {
+	var leaked bool
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Authorization") != ""
+	}))
+	defer plain.Close()
+	server := httptest.NewTLSServer(http.RedirectHandler(plain.URL+"/artifacts/stm32/firmware.bin", http.StatusFound))
+	defer server.Close()
+
+	source, err := newHTTPSSource(server.URL+"/artifacts", "secret", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Open(context.Background(), "stm32/firmware.bin", 0, ""); err == nil {
+		t.Errorf("Expected the redirect to http to be refused")
+	}
+	if leaked {
+		t.Errorf("Expected the token not sent in cleartext")
+	}
+}
+
+func TestInvalidHTTPSSourceRefusesDownloads(t *testing.T) {
+	source := artifactSource(SOURCE_HTTPS, "http://example.com/artifacts", "secret")
+	if _, isSFTP := source.(*sftpSource); isSFTP || source.Name() != SOURCE_HTTPS {
+		t.Fatalf("Expected the HTTPS source kept, got: %s", source.Name())
+	}
+	d := newTestDownloader(source)
+	err := d.download(context.Background(), "stm32/firmware.bin", filepath.Join(t.TempDir(), "firmware.bin"))
+	if !errors.Is(err, ErrSourceUnavailable) || !strings.Contains(err.Error(), "https is required") {
+		t.Errorf("Expected ErrSourceUnavailable with the reason, got: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package updater
+
+import (
+	"charles_communicator"
+	"common"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"event_control"
+	"fmt"
+	"initializer"
+	"peripherals"
+	"time"
+)
+
+const (
+	TARGET_STM32   = "stm32"
+	TARGET_HLK7628 = "hlk7628"
+)
+
+// HARDWARE_REVISION_TIMEOUT bounds the wait for the PCB revision of the STM32
+const HARDWARE_REVISION_TIMEOUT = 5 * time.Second
+
+var (
+	ErrNoPublicKey          = errors.New("no update public key in this build")
+	ErrInvalidManifest      = errors.New("invalid manifest")
+	ErrManifestSignature    = errors.New("invalid manifest signature")
+	ErrManifestTarget       = errors.New("manifest for another target")
+	ErrIncompatibleVersion  = errors.New("current version not compatible")
+	ErrIncompatibleHardware = errors.New("hardware revision not compatible")
+	ErrDowngrade            = errors.New("downgrade not allowed")
+	ErrPinnedVersion        = errors.New("version pinned")
+	ErrUnknownVersion       = errors.New("current version unknown")
+)
+
+// SignedManifest is the payload of the version topics. Signature is the base64 Ed25519
+// signature of the bytes of Manifest as received.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// Manifest describes a firmware. The update only applies to a device whose current version is
+// between MinVersion and MaxVersion and whose PCB revision is one of HardwareRevisions, when
+// they are set. A version older than the current one is only installed with AllowDowngrade.
+type Manifest struct {
+	Target            string   `json:"target"`
+	Version           string   `json:"version"`
+	Size              int64    `json:"size"`
+	Sha256sum         string   `json:"sha256sum"`
+	MinVersion        string   `json:"min_version,omitempty"`
+	MaxVersion        string   `json:"max_version,omitempty"`
+	HardwareRevisions []string `json:"hardware_revisions,omitempty"`
+	AllowDowngrade    bool     `json:"allow_downgrade,omitempty"`
+}
+
+// UpdateRejection is published through the rejection event when a manifest is refused.
+type UpdateRejection struct {
+	Target  string `json:"target"`
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+var updateRejectedEventId int
+
+// GetUpdateRejectedEventId is the event fired with the JSON UpdateRejection of each refused
+// manifest.
+func GetUpdateRejectedEventId() int {
+	if updateRejectedEventId == 0 {
+		updateRejectedEventId = event_control.CreateEventId()
+	}
+	return updateRejectedEventId
+}
+
+// updatePublicKey decodes common.UPDATE_PUBLIC_KEY, the base64 raw Ed25519 public key the
+// manifests are signed for.
+func updatePublicKey() (ed25519.PublicKey, error) {
+	if common.UPDATE_PUBLIC_KEY == "" {
+		return nil, ErrNoPublicKey
+	}
+	key, err := base64.StdEncoding.DecodeString(common.UPDATE_PUBLIC_KEY)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid update public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// parseManifest checks the signature of a version topic payload and returns its manifest when it
+// targets target.
+func parseManifest(payload []byte, publicKey ed25519.PublicKey, target string) (*Manifest, error) {
+	var signed SignedManifest
+	if err := json.Unmarshal(payload, &signed); err != nil || len(signed.Manifest) == 0 {
+		return nil, fmt.Errorf("%w: not a signed manifest", ErrInvalidManifest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(publicKey, signed.Manifest, signature) {
+		return nil, ErrManifestSignature
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(signed.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if manifest.Target != target {
+		return &manifest, fmt.Errorf("%w: %q", ErrManifestTarget, manifest.Target)
+	}
+	if sum, err := hex.DecodeString(manifest.Sha256sum); manifest.Version == "" || manifest.Size <= 0 || err != nil || len(sum) != 32 {
+		return &manifest, fmt.Errorf("%w: version, size and sha256sum required", ErrInvalidManifest)
+	}
+	for _, version := range []string{manifest.Version, manifest.MinVersion, manifest.MaxVersion} {
+		if _, err := ParseVersion(version); version != "" && err != nil {
+			return &manifest, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+	}
+	return &manifest, nil
+}
+
+// checkCompatibility tells whether the manifest applies to a device running currentVersion on
+// hardwareRevision. A current version that cannot be parsed is outside any version range.
+func (m *Manifest) checkCompatibility(currentVersion, hardwareRevision string) error {
+	if m.MinVersion != "" || m.MaxVersion != "" {
+		current, err := ParseVersion(currentVersion)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrIncompatibleVersion, err)
+		}
+		if minVersion, _ := ParseVersion(m.MinVersion); m.MinVersion != "" && current.Compare(minVersion) < 0 {
+			return fmt.Errorf("%w: %s older than %s", ErrIncompatibleVersion, currentVersion, m.MinVersion)
+		}
+		if maxVersion, _ := ParseVersion(m.MaxVersion); m.MaxVersion != "" && current.Compare(maxVersion) > 0 {
+			return fmt.Errorf("%w: %s newer than %s", ErrIncompatibleVersion, currentVersion, m.MaxVersion)
+		}
+	}
+	if len(m.HardwareRevisions) == 0 {
+		return nil
+	}
+	for _, revision := range m.HardwareRevisions {
+		if revision == hardwareRevision {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q not in %v", ErrIncompatibleHardware, hardwareRevision, m.HardwareRevisions)
+}
+
+// checkUpdate tells whether the firmware of the manifest must be installed on a device running
+// currentVersion. A device with a pinned version only installs that version, downgrading to it
+// if needed. Otherwise an older version is refused unless the manifest allows the downgrade.
+// An update is refused when the current version is unknown or cannot be parsed, since the
+// device may already run the release and would install it again at every announcement.
+func (m *Manifest) checkUpdate(currentVersion, pinnedVersion, hardwareRevision string) (bool, error) {
+	version, err := ParseVersion(m.Version)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	allowDowngrade := m.AllowDowngrade
+	if pinnedVersion != "" {
+		pinned, err := ParseVersion(pinnedVersion)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrPinnedVersion, err)
+		}
+		if version.Compare(pinned) != 0 {
+			return false, fmt.Errorf("%w: %s pinned", ErrPinnedVersion, pinnedVersion)
+		}
+		allowDowngrade = true
+	}
+
+	current, err := ParseVersion(currentVersion)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrUnknownVersion, err)
+	}
+	if result := version.Compare(current); result == 0 {
+		return false, nil
+	} else if result < 0 && !allowDowngrade {
+		return false, fmt.Errorf("%w: %s older than %s", ErrDowngrade, m.Version, currentVersion)
+	}
+	return true, m.checkCompatibility(currentVersion, hardwareRevision)
+}
+
+// acceptManifest verifies the payload of a version topic. A refused manifest is reported through
+// the rejection event.
+func acceptManifest(payload []byte, target string) (*Manifest, error) {
+	publicKey, err := updatePublicKey()
+	if err != nil {
+		rejectUpdate(target, "", err)
+		return nil, err
+	}
+	manifest, err := parseManifest(payload, publicKey, target)
+	if err != nil {
+		version := ""
+		if manifest != nil {
+			version = manifest.Version
+		}
+		rejectUpdate(target, version, err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// acceptUpdate tells whether the firmware of the manifest must be installed on this device,
+// before anything is downloaded. A refused update is reported through the rejection event.
+func acceptUpdate(manifest *Manifest, currentVersion, pinnedVersion string) (bool, error) {
+	update, err := manifest.checkUpdate(currentVersion, pinnedVersion, hardwareRevision())
+	if err != nil {
+		rejectUpdate(manifest.Target, manifest.Version, err)
+		return false, err
+	}
+	return update, nil
+}
+
+func rejectUpdate(target, version string, reason error) {
+	Logger.Warnf("Rejecting the %s update %s: %v", target, version, reason)
+	message, err := json.Marshal(UpdateRejection{Target: target, Version: version, Reason: reason.Error()})
+	if err != nil {
+		return
+	}
+	event_control.CallRegisteredEventFunctions(GetUpdateRejectedEventId(), 0, 0, string(message))
+}
+
+// hardwareRevision is the PCB revision answered by the STM32, or the configured one when the
+// STM32 does not answer.
+func hardwareRevision() string {
+	ctx, cancel := context.WithTimeout(context.Background(), HARDWARE_REVISION_TIMEOUT)
+	defer cancel()
+	revision, err := peripherals.GetValueContext(ctx, charles_communicator.MSG_CMD_PCB_REV)
+	if err != nil || revision == "" {
+		return initializer.GetProvisioningPCBRevision()
+	}
+	return revision
+}
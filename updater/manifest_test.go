@@ -0,0 +1,129 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testSha256sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func signManifest(t *testing.T, key ed25519.PrivateKey, manifest string) []byte {
+	t.Helper()
+	payload, err := json.Marshal(SignedManifest{
+		Manifest:  json.RawMessage(manifest),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(manifest))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestParseManifest(t *testing.T) {
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+	manifest := `{"target":"stm32","version":"1.4.0","size":1024,"sha256sum":"` + testSha256sum + `","hardware_revisions":["2","3"]}`
+
+	parsed, err := parseManifest(signManifest(t, key, manifest), publicKey, TARGET_STM32)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if parsed.Version != "1.4.0" || parsed.Size != 1024 || parsed.Sha256sum != testSha256sum || len(parsed.HardwareRevisions) != 2 {
+		t.Errorf("Unexpected manifest: %+v", parsed)
+	}
+
+	if _, err := parseManifest(signManifest(t, key, manifest), publicKey, TARGET_HLK7628); !errors.Is(err, ErrManifestTarget) {
+		t.Errorf("Expected ErrManifestTarget, got: %v", err)
+	}
+}
+
+func TestParseManifestRejectsTampering(t *testing.T) {
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	manifest := `{"target":"stm32","version":"1.4.0","size":1024,"sha256sum":"` + testSha256sum + `"}`
+
+	tampered := strings.Replace(string(signManifest(t, key, manifest)), "1.4.0", "1.5.0", 1)
+	if _, err := parseManifest([]byte(tampered), publicKey, TARGET_STM32); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("Expected ErrManifestSignature for a modified manifest, got: %v", err)
+	}
+	if _, err := parseManifest(signManifest(t, otherKey, manifest), publicKey, TARGET_STM32); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("Expected ErrManifestSignature for another key, got: %v", err)
+	}
+	unsigned := `{"version":"1.4.0","sha256sum":"` + testSha256sum + `"}`
+	if _, err := parseManifest([]byte(unsigned), publicKey, TARGET_STM32); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("Expected ErrInvalidManifest for the unsigned payload, got: %v", err)
+	}
+	incomplete := `{"target":"stm32","version":"1.4.0","sha256sum":"` + testSha256sum + `"}`
+	if _, err := parseManifest(signManifest(t, key, incomplete), publicKey, TARGET_STM32); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("Expected ErrInvalidManifest without size, got: %v", err)
+	}
+	misspelled := `{"target":"stm32","version":"1.4.O","size":1024,"sha256sum":"` + testSha256sum + `"}`
+	if _, err := parseManifest(signManifest(t, key, misspelled), publicKey, TARGET_STM32); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("Expected ErrInvalidManifest for an invalid version, got: %v", err)
+	}
+}
+
+func TestManifestCompatibility(t *testing.T) {
+	manifest := &Manifest{MinVersion: "1.2.0", MaxVersion: "1.9.9", HardwareRevisions: []string{"2", "3"}}
+
+	tests := []struct {
+		current  string
+		revision string
+		expected error
+	}{
+		{"1.2.0", "2", nil},
+		{"1.10.0", "3", ErrIncompatibleVersion},
+		{"1.1.9", "3", ErrIncompatibleVersion},
+		{"1.5.0", "1", ErrIncompatibleHardware},
+		{"1.5.0", "", ErrIncompatibleHardware},
+	}
+	for _, test := range tests {
+		err := manifest.checkCompatibility(test.current, test.revision)
+		if !errors.Is(err, test.expected) || (test.expected == nil && err != nil) {
+			t.Errorf("%s on revision %q: expected %v, got: %v", test.current, test.revision, test.expected, err)
+		}
+	}
+	if err := (&Manifest{}).checkCompatibility("0.1", ""); err != nil {
+		t.Errorf("Expected a manifest without constraints to apply, got: %v", err)
+	}
+}
+
+func TestManifestCheckUpdate(t *testing.T) {
+	tests := []struct {
+		version        string
+		allowDowngrade bool
+		current        string
+		pinned         string
+		update         bool
+		expected       error
+	}{
+		{"1.4.0", false, "1.3.9", "", true, nil},
+		{"1.10.0", false, "1.9.0", "", true, nil},
+		{"1.4.0", false, "v1.4.0", "", false, nil},
+		{"1.4.0", false, "1.4.0-rc.2", "", true, nil},
+		{"1.3.0", false, "1.4.0", "", false, ErrDowngrade},
+		{"1.3.0", true, "1.4.0", "", true, nil},
+		{"1.4.0", false, "unknown", "", false, ErrUnknownVersion},
+		{"1.4.0", false, "", "", false, ErrUnknownVersion},
+		{"1.4.0", false, "", "1.4.0", false, ErrUnknownVersion},
+		{"1.4.0", false, "1.3.0", "1.3.0", false, ErrPinnedVersion},
+		{"1.3.0", false, "1.3.0", "1.3.0", false, nil},
+		{"1.2.0", false, "1.3.0", "1.2.0", true, nil},
+		{"1.2.0", false, "1.3.0", "latest", false, ErrPinnedVersion},
+	}
+	for _, test := range tests {
+		manifest := &Manifest{Version: test.version, AllowDowngrade: test.allowDowngrade}
+		update, err := manifest.checkUpdate(test.current, test.pinned, "")
+		if update != test.update || !errors.Is(err, test.expected) || (test.expected == nil && err != nil) {
+			t.Errorf("%s over %s pinned to %q: expected %t, %v, got: %t, %v", test.version, test.current, test.pinned, test.update, test.expected, update, err)
+		}
+	}
+
+	manifest := &Manifest{Version: "1.4.0", MinVersion: "1.3.0"}
+	if _, err := manifest.checkUpdate("1.2.0", "", ""); !errors.Is(err, ErrIncompatibleVersion) {
+		t.Errorf("Expected ErrIncompatibleVersion, got: %v", err)
+	}
+}
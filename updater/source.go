@@ -0,0 +1,176 @@
+package updater
+
+import (
+	"common"
+	"context"
+	"errors"
+	"fmt"
+	"initializer"
+	"io"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SOURCE_SFTP  = "sftp"
+	SOURCE_HTTPS = "https"
+)
+
+// SFTP_ROOT is the directory of the SFTP server holding the artifacts
+const SFTP_ROOT = "Files"
+
+// ArtifactSource gives access to the update artifacts. The remote paths are relative to the root
+// of the source, e.g. stm32/<environment>/<version>/firmware.bin.
+type ArtifactSource interface {
+	Name() string
+	// Open returns the content of the artifact from offset. etag identifies the version of the
+	// artifact the first offset bytes were read from: when the artifact changed since, the
+	// content is returned from the start and Artifact.Offset is 0.
+	Open(ctx context.Context, remotePath string, offset int64, etag string) (*Artifact, error)
+}
+
+// Artifact is the content of an artifact from Offset. Size is the size of the whole artifact,
+// -1 when unknown, and ETag identifies its version.
+type Artifact struct {
+	Body   io.ReadCloser
+	Offset int64
+	Size   int64
+	ETag   string
+}
+
+var ErrSourceUnavailable = errors.New("artifact source unavailable")
+
+// newArtifactSource returns the source selected at build time by common.ARTIFACT_SOURCE, SFTP
+// when it is not set.
+func newArtifactSource() ArtifactSource {
+	return artifactSource(common.ARTIFACT_SOURCE, common.ARTIFACT_URL, common.ARTIFACT_TOKEN)
+}
+
+// artifactSource returns the source named name. A source that cannot be configured is not
+// replaced by another transport: the updates fail with ErrSourceUnavailable.
+func artifactSource(name, url, token string) ArtifactSource {
+	switch name {
+	case "", SOURCE_SFTP:
+		return newSFTPSource()
+	case SOURCE_HTTPS:
+		source, err := newHTTPSSourceFromConfig(url, token)
+		if err != nil {
+			return newUnavailableSource(SOURCE_HTTPS, err)
+		}
+		return source
+	default:
+		return newUnavailableSource(name, errors.New("unknown source"))
+	}
+}
+
+// unavailableSource stands for a misconfigured source, refusing every download.
+type unavailableSource struct {
+	name string
+	err  error
+}
+
+func newUnavailableSource(name string, err error) *unavailableSource {
+	source := &unavailableSource{name: name, err: fmt.Errorf("%w: %s: %v", ErrSourceUnavailable, name, err)}
+	Logger.Errorf("Cannot configure the artifact source, the updates are refused: %v", source.err)
+	return source
+}
+
+func (s *unavailableSource) Name() string {
+	return s.name
+}
+
+func (s *unavailableSource) Open(ctx context.Context, remotePath string, offset int64, etag string) (*Artifact, error) {
+	return nil, s.err
+}
+
+// newSFTPSource returns the source of the SFTP server set at build time, trusted and
+// authenticated as configured in the [UPDATE] section.
+func newSFTPSource() *sftpSource {
+	config := newSFTPConfig(common.SFTP_SERVER, common.SFTP_PORT, common.SFTP_USER, common.SFTP_PASS)
+	config.hostFingerprints = initializer.GetUpdateSFTPHostFingerprints()
+	config.knownHosts = initializer.GetUpdateSFTPKnownHosts()
+	config.clientKey = initializer.GetUpdateSFTPClientKey()
+	config.insecureHostKey = initializer.GetUpdateSFTPInsecureHostKey()
+	return &sftpSource{config: config, root: SFTP_ROOT}
+}
+
+// sftpSource reads the artifacts from root on the SFTP server. The ETag of an artifact is
+// derived from its size and modification time.
+type sftpSource struct {
+	config *SFTPConfig
+	root   string
+}
+
+func (s *sftpSource) Name() string {
+	return SOURCE_SFTP
+}
+
+func (s *sftpSource) Open(ctx context.Context, remotePath string, offset int64, etag string) (*Artifact, error) {
+	sshClient, err := connectSSH(ctx, s.config)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the connection unblocks the SFTP requests and the reads of the body
+	stop := context.AfterFunc(ctx, func() { sshClient.Close() })
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		stop()
+		sshClient.Close()
+		return nil, cancelledOr(ctx, fmt.Errorf("failed to create SFTP client session: %v", err))
+	}
+	body := &sftpBody{sshClient: sshClient, sftpClient: sftpClient, stop: stop}
+
+	body.file, err = sftpClient.Open(path.Join(s.root, remotePath))
+	if err != nil {
+		body.Close()
+		return nil, cancelledOr(ctx, fmt.Errorf("failed to open remote file: %v", err))
+	}
+	info, err := body.file.Stat()
+	if err != nil {
+		body.Close()
+		return nil, cancelledOr(ctx, fmt.Errorf("failed to get remote file info: %v", err))
+	}
+
+	artifact := &Artifact{Body: body, Size: info.Size(), ETag: fmt.Sprintf("%d-%d", info.Size(), info.ModTime().Unix())}
+	if offset > 0 && etag == artifact.ETag && offset <= artifact.Size {
+		if _, err := body.file.Seek(offset, io.SeekStart); err != nil {
+			body.Close()
+			return nil, cancelledOr(ctx, err)
+		}
+		artifact.Offset = offset
+	}
+	return artifact, nil
+}
+
+// cancelledOr returns the error of ctx once cancelled, since the closed connection then fails
+// the SFTP requests with unrelated errors, and err otherwise.
+func cancelledOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// sftpBody closes the SFTP session and the SSH connection with the remote file. stop unregisters
+// the closing of the connection on the cancellation of the context.
+type sftpBody struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+	file       *sftp.File
+	stop       func() bool
+}
+
+func (b *sftpBody) Read(p []byte) (int, error) {
+	return b.file.Read(p)
+}
+
+func (b *sftpBody) Close() error {
+	b.stop()
+	if b.file != nil {
+		b.file.Close()
+	}
+	b.sftpClient.Close()
+	return b.sshClient.Close()
+}
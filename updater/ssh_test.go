@@ -0,0 +1,198 @@
+package updater
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSSHServer accepts the password "secret" and the public key of clientKey, when set.
+func startSSHServer(t *testing.T, clientKey ssh.PublicKey) (ssh.Signer, string, string) {
+	t.Helper()
+	_, key, _ := ed25519.GenerateKey(nil)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if clientKey == nil || string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for channel := range channels {
+					channel.Reject(ssh.Prohibited, "")
+				}
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return hostKey, host, port
+}
+
+func TestConnectSSHPinnedHostKey(t *testing.T) {
+	hostKey, host, port := startSSHServer(t, nil)
+	config := newSFTPConfig(host, port, "device", "secret")
+	config.hostFingerprints = []string{"SHA256:other", ssh.FingerprintSHA256(hostKey.PublicKey())}
+
+	client, err := connectSSH(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.Close()
+}
+
+func TestConnectSSHRejectsUnknownHostKey(t *testing.T) {
+	_, host, port := startSSHServer(t, nil)
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	other, _ := ssh.NewPublicKey(otherKey)
+	config := newSFTPConfig(host, port, "device", "secret")
+	config.hostFingerprints = []string{ssh.FingerprintSHA256(other)}
+
+	if _, err := connectSSH(context.Background(), config); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("Expected ErrHostKeyMismatch, got: %v", err)
+	}
+}
+
+func TestConnectSSHRefusesUnpinnedServer(t *testing.T) {
+	_, host, port := startSSHServer(t, nil)
+	config := newSFTPConfig(host, port, "device", "secret")
+
+	if _, err := connectSSH(context.Background(), config); !errors.Is(err, ErrHostKeyNotPinned) {
+		t.Errorf("Expected ErrHostKeyNotPinned, got: %v", err)
+	}
+
+	config.insecureHostKey = true
+	client, err := connectSSH(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Expected the insecure mode to accept the server, got: %v", err)
+	}
+	client.Close()
+}
+
+func TestConnectSSHKnownHosts(t *testing.T) {
+	hostKey, host, port := startSSHServer(t, nil)
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, port))}, hostKey.PublicKey())
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := newSFTPConfig(host, port, "device", "secret")
+	config.knownHosts = knownHostsFile
+
+	client, err := connectSSH(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.Close()
+
+	// A server missing from the known hosts is refused
+	_, otherHost, otherPort := startSSHServer(t, nil)
+	config = newSFTPConfig(otherHost, otherPort, "device", "secret")
+	config.knownHosts = knownHostsFile
+	if _, err := connectSSH(context.Background(), config); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("Expected ErrHostKeyMismatch, got: %v", err)
+	}
+}
+
+func TestConnectSSHClientKey(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	pemBlock, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(clientKeyFile, pem.EncodeToMemory(pemBlock), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(key)
+	hostKey, host, port := startSSHServer(t, signer.PublicKey())
+
+	config := newSFTPConfig(host, port, "device", "")
+	config.hostFingerprints = []string{ssh.FingerprintSHA256(hostKey.PublicKey())}
+	config.clientKey = clientKeyFile
+	client, err := connectSSH(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.Close()
+
+	config.clientKey = ""
+	if _, err := connectSSH(context.Background(), config); err == nil {
+		t.Errorf("Expected the authentication to fail without the client key")
+	}
+}
+
+func TestConnectSSHHonorsCancellation(t *testing.T) {
+	// A server that accepts the connection but never completes the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	config := newSFTPConfig(host, port, "device", "secret")
+	config.insecureHostKey = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := connectSSH(ctx, config)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the handshake aborted on cancellation")
+	}
+}
@@ -3,6 +3,7 @@ package updater
 import (
 	"charles_communicator"
 	"common"
+	"context"
 	"crypto/sha256"
 	"device_info"
 	"encoding/hex"
@@ -12,6 +13,7 @@ import (
 	"initializer"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"peripherals"
@@ -19,25 +21,37 @@ import (
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/pkg/sftp"
-	"github.com/tidwall/gjson"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var Logger = gablogger.Logger()
 var Handler *Updater
 
+var (
+	ErrHostKeyMismatch  = errors.New("SFTP host key mismatch")
+	ErrHostKeyNotPinned = errors.New("SFTP host key not pinned")
+	ErrStm32Disabled    = errors.New("STM32 update disabled")
+)
+
+// SFTPConfig describes the SFTP server and how it is trusted. The server must present a host
+// key with one of hostFingerprints, or one of the keys of the knownHosts file for its address.
+// Any server is only accepted with insecureHostKey. clientKey is the private key of the device,
+// tried before the password.
 type SFTPConfig struct {
-	host     string
-	port     string
-	username string
-	password string
+	host             string
+	port             string
+	username         string
+	password         string
+	hostFingerprints []string
+	knownHosts       string
+	clientKey        string
+	insecureHostKey  bool
 }
 
 type Updater struct {
 	localPath      string
-	remotePath     string
-	sftp           *SFTPConfig
+	source         ArtifactSource
 	Hlk7628Topic   string
 	Stm32Topic     string
 	stm32Version   string
@@ -48,55 +62,91 @@ func InitUpdater() {
 	Handler = &Updater{}
 	Handler.Hlk7628Topic = fmt.Sprintf("environments/%s/hlk7628/version", common.ENVIRONMENT)
 	Handler.Stm32Topic = fmt.Sprintf("environments/%s/stm32/version", common.ENVIRONMENT)
-	Handler.sftp = newSFTPConfig(common.SFTP_SERVER, common.SFTP_PORT, common.SFTP_USER, common.SFTP_PASS)
+	Handler.source = newArtifactSource()
+	Logger.Infoln("Downloading the updates through " + Handler.source.Name())
+	peripherals.SetWatchdogReflash(ReflashKnownGoodFirmware)
 
-	OSVersion, err := device_info.GetOSVersion()
-	if err != nil {
-		return
-	}
-	Logger.Infoln("Current OSVersion " + OSVersion)
+	Handler.localPath = "/tmp"
+
+	// Each version is read on its own, an unknown version is read again when an update arrives
+	Logger.Infoln("Current OSVersion " + currentVersion(&Handler.hlk7628Version, device_info.GetOSVersion))
+	Logger.Infoln("Current STM32Version " + currentVersion(&Handler.stm32Version, peripherals.GetFirmwareVersion))
+}
 
-	STM32Version, err := peripherals.GetFirmwareVersion()
+// currentVersion returns the version, reading it with read when it is not known yet. It is
+// empty when it cannot be read, and the updates are then refused.
+func currentVersion(version *string, read func() (string, error)) string {
+	if *version != "" {
+		return *version
+	}
+	value, err := read()
 	if err != nil {
-		return
+		Logger.Errorf("Cannot read the current version: %v", err)
+		return ""
 	}
-	Logger.Infoln("Current STM32Version " + STM32Version)
-
-	Handler.hlk7628Version = OSVersion
-	Handler.stm32Version = STM32Version
-	Handler.localPath = "/tmp"
-	Handler.remotePath = "Files"
+	*version = value
+	return value
 }
 
 func UpdaterHlk7628Callback(client mqtt.Client, message mqtt.Message) {
-	version := gjson.Get(string(message.Payload()), "version").String()
-	sha256sum := gjson.Get(string(message.Payload()), "sha256sum").String()
+	manifest, err := acceptManifest(message.Payload(), TARGET_HLK7628)
+	if err != nil {
+		return
+	}
+	version := manifest.Version
 	Logger.Debugln("Remote OSVersion " + version)
 
-	if strings.Compare(version, Handler.hlk7628Version) != 0 {
+	update, err := acceptUpdate(manifest, currentVersion(&Handler.hlk7628Version, device_info.GetOSVersion), initializer.GetUpdatePinnedHlk7628Version())
+	if err != nil {
+		return
+	}
+	if update {
 		Logger.Infoln("Updating hlk7628 version from " + Handler.hlk7628Version + " to " + version)
-		remotePath := Handler.remotePath + "/hlk7628/" + common.ENVIRONMENT + "/" + version + "/charlinhos-sysupgrade.bin"
+		remotePath := "hlk7628/" + common.ENVIRONMENT + "/" + version + "/charlinhos-sysupgrade.bin"
 		localPath := Handler.localPath + "/charlinhos-sysupgrade.bin"
-		updateDevice(remotePath, localPath, sha256sum, applyHlk7628Update)
+		updateDevice(remotePath, localPath, manifest, applyHlk7628Update)
 	} else {
 		callHLK7628Events("updated")
 	}
 }
 
 func UpdaterStm32Callback(client mqtt.Client, message mqtt.Message) {
-	version := gjson.Get(string(message.Payload()), "version").String()
-	sha256sum := gjson.Get(string(message.Payload()), "sha256sum").String()
+	manifest, err := acceptManifest(message.Payload(), TARGET_STM32)
+	if err != nil {
+		return
+	}
+	version := manifest.Version
 	Logger.Debugln("Remote STM32Version " + version)
 
-	if strings.Compare(version, Handler.stm32Version) != 0 {
+	update, err := acceptUpdate(manifest, currentVersion(&Handler.stm32Version, peripherals.GetFirmwareVersion), initializer.GetUpdatePinnedStm32Version())
+	if err != nil {
+		return
+	}
+	if update {
 		Logger.Infoln("Updating stm32 version from " + Handler.stm32Version + " to " + version)
-		remotePath := Handler.remotePath + "/stm32/" + common.ENVIRONMENT + "/" + version + "/firmware.bin"
+		remotePath := "stm32/" + common.ENVIRONMENT + "/" + version + "/firmware.bin"
 		localPath := Handler.localPath + "/firmware.bin"
-		charles_communicator.ClosePort()
-		updateDevice(remotePath, localPath, sha256sum, applyStm32Update)
-		charles_communicator.OpenPort()
+		// The download may take minutes, the link only enters maintenance for the flash
+		if err := fetchUpdate(remotePath, localPath, manifest); err != nil {
+			Logger.Errorf("STM32 update: %v", err)
+			return
+		}
+		peripherals.SuspendWatchdog()
+		flashedVersion, err := withStm32Maintenance(func() error {
+			return applyUpdate(localPath, applyStm32Update)
+		})
+		peripherals.ResumeWatchdog()
+		if err != nil {
+			Logger.Errorf("STM32 update: %v", err)
+			return
+		}
 		Logger.Infoln("STM Updated")
-		Handler.stm32Version = version
+		if flashedVersion == "" {
+			flashedVersion = version
+		} else if flashedVersion != version {
+			Logger.Warnf("STM32 reports version %s after the update to %s", flashedVersion, version)
+		}
+		Handler.stm32Version = flashedVersion
 	} else {
 		callSTM32Events("updated")
 	}
@@ -106,47 +156,60 @@ func UpdaterStm32Callback(client mqtt.Client, message mqtt.Message) {
 //
 // Parameters:
 //
-//	remotePath: The remote path of the file to be downloaded.
+//	remotePath: The path of the file to be downloaded, relative to the artifact source.
 //	localPath: The local path where the downloaded file will be saved.
-//	expectedSha256Sum: The expected SHA256 checksum of the downloaded file.
+//	manifest: The verified manifest holding the expected size and SHA256 checksum of the file.
 //	updateFunction: A function that takes a file path as input and returns an exit status code and an error.
 //
-// The updateDevice function performs the following steps:
-//  1. Downloads the file from the remote server to the local path.
-//  2. Verifies the downloaded file using its SHA256 checksum.
-//  3. Calls the provided update function to update the device.
-//  4. Logs the outcome of the update process, including any errors or status codes.
-//
-// It handles errors that may occur during the download, verification, or update process.
-func updateDevice(remotePath, localPath, expectedSha256Sum string, updateFunction func(string) (int, error)) error {
+// It returns the error of the download, of the verification or of the update.
+func updateDevice(remotePath, localPath string, manifest *Manifest, updateFunction func(string) (int, error)) error {
 	if updateFunction == nil {
 		return errors.New("update function is nil")
 	}
+	if err := fetchUpdate(remotePath, localPath, manifest); err != nil {
+		return err
+	}
+	return applyUpdate(localPath, updateFunction)
+}
 
-	// Download the file
-	err := downloadFile(Handler.sftp, remotePath, localPath)
+// fetchUpdate downloads a file from the artifact source and verifies its size and SHA256
+// checksum against the manifest. A file that does not match is removed.
+func fetchUpdate(remotePath, localPath string, manifest *Manifest) error {
+	err := downloadArtifact(context.Background(), remotePath, localPath)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	if err := verifyFile(localPath, expectedSha256Sum); err == nil {
-		statusCode, err := updateFunction(localPath)
-		if err != nil {
-			log.Printf("Error updating device: %v. Status code: %d", err, statusCode)
-		} else {
-			if statusCode != 0 {
-				log.Printf("Device update encountered an issue. Status code: %d", statusCode)
-			} else {
-				Logger.Infoln("Update successful!")
-			}
-		}
-	} else {
+	if info, err := os.Stat(localPath); err == nil && info.Size() != manifest.Size {
+		removeFile(localPath)
+		err = fmt.Errorf("%s has %d bytes instead of %d", localPath, info.Size(), manifest.Size)
 		log.Printf("Update failed: %v", err)
+		return err
+	}
+	if err := verifyFile(localPath, manifest.Sha256sum); err != nil {
+		log.Printf("Update failed: %v", err)
+		return err
 	}
 	return nil
 }
 
+// applyUpdate updates a device with the verified file at localPath. A non zero status code is
+// an error.
+func applyUpdate(localPath string, updateFunction func(string) (int, error)) error {
+	statusCode, err := updateFunction(localPath)
+	if err != nil {
+		log.Printf("Error updating device: %v. Status code: %d", err, statusCode)
+		return err
+	}
+	if statusCode != 0 {
+		log.Printf("Device update encountered an issue. Status code: %d", statusCode)
+		return fmt.Errorf("update exited with status code %d", statusCode)
+	}
+	Logger.Infoln("Update successful!")
+	return nil
+}
+
 // verifyFile verifies the integrity of a file by comparing its SHA-256 hash with an expected hash value.
 // If the file's hash matches the expected hash, the function returns nil, indicating a successful verification.
 // If there are any errors during the verification or if the file's hash does not match the expected hash,
@@ -178,37 +241,6 @@ func verifyFile(path, expectedSha256Sum string) error {
 	return nil
 }
 
-// downloadFile downloads a file from an SFTP server and saves it locally.
-// It establishes an SSH connection using the provided SFTP configuration,
-// downloads the specified remote file, and saves it to the local file path.
-//
-// Parameters:
-//
-//   - sftpHandler: An SFTP configuration containing host, port, username, and password.
-//   - sremotePath: The remote file path on the SFTP server.
-//   - localPath: The local file path where the downloaded file will be saved.
-//
-// Returns:
-//
-//   - An error if any connection or download error occurs; otherwise, it returns nil.
-func downloadFile(sftpHandler *SFTPConfig, remotePath, localPath string) error {
-	// Establish an SSH connection to the SFTP server
-	sshClient, err := connectSSH(sftpHandler)
-	if err != nil {
-		Logger.Errorf("Error in SFTP %v\n", err)
-		return err
-	}
-	defer sshClient.Close()
-
-	// Download the file from the SFTP server and save it locally
-	err = downloadFileSFTP(sshClient, remotePath, localPath)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // removeFile removes a file at the specified path.
 func removeFile(path string) error {
 	err := os.Remove(path)
@@ -228,64 +260,106 @@ func newSFTPConfig(host, port, username, password string) *SFTPConfig {
 	}
 }
 
-// ConnectSSH establishes an SSH connection to the SFTP server.
-func connectSSH(config *SFTPConfig) (*ssh.Client, error) {
+// ConnectSSH establishes an SSH connection to the SFTP server. A server whose host key is not
+// pinned is refused with ErrHostKeyMismatch, and no connection is made when no host key is
+// pinned. Cancelling ctx aborts the dial and the handshake.
+func connectSSH(ctx context.Context, config *SFTPConfig) (*ssh.Client, error) {
+	auth, err := config.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := config.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	// The SSH client does not wrap the error of the callback
+	var mismatch error
 	sshConfig := &ssh.ClientConfig{
 		User: config.username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(config.password),
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			mismatch = hostKeyCallback(hostname, remote, key)
+			return mismatch
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	return ssh.Dial("tcp", fmt.Sprintf("%s:%s", config.host, config.port), sshConfig)
-}
-
-// downloadFileSFTP downloads a file from the SFTP server and saves it locally.
-func downloadFileSFTP(sshClient *ssh.Client, remoteFilePath, localFilePath string) error {
-	sftpClient, err := sftp.NewClient(sshClient)
+	address := net.JoinHostPort(config.host, config.port)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		return fmt.Errorf("failed to create SFTP client session: %v", err)
+		return nil, err
 	}
-	defer sftpClient.Close()
-
-	remoteFile, err := sftpClient.Open(remoteFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to open remote file: %v", err)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, sshConfig)
+	if !stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, ctx.Err()
 	}
-	defer remoteFile.Close()
-
-	remoteFileInfo, err := remoteFile.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get remote file info: %v", err)
+	if mismatch != nil {
+		return nil, mismatch
 	}
-	remoteFileSize := remoteFileInfo.Size()
-
-	localFile, err := os.Create(localFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
+		conn.Close()
+		return nil, err
 	}
-	defer localFile.Close()
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
 
-	progressChan := make(chan float64)
-	go func() {
-		for progress := range progressChan {
-			updateProgress(localFilePath, progress)
+// authMethods authenticates with the client key when configured, then with the password.
+func (config *SFTPConfig) authMethods() ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	if config.clientKey != "" {
+		pem, err := os.ReadFile(config.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the SFTP client key: %w", err)
 		}
-	}()
-	defer close(progressChan)
-
-	copiedBytes, err := copyWithProgress(localFile, remoteFile, remoteFileSize, progressChan)
-	if err != nil {
-		return fmt.Errorf("download error: %v", err)
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the SFTP client key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
 	}
+	if config.password != "" {
+		auth = append(auth, ssh.Password(config.password))
+	}
+	return auth, nil
+}
 
-	if copiedBytes != remoteFileSize {
-		return fmt.Errorf("incomplete download: expected %d bytes, got %d bytes", remoteFileSize, copiedBytes)
+// hostKeyCallback accepts the pinned host keys. Without pinned keys, the connection is refused
+// with ErrHostKeyNotPinned unless insecureHostKey explicitly accepts any server.
+func (config *SFTPConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var knownHosts ssh.HostKeyCallback
+	if config.knownHosts != "" {
+		var err error
+		knownHosts, err = knownhosts.New(config.knownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the SFTP known hosts: %w", err)
+		}
+	}
+	if len(config.hostFingerprints) == 0 && knownHosts == nil {
+		if !config.insecureHostKey {
+			return nil, ErrHostKeyNotPinned
+		}
+		Logger.Warnln("The SFTP host key is not pinned, accepting any server")
+		return ssh.InsecureIgnoreHostKey(), nil
 	}
 
-	Logger.Infof("Download of %s completed.", localFilePath)
-	return nil
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, pinned := range config.hostFingerprints {
+			if pinned == fingerprint {
+				return nil
+			}
+		}
+		if knownHosts != nil && knownHosts(hostname, remote, key) == nil {
+			return nil
+		}
+		Logger.Errorf("SFTP server %s presented the unknown %s host key %s", hostname, key.Type(), fingerprint)
+		callHostKeyMismatchEvents(HostKeyMismatch{Host: hostname, KeyType: key.Type(), Fingerprint: fingerprint})
+		return fmt.Errorf("%w: %s presented %s %s", ErrHostKeyMismatch, hostname, key.Type(), fingerprint)
+	}, nil
 }
 
 // calculateSHA256Sum calcula o hash SHA-256 de um arquivo e o retorna como uma string hexadecimal.
@@ -378,6 +452,8 @@ func applyStm32Update(path string) (int, error) {
 		callSTM32Events("update fail")
 		err = fmt.Errorf("Could not flash STM32 firmware through its entirety")
 		Logger.Errorln("Failed")
+	} else if err := keepKnownGoodFirmware(path); err != nil {
+		Logger.Errorf("Cannot keep the known-good STM32 firmware: %v", err)
 	}
 	callSTM32Events("updated")
 	if err != nil {
@@ -388,66 +464,74 @@ func applyStm32Update(path string) (int, error) {
 	return cmd.ProcessState.ExitCode(), nil
 }
 
-// copyWithProgress copies data from a source reader to a destination writer,
-// while tracking the copy progress.
-//
-// Parameters:
-//
-//	dst          - The destination writer where data will be copied to.
-//	src          - The source reader from which data will be read.
-//	size         - The total size of data to be copied (for progress calculation).
-//	progressChan - A channel to send the copy progress (in percentage).
-//
-// Returns:
-//
-//	int64 - The total number of bytes copied.
-//	error - Any error that occurs during the copy.
-//
-// The function reads data from the source reader and writes it to the destination
-// writer in blocks, while updating the progress on the progressChan channel.
-func copyWithProgress(dst io.Writer, src io.Reader, size int64, progressChan chan<- float64) (int64, error) {
-	const bufferSize = 2097152
-
-	buffer := make([]byte, bufferSize)
-	var totalBytesCopied int64
-
-	for {
-		n, err := src.Read(buffer)
-		if n > 0 {
-			totalBytesCopied += int64(n)
-
-			progress := float64(totalBytesCopied) / float64(size) * 100
-
-			progressChan <- progress
-		}
-
-		if err != nil {
-			if err == io.EOF {
-				_, err = dst.Write(buffer[:n])
-				if err != nil {
-					return totalBytesCopied, err
-				}
-				break
-			}
-			return totalBytesCopied, err
-		}
+// keepKnownGoodFirmware copies a firmware flashed successfully to the path the watchdog
+// supervisor reflashes from.
+func keepKnownGoodFirmware(path string) error {
+	knownGoodPath := initializer.GetWatchdogKnownGoodFirmware()
+	if knownGoodPath == "" || knownGoodPath == path {
+		return nil
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
 
-		_, err = dst.Write(buffer[:n])
-		if err != nil {
-			return totalBytesCopied, err
-		}
+	temporaryPath := knownGoodPath + ".tmp"
+	destination, err := os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		removeFile(temporaryPath)
+		return err
 	}
+	if err := destination.Close(); err != nil {
+		removeFile(temporaryPath)
+		return err
+	}
+	return os.Rename(temporaryPath, knownGoodPath)
+}
 
-	return totalBytesCopied, nil
+// ReflashKnownGoodFirmware flashes the last firmware flashed successfully. It is the "reflash"
+// action of the STM32 watchdog supervisor, failing with ErrStm32Disabled when the STM32 updates
+// are disabled.
+func ReflashKnownGoodFirmware() error {
+	if !initializer.IsStm32UpdateEnabled() {
+		return ErrStm32Disabled
+	}
+	path := initializer.GetWatchdogKnownGoodFirmware()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no known-good firmware: %w", err)
+	}
+	Logger.Warnln("Reflashing the known-good STM32 firmware " + path)
+	version, err := withStm32Maintenance(func() error {
+		_, err := applyStm32Update(path)
+		return err
+	})
+	if version != "" {
+		Handler.stm32Version = version
+	}
+	return err
 }
 
-// updateProgress prints the download progress as a progress bar on the same line.
-func updateProgress(localFilePath string, progress float64) {
-	const progressBarWidth = 40 // Largura da barra de progresso em caracteres
-	progressBar := strings.Repeat("=", int(progress*progressBarWidth/100))
-	spaces := strings.Repeat(" ", progressBarWidth-int(progress*progressBarWidth/100))
-	Logger.Infof("\rDownload of %s <%s%s> %.2f%%", localFilePath, progressBar, spaces, progress)
-	if progress >= 100 {
-		fmt.Println()
+// withStm32Maintenance runs flash while the STM32 link is in maintenance, so the flasher has
+// the exclusive use of the UART, and returns the firmware version read once the link is
+// restored. The version is empty when it cannot be read.
+func withStm32Maintenance(flash func() error) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), charles_communicator.MAINTENANCE_DRAIN_TIMEOUT)
+	defer cancel()
+	if err := charles_communicator.EnterMaintenance(ctx); err != nil {
+		return "", fmt.Errorf("cannot enter maintenance: %w", err)
+	}
+	flashErr := flash()
+	version, err := charles_communicator.ExitMaintenance(context.Background())
+	if flashErr != nil {
+		return version, flashErr
+	}
+	if err != nil {
+		return version, fmt.Errorf("cannot read the firmware version: %w", err)
 	}
+	return version, nil
 }
@@ -0,0 +1,44 @@
+package updater
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyUpdateErrors(t *testing.T) {
+	errFlash := errors.New("flash failed")
+	tests := []struct {
+		statusCode int
+		err        error
+		failed     bool
+	}{
+		{0, nil, false},
+		{1, nil, true},
+		{2, errFlash, true},
+	}
+	for _, test := range tests {
+		err := applyUpdate("firmware.bin", func(string) (int, error) { return test.statusCode, test.err })
+		if (err != nil) != test.failed || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("Status code %d and %v: expected failed %t, got: %v", test.statusCode, test.err, test.failed, err)
+		}
+	}
+}
+
+func TestCurrentVersionReadAgainWhenUnknown(t *testing.T) {
+	var version string
+	reads := 0
+	failing := func() (string, error) {
+		reads++
+		return "", errors.New("no answer")
+	}
+	if currentVersion(&version, failing) != "" {
+		t.Errorf("Expected an unknown version")
+	}
+	read := func() (string, error) {
+		reads++
+		return "1.4.0", nil
+	}
+	if currentVersion(&version, read) != "1.4.0" || currentVersion(&version, read) != "1.4.0" || reads != 2 {
+		t.Errorf("Expected the version read once known, got: %q after %d reads", version, reads)
+	}
+}
@@ -0,0 +1,111 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidVersion = errors.New("invalid version")
+
+// Version is a semantic version, MAJOR.MINOR.PATCH with an optional pre-release. The build
+// metadata is ignored.
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease []string
+}
+
+// ParseVersion parses a semantic version with an optional leading "v". The patch, and the minor,
+// default to 0 so that the 1.2 versions of the older firmwares are accepted.
+func ParseVersion(value string) (Version, error) {
+	var version Version
+	core := strings.TrimPrefix(strings.TrimSpace(value), "v")
+	if i := strings.IndexByte(core, '+'); i >= 0 {
+		core = core[:i]
+	}
+	if i := strings.IndexByte(core, '-'); i >= 0 {
+		version.Prerelease = strings.Split(core[i+1:], ".")
+		core = core[:i]
+		for _, identifier := range version.Prerelease {
+			if identifier == "" {
+				return Version{}, fmt.Errorf("%w: %q", ErrInvalidVersion, value)
+			}
+		}
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("%w: %q", ErrInvalidVersion, value)
+	}
+	numbers := []*int{&version.Major, &version.Minor, &version.Patch}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 || part != strconv.Itoa(number) {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalidVersion, value)
+		}
+		*numbers[i] = number
+	}
+	return version, nil
+}
+
+func (v Version) String() string {
+	version := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		version += "-" + strings.Join(v.Prerelease, ".")
+	}
+	return version
+}
+
+// Compare returns -1, 0 or 1 when v precedes, equals or follows other, e.g.
+// 1.9.0 < 1.10.0-rc.1 < 1.10.0.
+func (v Version) Compare(other Version) int {
+	for _, pair := range [][2]int{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if pair[0] != pair[1] {
+			return compareInts(pair[0], pair[1])
+		}
+	}
+	// A release follows its pre-releases
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		if result := compareIdentifiers(v.Prerelease[i], other.Prerelease[i]); result != 0 {
+			return result
+		}
+	}
+	return compareInts(len(v.Prerelease), len(other.Prerelease))
+}
+
+// compareIdentifiers compares pre-release identifiers: numeric ones numerically and before the
+// alphanumeric ones, which are compared as strings.
+func compareIdentifiers(a, b string) int {
+	numberA, errA := strconv.Atoi(a)
+	numberB, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return compareInts(numberA, numberB)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
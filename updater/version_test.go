@@ -0,0 +1,48 @@
+package updater
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"1.4.0", "1.4.0"},
+		{"v2.10.3", "2.10.3"},
+		{"1.2", "1.2.0"},
+		{"1.0.0-rc.1+build.5", "1.0.0-rc.1"},
+	}
+	for _, test := range tests {
+		version, err := ParseVersion(test.value)
+		if err != nil || version.String() != test.expected {
+			t.Errorf("%q: expected %s, got: %s, %v", test.value, test.expected, version, err)
+		}
+	}
+
+	for _, value := range []string{"", "1.4.0.1", "1.x.0", "1.04.0", "1.-2.0", "1.0.0-", "1.0.0-rc..1", "latest"} {
+		if _, err := ParseVersion(value); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("%q: expected ErrInvalidVersion, got: %v", value, err)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.2.0", "1.9.2", "1.10.0"}
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := ParseVersion(ordered[i])
+			b, _ := ParseVersion(ordered[j])
+			if result := a.Compare(b); result != compareInts(i, j) {
+				t.Errorf("%s compared to %s: expected %d, got %d", ordered[i], ordered[j], compareInts(i, j), result)
+			}
+		}
+	}
+	a, _ := ParseVersion("v1.2")
+	b, _ := ParseVersion("1.2.0+build.7")
+	if a.Compare(b) != 0 {
+		t.Errorf("Expected v1.2 and 1.2.0+build.7 to be equal")
+	}
+}